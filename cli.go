@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"middleware/handler/archive"
+	"middleware/handler/db"
+	"os"
+	"path/filepath"
+)
+
+// runCommand runs a subcommand given on command line instead of serving:
+//
+//	export FILE
+//	import [-dry-run] [-on-conflict skip|rename|fail] [-from archive|markdown|wxr|disqus] PATH
+func runCommand(d db.DB, args []string) error {
+	switch args[0] {
+	case "export":
+		if len(args) != 2 {
+			return errors.New("usage: export FILE")
+		}
+		f, err := os.Create(args[1])
+		if err != nil {
+			return fmt.Errorf("create archive: %v", err)
+		}
+		if err := archive.Export(d, f); err != nil {
+			f.Close()
+			return fmt.Errorf("export archive: %v", err)
+		}
+		return f.Close()
+	case "import":
+		fs := flag.NewFlagSet("import", flag.ContinueOnError)
+		dryRun := fs.Bool("dry-run", false, "report what would be imported without writing anything")
+		onConflict := fs.String("on-conflict", archive.ConflictSkip, "what to do with a post whose title is taken: skip, rename or fail")
+		from := fs.String("from", "archive", "format of PATH: archive, markdown (a Hugo or Jekyll content directory), wxr or disqus")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if fs.NArg() != 1 {
+			return errors.New("usage: import [-dry-run] [-on-conflict skip|rename|fail] [-from archive|markdown|wxr|disqus] PATH")
+		}
+		opt := &archive.ImportOptions{DryRun: *dryRun, OnConflict: *onConflict}
+		rp, err := importFrom(d, *from, fs.Arg(0), opt)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(rp)
+	default:
+		return fmt.Errorf("unknown command %s, expects export or import", args[0])
+	}
+}
+
+// importFrom imports content at path in format from
+func importFrom(d db.DB, from, path string, opt *archive.ImportOptions) (*archive.Report, error) {
+	var (
+		a    *archive.Archive
+		conv *archive.Report
+	)
+	switch from {
+	case "archive":
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("open archive: %v", err)
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			return nil, fmt.Errorf("stat archive: %v", err)
+		}
+		a, err = archive.Read(f, fi.Size(), archive.DefaultMaxUncompressed)
+		if err != nil {
+			return nil, fmt.Errorf("read archive: %v", err)
+		}
+	case "markdown":
+		files := map[string][]byte{}
+		err := filepath.Walk(path, func(name string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(path, name)
+			if err != nil {
+				return err
+			}
+			files[filepath.ToSlash(rel)], err = ioutil.ReadFile(name)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("read markdown directory: %v", err)
+		}
+		a, conv, err = archive.FromMarkdown(files)
+		if err != nil {
+			return nil, fmt.Errorf("convert markdown: %v", err)
+		}
+	case "wxr", "disqus":
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("open %s export: %v", from, err)
+		}
+		defer f.Close()
+		if from == "disqus" {
+			return archive.ImportDisqus(d, f, opt)
+		}
+		a, conv, err = archive.FromWXR(f)
+		if err != nil {
+			return nil, fmt.Errorf("convert wxr: %v", err)
+		}
+	default:
+		return nil, errors.New("-from is not archive, markdown, wxr or disqus")
+	}
+	rp, err := archive.Import(d, a, opt)
+	if err != nil {
+		return nil, fmt.Errorf("import archive: %v", err)
+	}
+	if conv != nil {
+		rp.Add(conv)
+	}
+	return rp, nil
+}
@@ -0,0 +1,7 @@
+package filemail
+
+// FileConfig contains necessary of a FileMailer
+type FileConfig struct {
+	// Dir is directory emails are written into, one .eml file each
+	Dir string
+}
@@ -0,0 +1,81 @@
+package filemail
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"middleware/handler/mailer"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FileMailer writes emails into files of a directory instead of sending them,
+// it is meant for development
+type FileMailer struct {
+	config *FileConfig
+}
+
+// New uses FileConfig, returns FileMailer instance
+func New(c *FileConfig) (*FileMailer, error) {
+	cfg, err := validConfig(c)
+	if err != nil {
+		return nil, fmt.Errorf("validate config: %v", err)
+	}
+	err = os.MkdirAll(cfg.Dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("create mail dir: %v", err)
+	}
+	return &FileMailer{config: cfg}, nil
+}
+
+func validConfig(r *FileConfig) (*FileConfig, error) {
+	n := *r
+
+	if n.Dir == "" {
+		return nil, errors.New("empty mail dir")
+	}
+	return &n, nil
+}
+
+// headerValue drops line breaks so values cannot add headers
+func headerValue(v string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(v)
+}
+
+// Send implements mailer.Mailer, m is written as a message of RFC 5322 named by
+// time it is sent, so files list in order
+func (fm *FileMailer) Send(m *mailer.Message) error {
+	now := time.Now()
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", headerValue(m.From))
+	fmt.Fprintf(&b, "To: %s\r\n", headerValue(m.To))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", headerValue(m.Subject)))
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	keys := make([]string, 0, len(m.Headers))
+	for k := range m.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s: %s\r\n", headerValue(k), headerValue(m.Headers[k]))
+	}
+	b.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.Replace(m.Body, "\n", "\r\n", -1))
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return fmt.Errorf("generate file name: %v", err)
+	}
+	name := filepath.Join(fm.config.Dir, fmt.Sprintf("%d-%s.eml", now.UnixNano(), hex.EncodeToString(suffix)))
+	if err := ioutil.WriteFile(name, b.Bytes(), 0644); err != nil {
+		return fmt.Errorf("write %s: %v", name, err)
+	}
+	return nil
+}
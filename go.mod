@@ -3,10 +3,10 @@ module middleware
 go 1.13
 
 require (
-    github.com/Jeffail/gabs/v2 v2.4.0
-    github.com/drhodes/golorem v0.0.0-20160418191928-ecccc744c2d9
-    github.com/golang/mock v1.3.1
-    github.com/google/uuid v1.1.1
-    github.com/lib/pq v1.3.0
-    golang.org/x/crypto v0.0.0-20200728195943-123391ffb6de // indirect
-)
\ No newline at end of file
+	github.com/Jeffail/gabs/v2 v2.4.0
+	github.com/drhodes/golorem v0.0.0-20160418191928-ecccc744c2d9
+	github.com/golang/mock v1.3.1
+	github.com/google/uuid v1.1.1
+	github.com/lib/pq v1.3.0
+	golang.org/x/crypto v0.0.0-20200728195943-123391ffb6de
+)
@@ -0,0 +1,260 @@
+package handler
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"middleware/handler/db"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// viewCounter buffers views of posts in memory and flushes them to db in batches,
+// readers are told apart by a hash of their address and user agent salted with a
+// random value that is replaced every day and never stored, so neither cookies
+// nor addresses are kept and hashes cannot be linked across days
+type viewCounter struct {
+	d          db.DB
+	maxPending int
+	// kick asks flusher for an early flush, done stops it and stopped
+	// is closed once its last flush is over
+	kick      chan struct{}
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+
+	mu      sync.Mutex
+	salt    []byte
+	saltDay time.Time
+	records map[viewKey]*viewBuffer
+}
+
+type viewKey struct {
+	pid int
+	day time.Time
+}
+
+type viewBuffer struct {
+	views     int
+	visitors  map[string]bool
+	referrers map[string]int
+}
+
+func newViewCounter(d db.DB, cfg *AnalyticsConfig) *viewCounter {
+	vc := &viewCounter{d: d, maxPending: cfg.MaxPending, records: make(map[viewKey]*viewBuffer),
+		kick: make(chan struct{}, 1), done: make(chan struct{}), stopped: make(chan struct{})}
+	go vc.flusher(cfg.FlushInterval)
+	return vc
+}
+
+// flusher is only goroutine flushing, so flushes never overlap, views are flushed on
+// interval and when buffer is full, but a full buffer waits for interval after a
+// failed flush instead of retrying on every view
+func (vc *viewCounter) flusher(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	failed := false
+	for {
+		select {
+		case <-ticker.C:
+			failed = !vc.flush()
+		case <-vc.kick:
+			if !failed {
+				failed = !vc.flush()
+			}
+		case <-vc.done:
+			vc.flush()
+			close(vc.stopped)
+			return
+		}
+	}
+}
+
+// close stops flusher after a last flush of buffered views, and waits for it
+func (vc *viewCounter) close() {
+	vc.closeOnce.Do(func() {
+		close(vc.done)
+	})
+	<-vc.stopped
+}
+
+// botMarks are substrings of user agents of crawlers, whose views are not counted
+var botMarks = []string{"bot", "crawl", "spider", "slurp", "preview"}
+
+// record counts a view of post of pid by request
+func (vc *viewCounter) record(pid int, r *http.Request) {
+	ua := strings.ToLower(r.UserAgent())
+	if ua == "" {
+		return
+	}
+	for _, mark := range botMarks {
+		if strings.Contains(ua, mark) {
+			return
+		}
+	}
+
+	now := time.Now().UTC()
+	day := now.Truncate(24 * time.Hour)
+
+	vc.mu.Lock()
+	if vc.salt == nil || !vc.saltDay.Equal(day) {
+		salt := make([]byte, 32)
+		if _, err := rand.Read(salt); err != nil {
+			vc.mu.Unlock()
+			log.Printf("rotate visitor salt: %v\n", err)
+			return
+		}
+		vc.salt, vc.saltDay = salt, day
+	}
+	h := sha256.New()
+	h.Write(vc.salt)
+	h.Write([]byte(clientIP(r)))
+	h.Write([]byte{0})
+	h.Write([]byte(r.UserAgent()))
+	visitor := hex.EncodeToString(h.Sum(nil)[:16])
+
+	key := viewKey{pid, day}
+	buf, ok := vc.records[key]
+	if !ok {
+		buf = &viewBuffer{visitors: make(map[string]bool), referrers: make(map[string]int)}
+		vc.records[key] = buf
+	}
+	buf.views++
+	buf.visitors[visitor] = true
+	if domain := referrerDomain(r); domain != "" {
+		buf.referrers[domain]++
+	}
+	full := len(vc.records) >= vc.maxPending
+	vc.mu.Unlock()
+
+	if full {
+		select {
+		case vc.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// referrerDomain returns domain of referer of request, empty if it is missing or same site
+func referrerDomain(r *http.Request) string {
+	ref, err := url.Parse(r.Referer())
+	if err != nil || ref.Hostname() == "" {
+		return ""
+	}
+	domain := strings.TrimPrefix(strings.ToLower(ref.Hostname()), "www.")
+	host := strings.TrimPrefix(strings.ToLower(r.Host), "www.")
+	if i := strings.IndexByte(host, ':'); i >= 0 {
+		host = host[:i]
+	}
+	if domain == host {
+		return ""
+	}
+	return domain
+}
+
+// flush writes buffered views to db, they are kept for next flush if it fails
+func (vc *viewCounter) flush() bool {
+	vc.mu.Lock()
+	records := vc.records
+	vc.records = make(map[viewKey]*viewBuffer)
+	vc.mu.Unlock()
+	if len(records) == 0 {
+		return true
+	}
+
+	batch := make([]db.ViewRecord, 0, len(records))
+	for key, buf := range records {
+		rec := db.ViewRecord{PostID: key.pid, Day: key.day, Views: buf.views, Referrers: buf.referrers}
+		for v := range buf.visitors {
+			rec.Visitors = append(rec.Visitors, v)
+		}
+		batch = append(batch, rec)
+	}
+	err := vc.d.RecordViews(batch)
+	if err == nil {
+		return true
+	}
+	log.Printf("flush %d view records: %v\n", len(batch), err)
+
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+	for key, buf := range records {
+		cur, ok := vc.records[key]
+		if !ok {
+			vc.records[key] = buf
+			continue
+		}
+		cur.views += buf.views
+		for v := range buf.visitors {
+			cur.visitors[v] = true
+		}
+		for domain, n := range buf.referrers {
+			cur.referrers[domain] += n
+		}
+	}
+	return false
+}
+
+func viewAnalytics(d db.DB, r *http.Request) (*db.Analytics, error) {
+	to := time.Now().UTC().Truncate(24 * time.Hour)
+	from := to.AddDate(0, 0, -29)
+	var err error
+	if toStr := r.FormValue("to"); toStr != "" {
+		to, err = time.Parse("2006-01-02", toStr)
+		if err != nil {
+			return nil, fmt.Errorf("parse to as date: %v", err)
+		}
+	}
+	if fromStr := r.FormValue("from"); fromStr != "" {
+		from, err = time.Parse("2006-01-02", fromStr)
+		if err != nil {
+			return nil, fmt.Errorf("parse from as date: %v", err)
+		}
+	}
+	if from.After(to) {
+		return nil, errors.New("from cannot be after to")
+	}
+	if to.Sub(from) > 366*24*time.Hour {
+		return nil, errors.New("period cannot be longer than a year")
+	}
+
+	var pid int
+	if pidStr := r.FormValue("pid"); pidStr != "" {
+		pid, err = strconv.Atoi(pidStr)
+		if err != nil {
+			return nil, fmt.Errorf("convert pid to int: %v", err)
+		}
+	}
+	limit := 10
+	if limitStr := r.FormValue("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil {
+			return nil, fmt.Errorf("convert limit to int: %v", err)
+		}
+		if limit <= 0 || limit > 100 {
+			return nil, errors.New("limit out of [1, 100]")
+		}
+	}
+
+	an := &db.Analytics{}
+	an.Daily, err = d.GetDailyViews(from, to, pid)
+	if err != nil {
+		return nil, fmt.Errorf("get daily views: %v", err)
+	}
+	an.Top, err = d.GetTopPosts(from, to, limit)
+	if err != nil {
+		return nil, fmt.Errorf("get top posts: %v", err)
+	}
+	an.Referrers, err = d.GetReferrers(from, to, limit)
+	if err != nil {
+		return nil, fmt.Errorf("get referrers: %v", err)
+	}
+	return an, nil
+}
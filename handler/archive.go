@@ -0,0 +1,96 @@
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"middleware/handler/archive"
+	"middleware/handler/db"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// archiveExport streams every post, comment and user as an archive
+type archiveExport struct {
+	d db.DB
+}
+
+func (ae archiveExport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(`Content-Type`, `application/zip`)
+	w.Header().Set(`Content-Disposition`, `attachment; filename="blog-`+time.Now().UTC().Format("20060102")+`.zip"`)
+	// headers are sent with first bytes, a failure later can only cut the archive short
+	if err := archive.Export(ae.d, w); err != nil {
+		log.Printf("export archive: %v", err)
+	}
+}
+
+// sources of /archive import and types of body they are sent as
+var archiveSources = map[string][]string{
+	"archive":  {"application/zip"},
+	"markdown": {"application/zip"},
+	"wxr":      {"application/xml", "text/xml"},
+	"disqus":   {"application/xml", "text/xml"},
+}
+
+// importArchive imports body of r, which is an archive or an export of another blog by source,
+// options are read from query
+func importArchive(d db.DB, cfg *ArchiveConfig, w http.ResponseWriter, r *http.Request) (*archive.Report, error) {
+	source := r.FormValue("source")
+	if source == "" {
+		source = "archive"
+	}
+	types, ok := archiveSources[source]
+	if !ok {
+		return nil, errors.New("source is not archive, markdown, wxr or disqus")
+	}
+	ct := strings.TrimSpace(strings.Split(r.Header.Get("Content-Type"), ";")[0])
+	allowed := false
+	for _, t := range types {
+		allowed = allowed || t == ct
+	}
+	if !allowed {
+		return nil, fmt.Errorf("request body of %s is not %s", source, strings.Join(types, " or "))
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, cfg.MaxSize))
+	if err != nil {
+		return nil, fmt.Errorf("read body of at most %d bytes: %v", cfg.MaxSize, err)
+	}
+	opt := &archive.ImportOptions{DryRun: r.FormValue("dryRun") == "true", OnConflict: r.FormValue("onConflict")}
+
+	var (
+		a    *archive.Archive
+		conv *archive.Report
+	)
+	switch source {
+	case "archive":
+		a, err = archive.Read(bytes.NewReader(body), int64(len(body)), cfg.MaxUncompressed)
+	case "markdown":
+		var files map[string][]byte
+		files, err = archive.ZipFiles(bytes.NewReader(body), int64(len(body)), cfg.MaxUncompressed)
+		if err == nil {
+			a, conv, err = archive.FromMarkdown(files)
+		}
+	case "wxr":
+		a, conv, err = archive.FromWXR(bytes.NewReader(body))
+	case "disqus":
+		rp, err := archive.ImportDisqus(d, bytes.NewReader(body), opt)
+		if err != nil {
+			return nil, fmt.Errorf("import disqus comments: %v", err)
+		}
+		return rp, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %v", source, err)
+	}
+	rp, err := archive.Import(d, a, opt)
+	if err != nil {
+		return nil, fmt.Errorf("import archive: %v", err)
+	}
+	if conv != nil {
+		rp.Add(conv)
+	}
+	return rp, nil
+}
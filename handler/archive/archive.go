@@ -0,0 +1,340 @@
+// Package archive moves content of a blog between servers as a zip of Markdown posts
+// with YAML front matter and a JSON manifest which lists posts and holds comments and users
+package archive
+
+import (
+	"archive/zip"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"middleware/handler/db"
+	"strconv"
+	"time"
+)
+
+const (
+	manifestName  = "manifest.json"
+	formatName    = "blog-archive"
+	formatVersion = 1
+	// exportBatch is how many rows are read from db at once while exporting
+	exportBatch = 100
+	// DefaultMaxUncompressed is max bytes files of a zip may take once decompressed,
+	// unless another limit is given
+	DefaultMaxUncompressed = 256 << 20
+)
+
+// Archive is content of a blog, ids in it are those of the blog it is exported from
+type Archive struct {
+	Posts    []db.Post
+	Comments []db.Comment
+	Users    []db.UserAccount
+}
+
+// manifest is manifest.json of an archive
+type manifest struct {
+	Format     string         `json:"format"`
+	Version    int            `json:"version"`
+	ExportedAt time.Time      `json:"exportedAt"`
+	Posts      []postEntry    `json:"posts"`
+	Comments   []commentEntry `json:"comments"`
+	Users      []userEntry    `json:"users"`
+}
+
+// postEntry names Markdown file of a post
+type postEntry struct {
+	PostID int    `json:"pid"`
+	File   string `json:"file"`
+}
+
+type commentEntry struct {
+	CommentID int    `json:"cid"`
+	PostID    int    `json:"pid"`
+	Email     string `json:"email"`
+	// AuthorName is missing in archives exported before commenters gave names
+	AuthorName string    `json:"authorName,omitempty"`
+	CDate      time.Time `json:"cDate"`
+	Content    string    `json:"content"`
+	ParentID   int       `json:"parentCid,omitempty"`
+	Deleted    bool      `json:"deleted,omitempty"`
+	// Status is missing in archives exported before comments were moderated, they are approved
+	Status string `json:"status,omitempty"`
+}
+
+type userEntry struct {
+	UID       int    `json:"uid"`
+	UserName  string `json:"userName"`
+	Privilege int    `json:"privilege"`
+	// PassWord is hex of sha256 hash of password
+	PassWord string `json:"passWord"`
+}
+
+// writer writes posts into a zip as they come, comments and users are kept
+// in manifest written on close
+type writer struct {
+	zw *zip.Writer
+	m  manifest
+}
+
+func newWriter(w io.Writer) *writer {
+	return &writer{
+		zw: zip.NewWriter(w),
+		m: manifest{Format: formatName, Version: formatVersion, ExportedAt: time.Now().UTC(),
+			Posts: []postEntry{}, Comments: []commentEntry{}, Users: []userEntry{}},
+	}
+}
+
+func (aw *writer) writePost(p *db.Post) error {
+	fmw := newFMWriter()
+	fmw.field("pid", p.PostID)
+	fmw.field("title", p.Title)
+	if p.CDate != nil {
+		fmw.field("cDate", time.Time(*p.CDate))
+	}
+	if p.MDate != nil {
+		fmw.field("mDate", time.Time(*p.MDate))
+	}
+	fmw.field("tags", append([]string{}, p.Tags...))
+	if p.Language != "" {
+		fmw.field("language", p.Language)
+	}
+	if p.TranslationGroup != 0 {
+		fmw.field("translationGroup", p.TranslationGroup)
+	}
+	if p.Pinned {
+		fmw.field("pinned", true)
+		if p.PinnedUntil != nil {
+			fmw.field("pinnedUntil", time.Time(*p.PinnedUntil))
+		}
+	}
+	if p.Featured {
+		fmw.field("featured", true)
+	}
+
+	name := "posts/" + strconv.Itoa(p.PostID) + ".md"
+	f, err := aw.zw.Create(name)
+	if err != nil {
+		return fmt.Errorf("create %s: %v", name, err)
+	}
+	if _, err := f.Write(fmw.bytes(p.Content)); err != nil {
+		return fmt.Errorf("write %s: %v", name, err)
+	}
+	aw.m.Posts = append(aw.m.Posts, postEntry{PostID: p.PostID, File: name})
+	return nil
+}
+
+func (aw *writer) addComment(c *db.Comment) {
+	ce := commentEntry{CommentID: c.CommentID, PostID: c.PostID, Email: c.Email, AuthorName: c.AuthorName, Content: c.Content, ParentID: c.ParentID,
+		Deleted: c.Deleted, Status: c.Status}
+	if c.CDate != nil {
+		ce.CDate = time.Time(*c.CDate)
+	}
+	aw.m.Comments = append(aw.m.Comments, ce)
+}
+
+func (aw *writer) addUser(u *db.UserAccount) {
+	aw.m.Users = append(aw.m.Users, userEntry{UID: u.UID, UserName: u.UserName, Privilege: u.Privilege, PassWord: hex.EncodeToString(u.PassWord[:])})
+}
+
+// close writes manifest and finishes zip, underlying writer is not closed
+func (aw *writer) close() error {
+	f, err := aw.zw.Create(manifestName)
+	if err != nil {
+		return fmt.Errorf("create manifest: %v", err)
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(&aw.m); err != nil {
+		return fmt.Errorf("write manifest: %v", err)
+	}
+	return aw.zw.Close()
+}
+
+// Write writes a as an archive to w
+func Write(w io.Writer, a *Archive) error {
+	aw := newWriter(w)
+	for i := range a.Posts {
+		if err := aw.writePost(&a.Posts[i]); err != nil {
+			return err
+		}
+	}
+	for i := range a.Comments {
+		aw.addComment(&a.Comments[i])
+	}
+	for i := range a.Users {
+		aw.addUser(&a.Users[i])
+	}
+	return aw.close()
+}
+
+// Export streams every post, comment and user of d as an archive to w,
+// posts are read in batches so they are never all held in memory
+func Export(d db.DB, w io.Writer) error {
+	aw := newWriter(w)
+	for after := 0; ; {
+		posts, err := d.GetPostsAfter(after, exportBatch)
+		if err != nil {
+			return fmt.Errorf("get posts: %v", err)
+		}
+		for i := range posts {
+			if err := aw.writePost(&posts[i]); err != nil {
+				return err
+			}
+			after = posts[i].PostID
+		}
+		if len(posts) < exportBatch {
+			break
+		}
+	}
+	for after := 0; ; {
+		cmts, err := d.GetCommentsAfter(after, exportBatch)
+		if err != nil {
+			return fmt.Errorf("get comments: %v", err)
+		}
+		for i := range cmts {
+			aw.addComment(&cmts[i])
+			after = cmts[i].CommentID
+		}
+		if len(cmts) < exportBatch {
+			break
+		}
+	}
+	users, err := d.GetUserAccounts()
+	if err != nil {
+		return fmt.Errorf("get users: %v", err)
+	}
+	for i := range users {
+		aw.addUser(&users[i])
+	}
+	return aw.close()
+}
+
+// Read reads an archive of size bytes from r, whose files take at most maxUncompressed
+// bytes once decompressed
+func Read(r io.ReaderAt, size, maxUncompressed int64) (*Archive, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("open zip: %v", err)
+	}
+	files := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+	mf, ok := files[manifestName]
+	if !ok {
+		return nil, errors.New("no " + manifestName + " in archive")
+	}
+	zb := &zipBudget{left: maxUncompressed}
+	b, err := zb.read(mf)
+	if err != nil {
+		return nil, err
+	}
+	var m manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("parse manifest: %v", err)
+	}
+	if m.Format != formatName || m.Version > formatVersion {
+		return nil, fmt.Errorf("archive format %s %d is not supported", m.Format, m.Version)
+	}
+
+	a := &Archive{}
+	for _, pe := range m.Posts {
+		f, ok := files[pe.File]
+		if !ok {
+			return nil, fmt.Errorf("no %s of post %d in archive", pe.File, pe.PostID)
+		}
+		b, err := zb.read(f)
+		if err != nil {
+			return nil, err
+		}
+		p, err := parsePost(string(b))
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %v", pe.File, err)
+		}
+		p.PostID = pe.PostID
+		a.Posts = append(a.Posts, *p)
+	}
+	for _, ce := range m.Comments {
+		cDate := db.Jstime(ce.CDate)
+		a.Comments = append(a.Comments, db.Comment{CommentID: ce.CommentID, PostID: ce.PostID, Email: ce.Email, AuthorName: ce.AuthorName, CDate: &cDate,
+			Content: ce.Content, ParentID: ce.ParentID, Deleted: ce.Deleted, Status: ce.Status})
+	}
+	for _, ue := range m.Users {
+		u := db.UserAccount{User: db.User{UID: ue.UID, UserName: ue.UserName, Privilege: ue.Privilege}}
+		pw, err := hex.DecodeString(ue.PassWord)
+		if err != nil || len(pw) != len(u.PassWord) {
+			return nil, fmt.Errorf("password of user %d is not hex of a sha256 hash", ue.UID)
+		}
+		copy(u.PassWord[:], pw)
+		a.Users = append(a.Users, u)
+	}
+	return a, nil
+}
+
+// zipBudget is how many bytes files of a zip may still take once decompressed,
+// so a zip bomb is refused instead of filling memory
+type zipBudget struct {
+	left int64
+}
+
+// read reads file f, it fails if f does not fit in what is left of budget, by size
+// its header declares or, since a header may lie, by bytes it decompresses to
+func (zb *zipBudget) read(f *zip.File) ([]byte, error) {
+	if f.UncompressedSize64 > uint64(zb.left) {
+		return nil, fmt.Errorf("%s is larger than %d bytes left to decompress", f.Name, zb.left)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %v", f.Name, err)
+	}
+	defer rc.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(rc, zb.left+1))
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %v", f.Name, err)
+	}
+	if int64(len(b)) > zb.left {
+		return nil, fmt.Errorf("%s is larger than %d bytes left to decompress", f.Name, zb.left)
+	}
+	zb.left -= int64(len(b))
+	return b, nil
+}
+
+// parsePost parses a Markdown file of a post written by writePost
+func parsePost(doc string) (*db.Post, error) {
+	fm, body, err := splitFrontMatter(doc)
+	if err != nil {
+		return nil, err
+	}
+	p := &db.Post{Content: body}
+	if p.Title, err = fm.str("title"); err != nil {
+		return nil, err
+	}
+	if p.Tags, err = fm.strs("tags"); err != nil {
+		return nil, err
+	}
+	if p.Language, err = fm.str("language"); err != nil {
+		return nil, err
+	}
+	if p.TranslationGroup, err = fm.int("translationGroup"); err != nil {
+		return nil, err
+	}
+	if p.Pinned, err = fm.bool("pinned"); err != nil {
+		return nil, err
+	}
+	if p.Featured, err = fm.bool("featured"); err != nil {
+		return nil, err
+	}
+	for key, dst := range map[string]**db.Jstime{"cDate": &p.CDate, "mDate": &p.MDate, "pinnedUntil": &p.PinnedUntil} {
+		t, err := fm.time(key)
+		if err != nil {
+			return nil, err
+		}
+		if t != nil {
+			jt := db.Jstime(*t)
+			*dst = &jt
+		}
+	}
+	return p, nil
+}
@@ -0,0 +1,143 @@
+package archive
+
+import (
+	"archive/zip"
+	"fmt"
+	"html"
+	"io"
+	"middleware/handler/db"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// converter collects an archive converted from another blog, fields are fitted
+// into schema on the way and what is skipped or cut is reported
+type converter struct {
+	a  Archive
+	rp *Report
+}
+
+func newConverter() *converter {
+	return &converter{rp: newReport(false)}
+}
+
+func (c *converter) skip(kind string, id int, source, reason string) {
+	c.rp.Skipped = append(c.rp.Skipped, Skipped{Kind: kind, ID: id, Source: source, Reason: reason})
+}
+
+func (c *converter) truncate(kind string, id int, source, field, reason string) {
+	c.rp.Truncated = append(c.rp.Truncated, Truncated{Kind: kind, ID: id, Source: source, Field: field, Reason: reason})
+}
+
+// addPost fits title, content and tags of p, a post too short to fit is skipped
+func (c *converter) addPost(source string, p db.Post) bool {
+	p.Title = strings.Join(strings.Fields(p.Title), " ")
+	if utf8.RuneCountInString(p.Title) < db.MinTitleLen {
+		c.skip("post", p.PostID, source, fmt.Sprintf("title %q is shorter than %d characters", p.Title, db.MinTitleLen))
+		return false
+	}
+	if cut, ok := cutRunes(p.Title, db.MaxTitleLen); ok {
+		c.truncate("post", p.PostID, source, "title", fmt.Sprintf("%q is cut to %q", p.Title, cut))
+		p.Title = strings.TrimSpace(cut)
+	}
+
+	p.Content = strings.TrimSpace(p.Content)
+	if utf8.RuneCountInString(p.Content) < db.MinContentLen {
+		c.skip("post", p.PostID, source, fmt.Sprintf("content is shorter than %d characters", db.MinContentLen))
+		return false
+	}
+	if cut, ok := cutRunes(p.Content, db.MaxContentLen); ok {
+		c.truncate("post", p.PostID, source, "content", fmt.Sprintf("%d characters are cut to %d", utf8.RuneCountInString(p.Content), db.MaxContentLen))
+		p.Content = cut
+	}
+
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, tag := range p.Tags {
+		tag = strings.Join(strings.Fields(tag), "-")
+		switch n := utf8.RuneCountInString(tag); {
+		case seen[tag]:
+			continue
+		case n < db.MinTagLen || n > db.MaxTagLen:
+			c.skip("tag", p.PostID, source, fmt.Sprintf("tag %q does not have %d to %d characters", tag, db.MinTagLen, db.MaxTagLen))
+			continue
+		case len(tags) == db.MaxTags:
+			c.skip("tag", p.PostID, source, fmt.Sprintf("tag %q is beyond %d tags of a post", tag, db.MaxTags))
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	p.Tags = tags
+
+	c.a.Posts = append(c.a.Posts, p)
+	return true
+}
+
+// addComment fits content of cm, which is turned into plain text
+func (c *converter) addComment(source string, cm db.Comment) bool {
+	cm.Content = plainText(cm.Content)
+	if utf8.RuneCountInString(cm.Content) < db.MinCommentContentLen {
+		c.skip("comment", cm.CommentID, source, fmt.Sprintf("content is shorter than %d characters", db.MinCommentContentLen))
+		return false
+	}
+	if cut, ok := cutRunes(cm.Content, db.MaxCommentContentLen); ok {
+		c.truncate("comment", cm.CommentID, source, "content", fmt.Sprintf("%d characters are cut to %d", utf8.RuneCountInString(cm.Content), db.MaxCommentContentLen))
+		cm.Content = cut
+	}
+	if cut, ok := cutRunes(cm.AuthorName, db.MaxAuthorNameLen); ok {
+		c.truncate("comment", cm.CommentID, source, "authorName", fmt.Sprintf("%d characters are cut to %d", utf8.RuneCountInString(cm.AuthorName), db.MaxAuthorNameLen))
+		cm.AuthorName = cut
+	}
+	c.a.Comments = append(c.a.Comments, cm)
+	return true
+}
+
+// cutRunes cuts s to n characters, it reports whether s is cut
+func cutRunes(s string, n int) (string, bool) {
+	i := 0
+	for k := range s {
+		if i == n {
+			return s[:k], true
+		}
+		i++
+	}
+	return s, false
+}
+
+var (
+	htmlTag      = regexp.MustCompile(`<[^>]*>`)
+	htmlBreak    = regexp.MustCompile(`(?i)<br\s*/?>|</p>`)
+	blockComment = regexp.MustCompile(`<!--\s*/?wp:[^>]*-->\n?`)
+)
+
+// plainText drops html tags of comments written on other blogs
+func plainText(s string) string {
+	s = htmlBreak.ReplaceAllString(s, "\n")
+	s = html.UnescapeString(htmlTag.ReplaceAllString(s, ""))
+	return strings.TrimSpace(s)
+}
+
+// ZipFiles reads every file in a zip, it is used to upload a directory of
+// Markdown files, names are slash separated paths, files take at most
+// maxUncompressed bytes once decompressed
+func ZipFiles(r io.ReaderAt, size, maxUncompressed int64) (map[string][]byte, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("open zip: %v", err)
+	}
+	files := map[string][]byte{}
+	zb := &zipBudget{left: maxUncompressed}
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		b, err := zb.read(f)
+		if err != nil {
+			return nil, err
+		}
+		files[f.Name] = b
+	}
+	return files, nil
+}
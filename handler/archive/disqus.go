@@ -0,0 +1,122 @@
+package archive
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"middleware/handler/db"
+	"strings"
+	"time"
+)
+
+// disqus is a Disqus export, ids of threads and posts are in dsq namespace
+type disqus struct {
+	Threads []disqusThread `xml:"thread"`
+	Posts   []disqusPost   `xml:"post"`
+}
+
+type disqusThread struct {
+	ID    string `xml:"http://disqus.com/disqus-internals id,attr"`
+	Link  string `xml:"link"`
+	Title string `xml:"title"`
+}
+
+type disqusPost struct {
+	ID        string `xml:"http://disqus.com/disqus-internals id,attr"`
+	Message   string `xml:"message"`
+	CreatedAt string `xml:"createdAt"`
+	IsDeleted bool   `xml:"isDeleted"`
+	IsSpam    bool   `xml:"isSpam"`
+	Name      string `xml:"author>name"`
+	Email     string `xml:"author>email"`
+	Thread    struct {
+		ID string `xml:"http://disqus.com/disqus-internals id,attr"`
+	} `xml:"thread"`
+	Parent struct {
+		ID string `xml:"http://disqus.com/disqus-internals id,attr"`
+	} `xml:"parent"`
+}
+
+// ImportDisqus imports comments of a Disqus export into posts already in d, a thread belongs
+// to the post titled like it or like its title cut to fit schema, as importers of posts cut it,
+// comments are numbered in order of export and a comment without email is kept with an empty one,
+// replies follow their parents, comments imported by an earlier import of export are skipped
+func ImportDisqus(d db.DB, r io.Reader, opt *ImportOptions) (*Report, error) {
+	if opt == nil {
+		opt = &ImportOptions{}
+	}
+	var x disqus
+	if err := xml.NewDecoder(r).Decode(&x); err != nil {
+		return nil, fmt.Errorf("parse disqus export: %v", err)
+	}
+
+	pids := map[string]int{}
+	c := newConverter()
+	for _, th := range x.Threads {
+		pid, err := threadPost(d, th.Title)
+		if err != nil {
+			return nil, err
+		}
+		if pid == 0 {
+			c.skip("thread", 0, "thread "+th.ID, fmt.Sprintf("no post titled %q of %s", th.Title, th.Link))
+			continue
+		}
+		pids[th.ID] = pid
+	}
+	cids := make(map[string]int, len(x.Posts))
+	for n, dp := range x.Posts {
+		cids[dp.ID] = n + 1
+	}
+	for n, dp := range x.Posts {
+		cid := n + 1
+		source := "post " + dp.ID
+		pid, ok := pids[dp.Thread.ID]
+		switch {
+		case dp.IsDeleted:
+			c.skip("comment", cid, source, "comment is deleted")
+			continue
+		case dp.IsSpam:
+			c.skip("comment", cid, source, "comment is spam")
+			continue
+		case !ok:
+			c.skip("comment", cid, source, "thread "+dp.Thread.ID+" has no post")
+			continue
+		}
+		cm := db.Comment{CommentID: cid, PostID: pid, ParentID: cids[dp.Parent.ID], Email: strings.TrimSpace(dp.Email),
+			AuthorName: strings.TrimSpace(dp.Name), Content: dp.Message}
+		if dp.ID != "" {
+			cm.Source = "disqus:" + dp.ID
+		}
+		if t, err := time.Parse(time.RFC3339, strings.TrimSpace(dp.CreatedAt)); err == nil {
+			jt := db.Jstime(t)
+			cm.CDate = &jt
+		}
+		c.addComment(source, cm)
+	}
+
+	rp := newReport(opt.DryRun)
+	rp.Add(c.rp)
+	if err := importComments(d, c.a.Comments, nil, rp, opt.DryRun); err != nil {
+		return nil, err
+	}
+	return rp, nil
+}
+
+// threadPost finds pid of post a thread titled title belongs to, 0 if there is none
+func threadPost(d db.DB, title string) (int, error) {
+	title = strings.Join(strings.Fields(title), " ")
+	candidates := []string{title}
+	if cut, ok := cutRunes(title, db.MaxTitleLen); ok {
+		candidates = append(candidates, strings.TrimSpace(cut))
+	}
+	for _, t := range candidates {
+		pid, err := d.GetPostIDByTitle(t)
+		if err != nil {
+			return 0, fmt.Errorf("look up title: %v", err)
+		}
+		if pid != 0 {
+			return pid, nil
+		}
+	}
+	return 0, nil
+}
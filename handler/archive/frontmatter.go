@@ -0,0 +1,320 @@
+package archive
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// frontMatter is YAML front matter of a Markdown file, only mappings of scalars
+// and of sequences of scalars are supported, which is all posts need,
+// values are strings, []string or nested
+type frontMatter map[string]interface{}
+
+// nested is value of a key holding a mapping, a sequence of mappings or a block scalar,
+// like cover or params of Hugo themes, it is skipped and fails only once key is read
+type nested struct{}
+
+const fmDelim = "---"
+
+// splitFrontMatter parses front matter leading doc and returns it with the rest of doc,
+// a doc not starting with --- has empty front matter
+func splitFrontMatter(doc string) (frontMatter, string, error) {
+	doc = strings.TrimPrefix(doc, "\ufeff")
+	first, rest := cutLine(doc)
+	if strings.TrimSpace(first) != fmDelim {
+		return frontMatter{}, doc, nil
+	}
+	var lines []string
+	for {
+		if rest == "" {
+			return nil, "", errors.New("front matter is not closed by ---")
+		}
+		var line string
+		line, rest = cutLine(rest)
+		if strings.TrimSpace(line) == fmDelim {
+			break
+		}
+		lines = append(lines, line)
+	}
+	fm, err := parseYAML(lines)
+	if err != nil {
+		return nil, "", err
+	}
+	return fm, rest, nil
+}
+
+// cutLine splits s after its first line, line has no line ending
+func cutLine(s string) (string, string) {
+	i := strings.IndexByte(s, '\n')
+	if i < 0 {
+		return strings.TrimSuffix(s, "\r"), ""
+	}
+	return strings.TrimSuffix(s[:i], "\r"), s[i+1:]
+}
+
+func parseYAML(lines []string) (frontMatter, error) {
+	fm := frontMatter{}
+	var (
+		key string // last key of root mapping
+		seq string // key of block sequence being read
+	)
+	for n, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		indented := line[0] == ' ' || line[0] == '\t'
+		if seq != "" && strings.HasPrefix(trimmed, "-") && (indented || line[0] == '-') {
+			item, err := parseScalar(strings.TrimSpace(trimmed[1:]))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n+1, err)
+			}
+			fm[seq] = append(fm[seq].([]string), item)
+			continue
+		}
+		seq = ""
+		if indented {
+			if key == "" {
+				return nil, fmt.Errorf("line %d: expects key: value", n+1)
+			}
+			// lines nested under key are skipped with it
+			fm[key] = nested{}
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("line %d: expects key: value", n+1)
+		}
+		var value string
+		key, value = strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		switch {
+		case value == "":
+			seq = key
+			fm[key] = []string{}
+		case strings.HasPrefix(value, "["):
+			items, err := parseFlowSeq(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n+1, err)
+			}
+			fm[key] = items
+		case value[0] == '|' || value[0] == '>' || value[0] == '{':
+			fm[key] = nested{}
+		default:
+			s, err := parseScalar(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n+1, err)
+			}
+			fm[key] = s
+		}
+	}
+	return fm, nil
+}
+
+// parseScalar unquotes a plain, 'single quoted' or "double quoted" scalar, a trailing comment is dropped
+func parseScalar(s string) (string, error) {
+	if s == "" || (s[0] != '"' && s[0] != '\'') {
+		if i := strings.Index(s, " #"); i >= 0 {
+			s = s[:i]
+		}
+		return strings.TrimSpace(s), nil
+	}
+	end := closingQuote(s)
+	if end < 0 {
+		return "", fmt.Errorf("broken quoted string %s", s)
+	}
+	if rest := strings.TrimSpace(s[end+1:]); rest != "" && rest[0] != '#' {
+		return "", fmt.Errorf("unexpected %s after quoted string", rest)
+	}
+	if s[0] == '\'' {
+		return strings.Replace(s[1:end], `''`, `'`, -1), nil
+	}
+	var v string
+	if err := json.Unmarshal([]byte(s[:end+1]), &v); err != nil {
+		return "", fmt.Errorf("broken double quoted string %s", s[:end+1])
+	}
+	return v, nil
+}
+
+// parseFlowSeq parses a sequence like [a, "b", 'c']
+func parseFlowSeq(s string) ([]string, error) {
+	if !strings.HasSuffix(s, "]") {
+		return nil, fmt.Errorf("sequence %s is not closed by ]", s)
+	}
+	s = s[1 : len(s)-1]
+	items := []string{}
+	for {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			return items, nil
+		}
+		end := strings.IndexByte(s, ',')
+		if s[0] == '"' || s[0] == '\'' {
+			// a quoted item may contain commas
+			q := closingQuote(s)
+			if q < 0 {
+				return nil, fmt.Errorf("broken quoted string %s", s)
+			}
+			end = strings.IndexByte(s[q+1:], ',')
+			if end >= 0 {
+				end += q + 1
+			}
+		}
+		if end < 0 {
+			end = len(s)
+		}
+		item, err := parseScalar(strings.TrimSpace(s[:end]))
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+		if end == len(s) {
+			return items, nil
+		}
+		s = s[end+1:]
+	}
+}
+
+// closingQuote returns index of quote closing quoted string s starts with, or -1
+func closingQuote(s string) int {
+	q := s[0]
+	for i := 1; i < len(s); i++ {
+		switch {
+		case q == '"' && s[i] == '\\':
+			i++
+		case s[i] == q && q == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			i++
+		case s[i] == q:
+			return i
+		}
+	}
+	return -1
+}
+
+// str reads a scalar of key, a missing key is empty
+func (fm frontMatter) str(key string) (string, error) {
+	v, ok := fm[key]
+	if !ok {
+		return "", nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("%s is not a scalar, nested values are not supported", key)
+	}
+	return s, nil
+}
+
+// int reads an integer of key, a missing key is 0
+func (fm frontMatter) int(key string) (int, error) {
+	s, err := fm.str(key)
+	if err != nil || s == "" {
+		return 0, err
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not an integer", key)
+	}
+	return n, nil
+}
+
+// bool reads a boolean of key, a missing key is false
+func (fm frontMatter) bool(key string) (bool, error) {
+	s, err := fm.str(key)
+	if err != nil || s == "" {
+		return false, err
+	}
+	switch s {
+	case "true", "True", "TRUE", "yes":
+		return true, nil
+	case "false", "False", "FALSE", "no":
+		return false, nil
+	}
+	return false, fmt.Errorf("%s is not a boolean", key)
+}
+
+// time layouts of dates in front matter, the last ones are written by Jekyll
+var fmTimeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+}
+
+// time reads a date of key, a missing key is nil
+func (fm frontMatter) time(key string) (*time.Time, error) {
+	s, err := fm.str(key)
+	if err != nil || s == "" {
+		return nil, err
+	}
+	for _, layout := range fmTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return &t, nil
+		}
+	}
+	return nil, fmt.Errorf("%s is not a date", key)
+}
+
+// strs reads a sequence of key, a missing key is nil
+func (fm frontMatter) strs(key string) ([]string, error) {
+	v, ok := fm[key]
+	if !ok {
+		return nil, nil
+	}
+	s, ok := v.([]string)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a sequence of scalars, nested values are not supported", key)
+	}
+	return s, nil
+}
+
+// fmWriter writes front matter fields in order they are given
+type fmWriter struct {
+	b bytes.Buffer
+}
+
+func newFMWriter() *fmWriter {
+	w := &fmWriter{}
+	w.b.WriteString(fmDelim + "\n")
+	return w
+}
+
+// field writes v, which is a string, an int, a bool, a time or a []string
+func (w *fmWriter) field(key string, v interface{}) {
+	w.b.WriteString(key + ": ")
+	switch v := v.(type) {
+	case string:
+		w.b.WriteString(quote(v))
+	case int:
+		w.b.WriteString(strconv.Itoa(v))
+	case bool:
+		w.b.WriteString(strconv.FormatBool(v))
+	case time.Time:
+		w.b.WriteString(v.Format(time.RFC3339))
+	case []string:
+		quoted := make([]string, len(v))
+		for i, s := range v {
+			quoted[i] = quote(s)
+		}
+		w.b.WriteString("[" + strings.Join(quoted, ", ") + "]")
+	}
+	w.b.WriteString("\n")
+}
+
+// bytes closes front matter and appends body
+func (w *fmWriter) bytes(body string) []byte {
+	w.b.WriteString(fmDelim + "\n")
+	w.b.WriteString(body)
+	return w.b.Bytes()
+}
+
+// quote writes s as a double quoted scalar, json escapes are valid in YAML
+func quote(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
@@ -0,0 +1,348 @@
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"middleware/handler/db"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+// ways to handle a post whose title is taken, titles are unique in schema
+const (
+	// ConflictSkip leaves out the post and its comments
+	ConflictSkip = "skip"
+	// ConflictRename imports the post under its title suffixed by -2, -3...
+	ConflictRename = "rename"
+	// ConflictFail refuses the whole archive before anything is written
+	ConflictFail = "fail"
+)
+
+// maxRenames is how many suffixes are tried to rename a post
+const maxRenames = 100
+
+// ImportOptions tunes Import
+type ImportOptions struct {
+	// DryRun checks archive and reports what would be imported without writing anything
+	DryRun bool
+	// OnConflict is one of ConflictSkip (default), ConflictRename and ConflictFail
+	OnConflict string
+}
+
+// Report tells what an import did, or would do in a dry run
+type Report struct {
+	DryRun   bool `json:"dryRun"`
+	Posts    int  `json:"posts"`
+	Comments int  `json:"comments"`
+	Users    int  `json:"users"`
+	// PostIDs and UserIDs map ids in archive to ids they are imported as, they are empty in a dry run
+	PostIDs map[int]int `json:"postIDs"`
+	UserIDs map[int]int `json:"userIDs"`
+	Renamed []Renamed   `json:"renamed"`
+	Skipped []Skipped   `json:"skipped"`
+	// Truncated lists fields cut to fit schema while converting from another blog
+	Truncated []Truncated `json:"truncated"`
+}
+
+// Renamed is a post imported under another title since its own is taken
+type Renamed struct {
+	PostID int    `json:"pid"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+}
+
+// Skipped is an item of archive left out of import, Kind is post, comment, user, tag or translation,
+// Source locates items converted from another blog in its export
+type Skipped struct {
+	Kind   string `json:"kind"`
+	ID     int    `json:"id"`
+	Source string `json:"source,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// Truncated is a field of an item converted from another blog which is cut to fit schema
+type Truncated struct {
+	Kind   string `json:"kind"`
+	ID     int    `json:"id"`
+	Source string `json:"source,omitempty"`
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+func newReport(dryRun bool) *Report {
+	return &Report{DryRun: dryRun, PostIDs: map[int]int{}, UserIDs: map[int]int{},
+		Renamed: []Renamed{}, Skipped: []Skipped{}, Truncated: []Truncated{}}
+}
+
+func (rp *Report) skip(kind string, id int, reason string) {
+	rp.Skipped = append(rp.Skipped, Skipped{Kind: kind, ID: id, Reason: reason})
+}
+
+// Add puts what was skipped and truncated while converting an archive before what rp lists
+func (rp *Report) Add(conv *Report) {
+	rp.Skipped = append(append([]Skipped{}, conv.Skipped...), rp.Skipped...)
+	rp.Truncated = append(append([]Truncated{}, conv.Truncated...), rp.Truncated...)
+}
+
+// Import inserts content of a into d, posts and users get new ids, comments and translations
+// follow their posts, users whose names are taken are skipped and posts whose titles are
+// taken are handled by opt.OnConflict, items breaking schema are skipped and reported
+func Import(d db.DB, a *Archive, opt *ImportOptions) (*Report, error) {
+	if opt == nil {
+		opt = &ImportOptions{}
+	}
+	onConflict := opt.OnConflict
+	if onConflict == "" {
+		onConflict = ConflictSkip
+	}
+	if onConflict != ConflictSkip && onConflict != ConflictRename && onConflict != ConflictFail {
+		return nil, errors.New("unknown conflict handling " + onConflict)
+	}
+	rp := newReport(opt.DryRun)
+
+	// every post is planned before anything is written, so a failing conflict leaves db untouched
+	posts := append([]db.Post{}, a.Posts...)
+	sort.Slice(posts, func(i, j int) bool { return posts[i].PostID < posts[j].PostID })
+	planned := make([]*db.Post, 0, len(posts))
+	taken := map[string]bool{}
+	for i := range posts {
+		p := &posts[i]
+		if err := validPost(p); err != nil {
+			rp.skip("post", p.PostID, err.Error())
+			continue
+		}
+		free, err := titleFree(d, taken, p.Title)
+		if err != nil {
+			return nil, err
+		}
+		if !free {
+			switch onConflict {
+			case ConflictFail:
+				return nil, fmt.Errorf("title %q of post %d is taken", p.Title, p.PostID)
+			case ConflictSkip:
+				rp.skip("post", p.PostID, "title "+strconv.Quote(p.Title)+" is taken")
+				continue
+			case ConflictRename:
+				title, err := rename(d, taken, p.Title)
+				if err != nil {
+					return nil, err
+				}
+				if title == "" {
+					rp.skip("post", p.PostID, "no free title found to rename "+strconv.Quote(p.Title))
+					continue
+				}
+				rp.Renamed = append(rp.Renamed, Renamed{PostID: p.PostID, From: p.Title, To: title})
+				p.Title = title
+			}
+		}
+		taken[p.Title] = true
+		planned = append(planned, p)
+	}
+
+	for i := range a.Users {
+		u := &a.Users[i]
+		uid, err := d.GetUserIDByName(u.UserName)
+		if err != nil {
+			return nil, fmt.Errorf("look up user name: %v", err)
+		}
+		if uid != 0 {
+			rp.skip("user", u.UID, "user name "+strconv.Quote(u.UserName)+" is taken")
+			continue
+		}
+		if !opt.DryRun {
+			uid, err = d.ImportUser(u)
+			if err != nil {
+				rp.skip("user", u.UID, err.Error())
+				continue
+			}
+			rp.UserIDs[u.UID] = uid
+		}
+		rp.Users++
+	}
+
+	imported := map[int]bool{}
+	for _, p := range planned {
+		if !opt.DryRun {
+			pid, err := d.ImportPost(p)
+			if err != nil {
+				rp.skip("post", p.PostID, err.Error())
+				continue
+			}
+			rp.PostIDs[p.PostID] = pid
+		}
+		imported[p.PostID] = true
+		rp.Posts++
+	}
+
+	for _, p := range planned {
+		if !imported[p.PostID] || p.TranslationGroup == 0 || p.TranslationGroup == p.PostID {
+			continue
+		}
+		if !imported[p.TranslationGroup] {
+			rp.skip("translation", p.PostID, "post "+strconv.Itoa(p.TranslationGroup)+" it translates is not imported")
+			continue
+		}
+		if !opt.DryRun {
+			if _, err := d.LinkTranslation(rp.PostIDs[p.PostID], rp.PostIDs[p.TranslationGroup]); err != nil {
+				rp.skip("translation", p.PostID, err.Error())
+			}
+		}
+	}
+
+	var cmts []db.Comment
+	for _, c := range a.Comments {
+		if !imported[c.PostID] {
+			rp.skip("comment", c.CommentID, "post "+strconv.Itoa(c.PostID)+" is not imported")
+			continue
+		}
+		if err := db.ValidCommentContent(c.Content); err != nil {
+			rp.skip("comment", c.CommentID, err.Error())
+			continue
+		}
+		if err := db.ValidAuthorName(c.AuthorName); err != nil {
+			rp.skip("comment", c.CommentID, err.Error())
+			continue
+		}
+		if c.Status != "" && !db.ValidCommentStatus(c.Status) {
+			rp.skip("comment", c.CommentID, "status "+strconv.Quote(c.Status)+" is unknown")
+			continue
+		}
+		cmts = append(cmts, c)
+	}
+	if err := importComments(d, cmts, rp.PostIDs, rp, opt.DryRun); err != nil {
+		return nil, err
+	}
+	return rp, nil
+}
+
+// importComments imports comments so that each reply follows its parent and refers to cid
+// its parent got, a reply whose parent is not imported becomes a top-level comment,
+// pids maps pids of comments to those in d, comments keep their pids if it is nil,
+// a comment of a source imported before is skipped and its replies follow its copy in d
+func importComments(d db.DB, cmts []db.Comment, pids map[int]int, rp *Report, dryRun bool) error {
+	// cids and posts map cids of imported comments to their cids and pids in archive
+	cids, posts := map[int]int{}, map[int]int{}
+	for _, c := range threadOrder(cmts) {
+		if c.Source != "" {
+			cid, err := d.GetCommentIDBySource(c.Source)
+			if err != nil {
+				return fmt.Errorf("look up comment source: %v", err)
+			}
+			if cid != 0 {
+				rp.Skipped = append(rp.Skipped, Skipped{Kind: "comment", ID: c.CommentID, Source: c.Source,
+					Reason: "comment is imported already as comment " + strconv.Itoa(cid)})
+				cids[c.CommentID], posts[c.CommentID] = cid, c.PostID
+				continue
+			}
+		}
+		parent, ok := cids[c.ParentID]
+		if ok && posts[c.ParentID] != c.PostID {
+			parent, ok = 0, false
+		}
+		if c.ParentID != 0 && !ok {
+			rp.Truncated = append(rp.Truncated, Truncated{Kind: "comment", ID: c.CommentID, Field: "parentCommentId",
+				Reason: "parent comment " + strconv.Itoa(c.ParentID) + " is not imported into same post, reply is kept at top level"})
+		}
+		c.ParentID = parent
+		cid, pid := c.CommentID, c.PostID
+		if !dryRun {
+			if pids != nil {
+				c.PostID = pids[c.PostID]
+			}
+			var err error
+			cid, err = d.ImportComment(&c)
+			if err != nil {
+				rp.skip("comment", c.CommentID, err.Error())
+				continue
+			}
+		}
+		cids[c.CommentID], posts[c.CommentID] = cid, pid
+		rp.Comments++
+	}
+	return nil
+}
+
+// threadOrder orders comments so that each reply follows its parent, replies of a parent
+// keep their order, a reply to a comment not in cmts or of another post keeps its place
+func threadOrder(cmts []db.Comment) []db.Comment {
+	postOf := make(map[int]int, len(cmts))
+	for _, c := range cmts {
+		postOf[c.CommentID] = c.PostID
+	}
+	replies := map[int][]int{}
+	var roots []int
+	for i, c := range cmts {
+		if pid, ok := postOf[c.ParentID]; ok && pid == c.PostID && c.ParentID != c.CommentID {
+			replies[c.ParentID] = append(replies[c.ParentID], i)
+			continue
+		}
+		roots = append(roots, i)
+	}
+
+	ordered := make([]db.Comment, 0, len(cmts))
+	visited := make([]bool, len(cmts))
+	var walk func(i int)
+	walk = func(i int) {
+		if visited[i] {
+			return
+		}
+		visited[i] = true
+		ordered = append(ordered, cmts[i])
+		for _, j := range replies[cmts[i].CommentID] {
+			walk(j)
+		}
+	}
+	for _, i := range roots {
+		walk(i)
+	}
+	// replies in a cycle have no root, they are walked from first of them
+	for i := range cmts {
+		walk(i)
+	}
+	return ordered
+}
+
+// validPost checks fields of p fit in schema
+func validPost(p *db.Post) error {
+	if err := db.ValidTitle(p.Title); err != nil {
+		return err
+	}
+	if err := db.ValidContent(p.Content); err != nil {
+		return err
+	}
+	return db.ValidTags(p.Tags)
+}
+
+// titleFree checks title is neither used in d nor by a post imported before
+func titleFree(d db.DB, taken map[string]bool, title string) (bool, error) {
+	if taken[title] {
+		return false, nil
+	}
+	pid, err := d.GetPostIDByTitle(title)
+	if err != nil {
+		return false, fmt.Errorf("look up title: %v", err)
+	}
+	return pid == 0, nil
+}
+
+// rename finds a free title made of title and a suffix, title is cut to keep
+// it in length limit, an empty title is returned if none is free
+func rename(d db.DB, taken map[string]bool, title string) (string, error) {
+	for n := 2; n <= maxRenames; n++ {
+		suffix := "-" + strconv.Itoa(n)
+		base := title
+		for utf8.RuneCountInString(base)+len(suffix) > db.MaxTitleLen {
+			_, size := utf8.DecodeLastRuneInString(base)
+			base = base[:len(base)-size]
+		}
+		free, err := titleFree(d, taken, base+suffix)
+		if err != nil {
+			return "", err
+		}
+		if free {
+			return base + suffix, nil
+		}
+	}
+	return "", nil
+}
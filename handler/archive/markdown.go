@@ -0,0 +1,184 @@
+package archive
+
+import (
+	"fmt"
+	"middleware/handler/db"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	// jekyllName is name of a Jekyll post like 2019-03-04-title.md
+	jekyllName = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2})-`)
+	// hugoLang is language of a Hugo translation named like title.de.md
+	hugoLang = regexp.MustCompile(`\.([a-z]{2})\.(md|markdown)$`)
+)
+
+// FromMarkdown converts posts of a Hugo or Jekyll site, files maps slash separated paths
+// to content, Markdown files with YAML (---) or TOML (+++) front matter are posts,
+// other files, Hugo section pages and drafts are left out, posts are numbered in order of paths
+func FromMarkdown(files map[string][]byte) (*Archive, *Report, error) {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		if ext := path.Ext(name); ext == ".md" || ext == ".markdown" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	c := newConverter()
+	for i, name := range names {
+		pid := i + 1
+		base := path.Base(name)
+		if base == "_index.md" || strings.HasPrefix(base, "README") {
+			c.skip("post", pid, name, "section page is not a post")
+			continue
+		}
+		fm, body, err := splitMarkdown(string(files[name]))
+		if err != nil {
+			c.skip("post", pid, name, err.Error())
+			continue
+		}
+		p, err := markdownPost(fm, name)
+		if err != nil {
+			c.skip("post", pid, name, err.Error())
+			continue
+		}
+		if draft, _ := fm.bool("draft"); draft {
+			c.skip("post", pid, name, "draft is not imported")
+			continue
+		}
+		// Jekyll hides posts by published: false
+		if published, err := fm.str("published"); err == nil && published == "false" {
+			c.skip("post", pid, name, "unpublished post is not imported")
+			continue
+		}
+		p.PostID = pid
+		p.Content = body
+		c.addPost(name, *p)
+	}
+	return &c.a, c.rp, nil
+}
+
+// splitMarkdown splits front matter of Hugo or Jekyll from content
+func splitMarkdown(doc string) (frontMatter, string, error) {
+	if first, rest := cutLine(strings.TrimPrefix(doc, "\ufeff")); strings.TrimSpace(first) == "+++" {
+		return splitTOML(rest)
+	}
+	return splitFrontMatter(doc)
+}
+
+// markdownPost reads fields of a post from front matter, a date missing in front matter
+// is taken from name of a Jekyll post
+func markdownPost(fm frontMatter, name string) (*db.Post, error) {
+	var (
+		p   db.Post
+		err error
+	)
+	if p.Title, err = fm.str("title"); err != nil {
+		return nil, err
+	}
+	for _, key := range []string{"tags", "categories"} {
+		// Jekyll also accepts tags separated by spaces
+		if s, ok := fm[key].(string); ok {
+			p.Tags = append(p.Tags, strings.Fields(s)...)
+			continue
+		}
+		tags, err := fm.strs(key)
+		if err != nil {
+			return nil, err
+		}
+		p.Tags = append(p.Tags, tags...)
+	}
+	for _, key := range []string{"language", "lang"} {
+		if p.Language, err = fm.str(key); err != nil || p.Language != "" {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if m := hugoLang.FindStringSubmatch(name); p.Language == "" && m != nil {
+		p.Language = m[1]
+	}
+	p.Language = strings.ToLower(p.Language)
+	if len(p.Language) > 2 {
+		// en-us and en_US are kept as en
+		p.Language = p.Language[:2]
+	}
+
+	date, err := fm.time("date")
+	if err != nil {
+		return nil, err
+	}
+	if m := jekyllName.FindStringSubmatch(path.Base(name)); date == nil && m != nil {
+		t, err := time.Parse("2006-01-02", m[1])
+		if err == nil {
+			date = &t
+		}
+	}
+	if date != nil {
+		jt := db.Jstime(*date)
+		p.CDate = &jt
+	}
+	for _, key := range []string{"lastmod", "last_modified_at"} {
+		t, err := fm.time(key)
+		if err != nil {
+			return nil, err
+		}
+		if t != nil {
+			jt := db.Jstime(*t)
+			p.MDate = &jt
+			break
+		}
+	}
+	return &p, nil
+}
+
+// splitTOML parses TOML front matter closed by +++ of a Hugo post, only keys
+// of root table with strings, numbers, booleans, dates and arrays of them are read
+func splitTOML(doc string) (frontMatter, string, error) {
+	fm := frontMatter{}
+	root := true
+	for n := 1; ; n++ {
+		if doc == "" {
+			return nil, "", fmt.Errorf("front matter is not closed by +++")
+		}
+		var line string
+		line, doc = cutLine(doc)
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "+++":
+			return fm, doc, nil
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "["):
+			// keys of tables like [params] do not belong to post
+			root = false
+			continue
+		case !root:
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i <= 0 {
+			return nil, "", fmt.Errorf("line %d: expects key = value", n)
+		}
+		key, value := strings.Trim(strings.TrimSpace(line[:i]), `"`), strings.TrimSpace(line[i+1:])
+		if strings.HasPrefix(value, "[") {
+			items, err := parseFlowSeq(value)
+			if err != nil {
+				return nil, "", fmt.Errorf("line %d: %v", n, err)
+			}
+			fm[key] = items
+			continue
+		}
+		s, err := parseScalar(value)
+		if err != nil {
+			return nil, "", fmt.Errorf("line %d: %v", n, err)
+		}
+		fm[key] = s
+	}
+}
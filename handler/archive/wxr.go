@@ -0,0 +1,112 @@
+package archive
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"middleware/handler/db"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// wxr is a WordPress eXtended RSS export, elements of wp namespace are matched
+// by local name since its uri changes with version of WordPress
+type wxr struct {
+	Items []wxrItem `xml:"channel>item"`
+}
+
+type wxrItem struct {
+	Title      string        `xml:"title"`
+	PubDate    string        `xml:"pubDate"`
+	Content    string        `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+	PostID     int           `xml:"post_id"`
+	DateGMT    string        `xml:"post_date_gmt"`
+	Modified   string        `xml:"post_modified_gmt"`
+	Status     string        `xml:"status"`
+	PostType   string        `xml:"post_type"`
+	Categories []wxrCategory `xml:"category"`
+	Comments   []wxrComment  `xml:"comment"`
+}
+
+type wxrCategory struct {
+	Domain string `xml:"domain,attr"`
+	Name   string `xml:",chardata"`
+}
+
+type wxrComment struct {
+	CommentID int    `xml:"comment_id"`
+	Parent    int    `xml:"comment_parent"`
+	Author    string `xml:"comment_author"`
+	Email     string `xml:"comment_author_email"`
+	DateGMT   string `xml:"comment_date_gmt"`
+	Content   string `xml:"comment_content"`
+	Approved  string `xml:"comment_approved"`
+	Type      string `xml:"comment_type"`
+}
+
+// wxrTime parses a date of WordPress, which writes 0000-00-00 00:00:00 for unset dates
+func wxrTime(s string) *db.Jstime {
+	t, err := time.Parse("2006-01-02 15:04:05", strings.TrimSpace(s))
+	if err != nil || t.Year() < 1 {
+		return nil
+	}
+	jt := db.Jstime(t)
+	return &jt
+}
+
+// FromWXR converts published posts and approved comments of a WordPress export, post tags
+// come before categories in tags, content is kept as html without block editor comments
+func FromWXR(r io.Reader) (*Archive, *Report, error) {
+	var x wxr
+	if err := xml.NewDecoder(r).Decode(&x); err != nil {
+		return nil, nil, fmt.Errorf("parse wxr: %v", err)
+	}
+	c := newConverter()
+	for _, it := range x.Items {
+		source := "post_id " + strconv.Itoa(it.PostID)
+		if it.PostType != "post" {
+			c.skip("post", it.PostID, source, "post type "+it.PostType+" is not imported")
+			continue
+		}
+		if it.Status != "publish" {
+			c.skip("post", it.PostID, source, "status "+it.Status+" is not imported")
+			continue
+		}
+		p := db.Post{PostID: it.PostID, Title: it.Title, Content: blockComment.ReplaceAllString(it.Content, ""),
+			CDate: wxrTime(it.DateGMT), MDate: wxrTime(it.Modified), Tags: []string{}}
+		if p.CDate == nil {
+			if t, err := time.Parse(time.RFC1123Z, it.PubDate); err == nil {
+				jt := db.Jstime(t)
+				p.CDate = &jt
+			}
+		}
+		for _, domain := range []string{"post_tag", "category"} {
+			for _, cat := range it.Categories {
+				if cat.Domain == domain {
+					p.Tags = append(p.Tags, cat.Name)
+				}
+			}
+		}
+		if !c.addPost(source, p) {
+			for _, cm := range it.Comments {
+				c.skip("comment", cm.CommentID, "comment_id "+strconv.Itoa(cm.CommentID), "post "+strconv.Itoa(it.PostID)+" is not imported")
+			}
+			continue
+		}
+		for _, cm := range it.Comments {
+			source := "comment_id " + strconv.Itoa(cm.CommentID)
+			if cm.Type != "" && cm.Type != "comment" {
+				c.skip("comment", cm.CommentID, source, "comment type "+cm.Type+" is not imported")
+				continue
+			}
+			if cm.Approved != "1" {
+				c.skip("comment", cm.CommentID, source, "comment is not approved")
+				continue
+			}
+			c.addComment(source, db.Comment{CommentID: cm.CommentID, PostID: it.PostID, ParentID: cm.Parent, Email: cm.Email,
+				AuthorName: strings.TrimSpace(cm.Author), CDate: wxrTime(cm.DateGMT), Content: cm.Content})
+		}
+	}
+	return &c.a, c.rp, nil
+}
@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"errors"
 	"middleware/handler/db"
 	"net/http"
 
@@ -12,3 +13,19 @@ var userTable = make(map[string]*db.User, 1000)
 func newUUID() *http.Cookie {
 	return &http.Cookie{Name: "uuid", Value: uuid.New().String()}
 }
+
+// requirePrivilege returns user bound to request if it is logined with privilege
+// not weaker than priv
+func requirePrivilege(r *http.Request, priv int) (*db.User, error) {
+	usr, ok := r.Context().Value(db.BlogContext("user")).(*db.User)
+	if !ok {
+		return nil, errors.New("no user context: internal error")
+	}
+	if usr == nil {
+		return nil, errors.New("user unlogined")
+	}
+	if usr.Privilege > priv {
+		return nil, errors.New("not enough privilege")
+	}
+	return usr, nil
+}
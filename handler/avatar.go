@@ -0,0 +1,125 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"middleware/handler/db"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// anonymousName is shown for comments whose commenter gave no name
+const anonymousName = "Anonymous"
+
+// identicon sizes in pixels, 5 cells of grid and a margin of half a cell on each side
+const (
+	identiconGrid        = 5
+	defaultIdenticonSize = 80
+	minIdenticonSize     = 16
+	maxIdenticonSize     = 512
+)
+
+// avatarHash is hex of hash of trimmed lowercased email, Gravatar needs plain sha256 of it
+// while identicons are drawn from an hmac keyed by AvatarSecret, so their hashes reveal no email
+func avatarHash(cfg *CommentConfig, email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if cfg.Avatar == AvatarIdenticon {
+		mac := hmac.New(sha256.New, cfg.AvatarSecret)
+		mac.Write([]byte(email))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	sum := sha256.Sum256([]byte(email))
+	return hex.EncodeToString(sum[:])
+}
+
+// avatarURL is image of hash from source, Gravatar falls back to its own identicons
+func avatarURL(source, hash string) string {
+	if source == AvatarIdenticon {
+		return "/avatar/" + hash + ".png"
+	}
+	return "https://www.gravatar.com/avatar/" + hash + "?d=identicon"
+}
+
+// publicComments strips emails of cmts, nested replies included, and names and
+// hashes commenters instead
+func publicComments(cmts []db.Comment, cfg *CommentConfig) []db.PublicComment {
+	pcs := make([]db.PublicComment, len(cmts))
+	for i, c := range cmts {
+		pc := db.PublicComment{PostID: c.PostID, CommentID: c.CommentID, AuthorName: c.AuthorName, UID: c.UID,
+			CDate: c.CDate, Content: c.Content, Version: c.Version, EditedAt: c.EditedAt, ParentID: c.ParentID,
+			Depth: c.Depth, Deleted: c.Deleted, PostTitle: c.PostTitle, PostSlug: c.PostSlug}
+		if !c.Deleted {
+			if pc.AuthorName == "" {
+				pc.AuthorName = anonymousName
+			}
+			pc.AvatarHash = avatarHash(cfg, c.Email)
+			pc.AvatarURL = avatarURL(cfg.Avatar, pc.AvatarHash)
+		}
+		if c.Replies != nil {
+			pc.Replies = publicComments(c.Replies, cfg)
+		}
+		pcs[i] = pc
+	}
+	return pcs
+}
+
+// identicon draws a symmetric grid of cells, colored and filled by bytes of sum,
+// so each hash always gets same image
+func identicon(sum []byte, size int) image.Image {
+	fg := color.RGBA{R: 64 + sum[0]%160, G: 64 + sum[1]%160, B: 64 + sum[2]%160, A: 255}
+	img := image.NewPaletted(image.Rect(0, 0, size, size), color.Palette{color.RGBA{R: 240, G: 240, B: 240, A: 255}, fg})
+	cell := size / (identiconGrid + 1)
+	margin := (size - cell*identiconGrid) / 2
+	for y := 0; y < identiconGrid; y++ {
+		// columns right of middle mirror left ones, so only 3 of 5 are decided by hash
+		for x := 0; x < (identiconGrid+1)/2; x++ {
+			if sum[3+y*3+x]%2 == 0 {
+				continue
+			}
+			for _, cx := range []int{x, identiconGrid - 1 - x} {
+				for py := margin + y*cell; py < margin+(y+1)*cell; py++ {
+					for px := margin + cx*cell; px < margin+(cx+1)*cell; px++ {
+						img.SetColorIndex(px, py, 1)
+					}
+				}
+			}
+		}
+	}
+	return img
+}
+
+// viewIdenticon returns png of identicon of hash in path /avatar/{hash}.png,
+// ?s sets its size in pixels
+func viewIdenticon(r *http.Request) ([]byte, error) {
+	name := strings.TrimPrefix(r.URL.Path, "/avatar/")
+	if !strings.HasSuffix(name, ".png") {
+		return nil, errors.New("avatar path is not /avatar/{hash}.png")
+	}
+	sum, err := hex.DecodeString(strings.TrimSuffix(name, ".png"))
+	if err != nil || len(sum) != sha256.Size {
+		return nil, errors.New("avatar hash is not hex of sha256")
+	}
+	size := defaultIdenticonSize
+	if s := r.FormValue("s"); s != "" {
+		size, err = strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("convert s to int: %v", err)
+		}
+		if size < minIdenticonSize || size > maxIdenticonSize {
+			return nil, fmt.Errorf("s must be in [%d, %d]", minIdenticonSize, maxIdenticonSize)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, identicon(sum, size)); err != nil {
+		return nil, fmt.Errorf("encode identicon: %v", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,131 @@
+package handler
+
+import (
+	"fmt"
+	"math"
+	"middleware/handler/db"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// BayesFilter is a naive Bayes classifier which learns from comments moderators mark
+// as spam or approve, it scores 0 until it learnt MinTrained comments of each
+type BayesFilter struct {
+	MinTrained int
+	// Interesting is how many tokens farthest from neutral are combined
+	Interesting int
+}
+
+// Name implements SpamFilter
+func (f *BayesFilter) Name() string { return "bayes" }
+
+// Check implements SpamFilter
+func (f *BayesFilter) Check(d db.DB, s *CommentSubmission) (float64, string, error) {
+	tokens := spamTokens(s.Content)
+	if len(tokens) == 0 {
+		return 0, "", nil
+	}
+	corpus, err := d.GetSpamCorpus(tokens)
+	if err != nil {
+		return 0, "", err
+	}
+	if corpus.SpamDocs < f.MinTrained || corpus.HamDocs < f.MinTrained {
+		return 0, "", nil
+	}
+	p, top := spamProbability(corpus, tokens, f.Interesting)
+	if len(top) == 0 {
+		return 0, "", nil
+	}
+	return p, fmt.Sprintf("spam probability %.2f by %s", p, strings.Join(top, ", ")), nil
+}
+
+// tokenProbability is probability a comment containing a token is spam, tokens seen
+// in few comments are pulled to 0.5 as Robinson suggests
+func tokenProbability(tc db.TokenCounts, spamDocs, hamDocs int) float64 {
+	const (
+		strength = 1.0
+		neutral  = 0.5
+	)
+	spamFreq := float64(tc.Spam) / float64(spamDocs)
+	hamFreq := float64(tc.Ham) / float64(hamDocs)
+	p := spamFreq / (spamFreq + hamFreq)
+	n := float64(tc.Spam + tc.Ham)
+	return (strength*neutral + n*p) / (strength + n)
+}
+
+// spamProbability combines probabilities of the n tokens farthest from neutral,
+// it returns them with the combined probability
+func spamProbability(corpus *db.SpamCorpus, tokens []string, n int) (float64, []string) {
+	type scored struct {
+		token string
+		p     float64
+	}
+	var known []scored
+	for _, t := range tokens {
+		tc, ok := corpus.Tokens[t]
+		if !ok || tc.Spam+tc.Ham == 0 {
+			continue
+		}
+		known = append(known, scored{t, tokenProbability(tc, corpus.SpamDocs, corpus.HamDocs)})
+	}
+	sort.SliceStable(known, func(i, j int) bool {
+		return math.Abs(known[i].p-0.5) > math.Abs(known[j].p-0.5)
+	})
+	if len(known) > n {
+		known = known[:n]
+	}
+
+	// products of probabilities are summed in logs so they do not underflow
+	var logSpam, logHam float64
+	top := make([]string, len(known))
+	for i, k := range known {
+		p := math.Min(math.Max(k.p, 0.01), 0.99)
+		logSpam += math.Log(p)
+		logHam += math.Log(1 - p)
+		top[i] = k.token
+	}
+	return 1 / (1 + math.Exp(logHam-logSpam)), top
+}
+
+// spamTokens splits content into distinct lowercased words of 2 to 20 characters,
+// hosts of links are kept whole as url:host
+func spamTokens(content string) []string {
+	seen := map[string]bool{}
+	var tokens []string
+	add := func(t string) {
+		if !seen[t] {
+			seen[t] = true
+			tokens = append(tokens, t)
+		}
+	}
+	for _, h := range linkHosts(content) {
+		add("url:" + h)
+	}
+	words := strings.FieldsFunc(strings.ToLower(link.ReplaceAllString(content, " ")), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '\'' && r != '$'
+	})
+	for _, w := range words {
+		w = strings.Trim(w, "'")
+		if n := utf8.RuneCountInString(w); n >= 2 && n <= 20 {
+			add(w)
+		}
+	}
+	return tokens
+}
+
+// trainSpam teaches spam filter comments of cids as spam or ham, a comment is learnt
+// once for each decision and unlearnt when moderators change their mind
+func trainSpam(d db.DB, cids []int, spam bool) error {
+	for _, cid := range cids {
+		c, err := d.GetComment(cid)
+		if err != nil {
+			return fmt.Errorf("get comment %d: %v", cid, err)
+		}
+		if _, err := d.TrainSpam(cid, spamTokens(c.Content), spam); err != nil {
+			return fmt.Errorf("train comment %d: %v", cid, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"sync"
+	"time"
+)
+
+// ttlCache keeps at most size values, each for ttl
+type ttlCache struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	size  int
+	items map[string]cacheItem
+}
+
+type cacheItem struct {
+	val     interface{}
+	expires time.Time
+}
+
+func newTTLCache(ttl time.Duration, size int) *ttlCache {
+	return &ttlCache{ttl: ttl, size: size, items: make(map[string]cacheItem, size)}
+}
+
+func (c *ttlCache) get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	it, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(it.expires) {
+		delete(c.items, key)
+		return nil, false
+	}
+	return it.val, true
+}
+
+func (c *ttlCache) set(key string, val interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if _, ok := c.items[key]; !ok && len(c.items) >= c.size {
+		for k, it := range c.items {
+			if now.After(it.expires) {
+				delete(c.items, k)
+			}
+		}
+		// still full, drop whatever comes first
+		for k := range c.items {
+			if len(c.items) < c.size {
+				break
+			}
+			delete(c.items, k)
+		}
+	}
+	c.items[key] = cacheItem{val: val, expires: now.Add(c.ttl)}
+}
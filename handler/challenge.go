@@ -0,0 +1,186 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// purposes challenges are issued for, a challenge solved for one is refused by the other
+const (
+	challengeRegister = "register"
+	challengeComment  = "comment"
+)
+
+// maxNonceLen bounds nonces clients send with solutions
+const maxNonceLen = 64
+
+// challengeMACSize is size of mac kept in challenges
+const challengeMACSize = 16
+
+// Challenge is a hashcash-like proof of work: client looks for a nonce such that
+// sha256 of challenge, ":" and nonce starts with Difficulty zero bits
+type Challenge struct {
+	Challenge  string    `json:"challenge"`
+	Algorithm  string    `json:"algorithm"`
+	Difficulty int       `json:"difficulty"`
+	Expires    time.Time `json:"expires"`
+}
+
+// challenger issues and verifies challenges, difficulty rises with challenges
+// requested and solutions failed in current window, by each client and by all of them
+type challenger struct {
+	cfg *ChallengeConfig
+
+	mu          sync.Mutex
+	windowStart time.Time
+	counts      map[string]int
+	total       int
+	// solved and prevSolved keep ids of challenges solved since solvedStart and in TTL
+	// before it, they are rotated every TTL so an id is kept until its challenge expired,
+	// as a challenge is solved before it expires, without scanning ids
+	solvedStart time.Time
+	solved      map[string]bool
+	prevSolved  map[string]bool
+}
+
+func newChallenger(cfg *ChallengeConfig) *challenger {
+	now := time.Now()
+	return &challenger{cfg: cfg, windowStart: now, counts: map[string]int{},
+		solvedStart: now, solved: map[string]bool{}, prevSolved: map[string]bool{}}
+}
+
+// count records a request of client and returns its count and total in current window
+func (c *challenger) count(client string, now time.Time) (int, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now.Sub(c.windowStart) >= c.cfg.Window {
+		c.windowStart, c.counts, c.total = now, map[string]int{}, 0
+	}
+	c.counts[client]++
+	c.total++
+	return c.counts[client], c.total
+}
+
+// extraBits is 0 below threshold and rises by a bit each time count doubles above it
+func extraBits(count, threshold int) int {
+	if count < threshold {
+		return 0
+	}
+	return bits.Len(uint(count / threshold))
+}
+
+// issue makes a challenge for purpose whose difficulty depends on how busy client and server are
+func (c *challenger) issue(client, purpose string) (*Challenge, error) {
+	now := time.Now()
+	n, total := c.count(client, now)
+	difficulty := c.cfg.Difficulty + extraBits(n, c.cfg.Threshold) + extraBits(total, c.cfg.GlobalThreshold)
+	if difficulty > c.cfg.MaxDifficulty {
+		difficulty = c.cfg.MaxDifficulty
+	}
+
+	// payload is difficulty, expiry, random id and purpose
+	expires := now.Add(c.cfg.TTL).Truncate(time.Second)
+	payload := make([]byte, 1+8+16, 1+8+16+len(purpose))
+	payload[0] = byte(difficulty)
+	binary.BigEndian.PutUint64(payload[1:9], uint64(expires.Unix()))
+	if _, err := rand.Read(payload[9:25]); err != nil {
+		return nil, fmt.Errorf("generate challenge id: %v", err)
+	}
+	payload = append(payload, purpose...)
+	mac := hmac.New(sha256.New, c.cfg.Secret)
+	mac.Write(payload)
+	token := base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:challengeMACSize])
+	return &Challenge{Challenge: token, Algorithm: "sha256", Difficulty: difficulty, Expires: expires.UTC()}, nil
+}
+
+// verify checks nonce solves challenge token issued for purpose, a failed solution
+// counts against client like a request of a challenge
+func (c *challenger) verify(client, purpose, token, nonce string) error {
+	err := c.check(purpose, token, nonce, time.Now())
+	if err != nil {
+		c.count(client, time.Now())
+	}
+	return err
+}
+
+func (c *challenger) check(purpose, token, nonce string, now time.Time) error {
+	if token == "" || nonce == "" {
+		return errors.New("challenge and nonce are required, get a challenge from /challenge")
+	}
+	if len(nonce) > maxNonceLen {
+		return fmt.Errorf("nonce is longer than %d bytes", maxNonceLen)
+	}
+	i := strings.IndexByte(token, '.')
+	if i < 0 {
+		return errors.New("challenge is malformed")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(token[:i])
+	if err != nil || len(payload) < 1+8+16 {
+		return errors.New("challenge is malformed")
+	}
+	sum, err := base64.RawURLEncoding.DecodeString(token[i+1:])
+	if err != nil {
+		return errors.New("challenge is malformed")
+	}
+	mac := hmac.New(sha256.New, c.cfg.Secret)
+	mac.Write(payload)
+	if !hmac.Equal(mac.Sum(nil)[:challengeMACSize], sum) {
+		return errors.New("challenge is not issued by server")
+	}
+	if !bytes.Equal(payload[25:], []byte(purpose)) {
+		return errors.New("challenge is issued for " + string(payload[25:]))
+	}
+	expires := time.Unix(int64(binary.BigEndian.Uint64(payload[1:9])), 0)
+	if now.After(expires) {
+		return errors.New("challenge is expired")
+	}
+	if leadingZeroBits(sha256.Sum256([]byte(token+":"+nonce))) < int(payload[0]) {
+		return errors.New("nonce does not solve challenge")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if since := now.Sub(c.solvedStart); since >= 2*c.cfg.TTL {
+		c.solvedStart, c.solved, c.prevSolved = now, map[string]bool{}, map[string]bool{}
+	} else if since >= c.cfg.TTL {
+		c.solvedStart, c.solved, c.prevSolved = c.solvedStart.Add(c.cfg.TTL), map[string]bool{}, c.solved
+	}
+	id := string(payload[9:25])
+	if c.solved[id] || c.prevSolved[id] {
+		return errors.New("challenge is solved already")
+	}
+	c.solved[id] = true
+	return nil
+}
+
+func leadingZeroBits(sum [sha256.Size]byte) int {
+	n := 0
+	for _, b := range sum {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
+
+// viewChallenge issues a challenge for purpose in query
+func viewChallenge(c *challenger, r *http.Request) (*Challenge, error) {
+	purpose := r.FormValue("purpose")
+	if purpose != challengeRegister && purpose != challengeComment {
+		return nil, errors.New("purpose is neither register nor comment")
+	}
+	return c.issue(clientIP(r), purpose)
+}
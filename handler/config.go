@@ -0,0 +1,462 @@
+package handler
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"middleware/handler/archive"
+	"middleware/handler/db"
+	"middleware/handler/mailer"
+	"middleware/handler/storage"
+	"strings"
+	"time"
+)
+
+// Config contains tunables of blog handler
+type Config struct {
+	Suggest   SuggestConfig
+	Media     MediaConfig
+	Analytics AnalyticsConfig
+	Reactions ReactionConfig
+	Archive   ArchiveConfig
+	Comments  CommentConfig
+	Challenge ChallengeConfig
+	Notify    NotifyConfig
+
+	// MaxJSONSize is max size of a json request body in bytes, it is read into memory
+	MaxJSONSize int64
+}
+
+// SuggestConfig tunes /search/suggest, which is called on every keystroke
+type SuggestConfig struct {
+	// Limit is max number of completions and of corrections returned
+	Limit int
+	// Rate is requests per second a client may sustain, Burst is how many it may send at once
+	Rate  float64
+	Burst int
+	// CacheTTL is how long a suggestion stays cached, both in server and in browser
+	CacheTTL  time.Duration
+	CacheSize int
+}
+
+// MediaConfig tunes uploads to /media
+type MediaConfig struct {
+	// Storage keeps uploaded files, it is required
+	Storage storage.Storage
+	// MaxSize is max size of an uploaded file in bytes
+	MaxSize int64
+	// Types are MIME types accepted, as sniffed from content of file
+	Types []string
+	// Images tunes derivatives generated for uploaded images
+	Images ImageConfig
+}
+
+// ImageConfig tunes processing of uploaded images
+type ImageConfig struct {
+	// Workers process images concurrently, at most Queue images wait for them,
+	// images uploaded when queue is full get no derivatives
+	Workers int
+	Queue   int
+	// Quality of derivatives encoded as jpeg, in [1, 100]
+	Quality int
+	// MaxPixels is max width times height of an image, larger ones are refused
+	// before they are decoded
+	MaxPixels   int64
+	Derivatives []DerivativeSpec
+	// Encoders produce an extra variant of each derivative per MIME type,
+	// like image/webp, which standard library cannot encode
+	Encoders map[string]ImageEncoder
+}
+
+// DerivativeSpec names a size images are scaled down to fit in
+type DerivativeSpec struct {
+	Name      string
+	MaxWidth  int
+	MaxHeight int
+}
+
+// ImageEncoder writes img to w in its format
+type ImageEncoder func(w io.Writer, img image.Image) error
+
+// AnalyticsConfig tunes buffering of post views
+type AnalyticsConfig struct {
+	// FlushInterval is how often buffered views are written to db, they are written
+	// earlier once views of MaxPending posts and days are buffered
+	FlushInterval time.Duration
+	MaxPending    int
+}
+
+// ReactionConfig tunes reactions of readers on posts
+type ReactionConfig struct {
+	// Emojis are reactions readers can leave
+	Emojis []string
+	// Rate is reactions per second a client may add or remove, Burst is how many at once
+	Rate  float64
+	Burst int
+}
+
+// NoReplies is MaxDepth of CommentConfig allowing no replies
+const NoReplies = -1
+
+// CommentConfig tunes comments of posts
+type CommentConfig struct {
+	// MaxDepth is how deep replies nest, top-level comments have depth 0, NoReplies
+	// allows top-level comments only since 0 takes default
+	MaxDepth int
+	// TrustAfter is how many approved comments a logined user needs before
+	// their comments are approved without moderation
+	TrustAfter int
+	// Rate is comments per second a client may submit, Burst is how many at once
+	Rate  float64
+	Burst int
+	// EditWindow is how long after submitting a comment its author may edit it,
+	// authors delete their comments at any time
+	EditWindow time.Duration
+	Spam       SpamConfig
+	// Policy is comment policy of posts which have none of their own, comments are open by default
+	Policy db.CommentPolicy
+	// Avatar is AvatarGravatar or AvatarIdenticon, it picks image readers see beside
+	// comments, identicons are generated by server from hash of email at /avatar/
+	Avatar string
+	// AvatarSecret keys hashes of emails identicons are drawn from, so readers cannot
+	// test guessed emails against them, it is random if nil, so identicons change on restarts
+	AvatarSecret []byte
+}
+
+// sources of avatars of commenters
+const (
+	AvatarGravatar  = "gravatar"
+	AvatarIdenticon = "identicon"
+)
+
+// SpamConfig tunes spam checks of comments submitted by readers who are not moderators
+type SpamConfig struct {
+	// Filters check each comment, their scores are added up
+	Filters []SpamFilter
+	// comments scoring at least SpamScore are marked as spam, those scoring
+	// at least HoldScore wait for moderation even if commenter is trusted
+	HoldScore float64
+	SpamScore float64
+	// Secret signs form tokens timing submissions, it is random if nil,
+	// so tokens do not survive restarts
+	Secret []byte
+}
+
+// ChallengeConfig tunes proofs of work asked of those who register or comment without login
+type ChallengeConfig struct {
+	// Secret signs challenges, it is random if nil, so challenges do not survive restarts
+	Secret []byte
+	// Difficulty is leading zero bits of a solution when server is quiet, each bit doubles
+	// work, it rises up to MaxDifficulty by a bit each time challenges requested and
+	// solutions failed in Window double beyond Threshold for a client or GlobalThreshold for all
+	Difficulty      int
+	MaxDifficulty   int
+	Window          time.Duration
+	Threshold       int
+	GlobalThreshold int
+	// TTL is how long a challenge can be solved
+	TTL time.Duration
+}
+
+// NotifyConfig tunes emails telling authors of posts about new comments and commenters
+// who opted in about replies to their comments
+type NotifyConfig struct {
+	// Mailer delivers emails, nothing is sent if it is nil
+	Mailer mailer.Mailer
+	// From is sender of emails
+	From string
+	// BaseURL is where server is reached, unsubscribe links point to it,
+	// PostURL is link to a post formatted with its pid
+	BaseURL string
+	PostURL string
+	// Secret signs unsubscribe and confirmation links, it is required with Mailer so links
+	// keep working after restarts
+	Secret []byte
+	// Interval is how often outbox is delivered, at most Batch emails each time
+	Interval time.Duration
+	Batch    int
+	// RetryDelay is how long a failed email waits before it is tried again, it doubles
+	// after each failure, an email is given up after MaxAttempts failures
+	RetryDelay  time.Duration
+	MaxAttempts int
+	// Lease is how long emails taken from outbox are kept from other instances sharing it,
+	// an email is sent again if its instance stops for longer before marking it
+	Lease time.Duration
+	// ConfirmResend is how long a commenter opting in to replies waits before another
+	// email asks to confirm their address
+	ConfirmResend time.Duration
+}
+
+// ArchiveConfig tunes export and import of /archive
+type ArchiveConfig struct {
+	// MaxSize is max size of an imported archive in bytes, it is read into memory
+	MaxSize int64
+	// MaxUncompressed is max bytes files of an imported zip take once decompressed
+	MaxUncompressed int64
+}
+
+func validConfig(c *Config) (*Config, error) {
+	if c == nil {
+		c = &Config{}
+	}
+	n := *c
+
+	if n.Suggest.Limit == 0 {
+		n.Suggest.Limit = 8
+	}
+	if n.Suggest.Rate == 0 {
+		n.Suggest.Rate = 5
+	}
+	if n.Suggest.Burst == 0 {
+		n.Suggest.Burst = 10
+	}
+	if n.Suggest.CacheTTL == 0 {
+		n.Suggest.CacheTTL = time.Minute
+	}
+	if n.Suggest.CacheSize == 0 {
+		n.Suggest.CacheSize = 1000
+	}
+	if n.Suggest.Limit < 0 || n.Suggest.Rate < 0 || n.Suggest.Burst < 0 || n.Suggest.CacheTTL < 0 || n.Suggest.CacheSize < 0 {
+		return nil, errors.New("negative suggest setting")
+	}
+
+	if n.Media.Storage == nil {
+		return nil, errors.New("nil media storage")
+	}
+	if n.Media.MaxSize == 0 {
+		n.Media.MaxSize = 10 << 20
+	}
+	if n.Media.MaxSize < 0 {
+		return nil, errors.New("negative media max size")
+	}
+	if len(n.Media.Types) == 0 {
+		n.Media.Types = []string{"image/jpeg", "image/png", "image/gif", "image/webp"}
+	}
+	for _, t := range n.Media.Types {
+		if mediaExt(t) == "" {
+			return nil, errors.New("no file extension known for media type " + t)
+		}
+	}
+
+	if n.Media.Images.Workers == 0 {
+		n.Media.Images.Workers = 2
+	}
+	if n.Media.Images.Queue == 0 {
+		n.Media.Images.Queue = 64
+	}
+	if n.Media.Images.Quality == 0 {
+		n.Media.Images.Quality = 85
+	}
+	if n.Media.Images.MaxPixels == 0 {
+		n.Media.Images.MaxPixels = 40000000
+	}
+	if n.Media.Images.Derivatives == nil {
+		n.Media.Images.Derivatives = []DerivativeSpec{
+			{Name: "thumbnail", MaxWidth: 200, MaxHeight: 200},
+			{Name: "medium", MaxWidth: 800},
+			{Name: "large", MaxWidth: 1600},
+		}
+	}
+	if n.Media.Images.MaxPixels < 0 {
+		return nil, errors.New("negative image pixel limit")
+	}
+	if n.Media.Images.Workers < 0 || n.Media.Images.Queue < 0 {
+		return nil, errors.New("negative image worker setting")
+	}
+	if n.Media.Images.Quality < 1 || n.Media.Images.Quality > 100 {
+		return nil, errors.New("image quality out of [1, 100]")
+	}
+	for _, ds := range n.Media.Images.Derivatives {
+		if ds.Name == "" || ds.MaxWidth < 0 || ds.MaxHeight < 0 || (ds.MaxWidth == 0 && ds.MaxHeight == 0) {
+			return nil, errors.New("derivative needs a name and a positive bound")
+		}
+	}
+	for t := range n.Media.Images.Encoders {
+		if mediaExt(t) == "" {
+			return nil, errors.New("no file extension known for encoder type " + t)
+		}
+	}
+
+	if n.Analytics.FlushInterval == 0 {
+		n.Analytics.FlushInterval = time.Minute
+	}
+	if n.Analytics.MaxPending == 0 {
+		n.Analytics.MaxPending = 1000
+	}
+	if n.Analytics.FlushInterval < 0 || n.Analytics.MaxPending < 0 {
+		return nil, errors.New("negative analytics setting")
+	}
+
+	if len(n.Reactions.Emojis) == 0 {
+		n.Reactions.Emojis = []string{"👍", "❤️", "🎉", "😄", "🤔"}
+	}
+	if n.Reactions.Rate == 0 {
+		n.Reactions.Rate = 1
+	}
+	if n.Reactions.Burst == 0 {
+		n.Reactions.Burst = 5
+	}
+	if n.Reactions.Rate < 0 || n.Reactions.Burst < 0 {
+		return nil, errors.New("negative reaction setting")
+	}
+	for _, e := range n.Reactions.Emojis {
+		if e == "" || len(e) > 32 {
+			return nil, errors.New("reaction emoji is empty or longer than 32 bytes")
+		}
+	}
+
+	if n.MaxJSONSize == 0 {
+		n.MaxJSONSize = 1 << 20
+	}
+	if n.MaxJSONSize < 0 {
+		return nil, errors.New("negative max json size")
+	}
+
+	if n.Archive.MaxSize == 0 {
+		n.Archive.MaxSize = 64 << 20
+	}
+	if n.Archive.MaxUncompressed == 0 {
+		n.Archive.MaxUncompressed = archive.DefaultMaxUncompressed
+	}
+	if n.Archive.MaxSize < 0 || n.Archive.MaxUncompressed < 0 {
+		return nil, errors.New("negative archive max size")
+	}
+
+	switch n.Comments.MaxDepth {
+	case 0:
+		n.Comments.MaxDepth = 5
+	case NoReplies:
+		n.Comments.MaxDepth = 0
+	}
+	if n.Comments.TrustAfter == 0 {
+		n.Comments.TrustAfter = 1
+	}
+	if n.Comments.Rate == 0 {
+		n.Comments.Rate = 0.2
+	}
+	if n.Comments.Burst == 0 {
+		n.Comments.Burst = 5
+	}
+	if n.Comments.EditWindow == 0 {
+		n.Comments.EditWindow = 15 * time.Minute
+	}
+	if n.Comments.Policy.Mode == "" {
+		n.Comments.Policy.Mode = db.CommentsOpen
+	}
+	if err := db.ValidCommentPolicy(&n.Comments.Policy); err != nil {
+		return nil, fmt.Errorf("default comment policy: %v", err)
+	}
+	if n.Comments.Avatar == "" {
+		n.Comments.Avatar = AvatarGravatar
+	}
+	if n.Comments.Avatar != AvatarGravatar && n.Comments.Avatar != AvatarIdenticon {
+		return nil, errors.New("comment avatar is neither gravatar nor identicon")
+	}
+	if n.Comments.MaxDepth < 0 || n.Comments.TrustAfter < 0 || n.Comments.Rate < 0 || n.Comments.Burst < 0 ||
+		n.Comments.EditWindow < 0 {
+		return nil, errors.New("negative comment setting")
+	}
+	if n.Comments.Spam.Filters == nil {
+		n.Comments.Spam.Filters = []SpamFilter{
+			&LinkFilter{Max: 2, PerLink: 0.25},
+			&HoneypotFilter{},
+			&TimeToSubmitFilter{Min: 3 * time.Second, MaxAge: 24 * time.Hour, Missing: 0.5},
+			&DuplicateFilter{Score: 0.5},
+			&BayesFilter{MinTrained: 10, Interesting: 15},
+		}
+	}
+	if n.Comments.Spam.HoldScore == 0 {
+		n.Comments.Spam.HoldScore = 0.5
+	}
+	if n.Comments.Spam.SpamScore == 0 {
+		n.Comments.Spam.SpamScore = 1
+	}
+	if n.Comments.Spam.HoldScore < 0 || n.Comments.Spam.SpamScore < n.Comments.Spam.HoldScore {
+		return nil, errors.New("spam score is below hold score or hold score is negative")
+	}
+	if n.Comments.AvatarSecret == nil {
+		n.Comments.AvatarSecret = make([]byte, 32)
+		if _, err := rand.Read(n.Comments.AvatarSecret); err != nil {
+			return nil, fmt.Errorf("generate avatar secret: %v", err)
+		}
+	}
+	if n.Comments.Spam.Secret == nil {
+		n.Comments.Spam.Secret = make([]byte, 32)
+		if _, err := rand.Read(n.Comments.Spam.Secret); err != nil {
+			return nil, fmt.Errorf("generate form token secret: %v", err)
+		}
+	}
+
+	if n.Challenge.Secret == nil {
+		n.Challenge.Secret = make([]byte, 32)
+		if _, err := rand.Read(n.Challenge.Secret); err != nil {
+			return nil, fmt.Errorf("generate challenge secret: %v", err)
+		}
+	}
+	if n.Challenge.Difficulty == 0 {
+		n.Challenge.Difficulty = 16
+	}
+	if n.Challenge.MaxDifficulty == 0 {
+		n.Challenge.MaxDifficulty = 24
+	}
+	if n.Challenge.Window == 0 {
+		n.Challenge.Window = 10 * time.Minute
+	}
+	if n.Challenge.Threshold == 0 {
+		n.Challenge.Threshold = 20
+	}
+	if n.Challenge.GlobalThreshold == 0 {
+		n.Challenge.GlobalThreshold = 1000
+	}
+	if n.Challenge.TTL == 0 {
+		n.Challenge.TTL = 10 * time.Minute
+	}
+	if n.Challenge.Difficulty < 0 || n.Challenge.Window < 0 || n.Challenge.Threshold < 0 || n.Challenge.GlobalThreshold < 0 || n.Challenge.TTL < 0 {
+		return nil, errors.New("negative challenge setting")
+	}
+	if n.Challenge.MaxDifficulty < n.Challenge.Difficulty || n.Challenge.MaxDifficulty > 32 {
+		return nil, errors.New("challenge max difficulty is below difficulty or above 32")
+	}
+
+	if n.Notify.Mailer != nil && len(n.Notify.Secret) == 0 {
+		return nil, errors.New("notify secret is required with mailer")
+	}
+	if n.Notify.From == "" {
+		n.Notify.From = "noreply@redhand.vip"
+	}
+	if n.Notify.BaseURL == "" {
+		n.Notify.BaseURL = "https://api.redhand.vip"
+	}
+	n.Notify.BaseURL = strings.TrimSuffix(n.Notify.BaseURL, "/")
+	if n.Notify.PostURL == "" {
+		n.Notify.PostURL = "https://www.redhand.vip/post?id=%d"
+	}
+	if strings.Count(n.Notify.PostURL, "%") != 1 || !strings.Contains(n.Notify.PostURL, "%d") {
+		return nil, errors.New("notify post url must have %d for pid and no other verb")
+	}
+	if n.Notify.Interval == 0 {
+		n.Notify.Interval = time.Minute
+	}
+	if n.Notify.Batch == 0 {
+		n.Notify.Batch = 20
+	}
+	if n.Notify.RetryDelay == 0 {
+		n.Notify.RetryDelay = time.Minute
+	}
+	if n.Notify.MaxAttempts == 0 {
+		n.Notify.MaxAttempts = 8
+	}
+	if n.Notify.Lease == 0 {
+		n.Notify.Lease = 10 * time.Minute
+	}
+	if n.Notify.ConfirmResend == 0 {
+		n.Notify.ConfirmResend = 24 * time.Hour
+	}
+	if n.Notify.Interval < 0 || n.Notify.Batch < 0 || n.Notify.RetryDelay < 0 || n.Notify.MaxAttempts < 0 ||
+		n.Notify.Lease < 0 || n.Notify.ConfirmResend < 0 {
+		return nil, errors.New("negative notify setting")
+	}
+	return &n, nil
+}
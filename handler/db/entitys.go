@@ -1,6 +1,7 @@
 package db
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"strconv"
 	"time"
@@ -14,15 +15,243 @@ type Post struct {
 	MDate   *Jstime  `json:"mDate"`
 	Content string   `json:"content"`
 	Tags    []string `json:"tags"`
+	// Language is code of language post is written in, like en
+	Language string `json:"language"`
+	// TranslationGroup is pid of first post of group of translations, 0 if post is not translated
+	TranslationGroup int `json:"translationGroup"`
+	// Version is increased by each update of post
+	Version int `json:"version"`
+	// Pinned posts are listed first until PinnedUntil, or forever if it is nil
+	Pinned      bool    `json:"pinned"`
+	PinnedUntil *Jstime `json:"pinnedUntil"`
+	Featured    bool    `json:"featured"`
+	// Reactions counts reactions of readers by emoji
+	Reactions map[string]int `json:"reactions"`
+	// CommentCount counts approved comments of post which are not deleted
+	CommentCount int `json:"commentCount"`
+	// Translations and TOC are only filled when a single post is viewed
+	Translations []Translation `json:"translations,omitempty"`
+	TOC          []TOCEntry    `json:"toc,omitempty"`
+	// Series places post in its series, Prev and Next are posts written just before and after it,
+	// they are only filled when a single post is viewed and omitted if there are none
+	Series *SeriesPosition `json:"series,omitempty"`
+	Prev   *PostLink       `json:"prev,omitempty"`
+	Next   *PostLink       `json:"next,omitempty"`
+	// CommentPolicy is policy comments of post follow, only filled when a single post is viewed
+	CommentPolicy *PostCommentPolicy `json:"commentPolicy,omitempty"`
+	// Rank and Snippet are only filled by full text search
+	Rank    float64 `json:"rank,omitempty"`
+	Snippet string  `json:"snippet,omitempty"`
+}
+
+// Translation refers to a post translated into another language
+type Translation struct {
+	PostID   int    `json:"pid"`
+	Language string `json:"language"`
+	Title    string `json:"title"`
+}
+
+// PostLink refers to another post by its title
+type PostLink struct {
+	PostID int    `json:"pid"`
+	Title  string `json:"title"`
+}
+
+// Series is an ordered list of posts like parts of a tutorial, a post is in one series at most
+type Series struct {
+	SeriesID    int        `json:"sid"`
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	Parts       []PostLink `json:"parts"`
+}
+
+// SeriesPosition is where a post is in its series, Part counts from 1
+// and Prev and Next are nil for first and last parts
+type SeriesPosition struct {
+	SeriesID int       `json:"sid"`
+	Title    string    `json:"title"`
+	Part     int       `json:"part"`
+	Total    int       `json:"total"`
+	Prev     *PostLink `json:"prev"`
+	Next     *PostLink `json:"next"`
+}
+
+// TOCEntry is a heading in content of a post with headings nested in it,
+// Anchor is id of heading in rendered content
+type TOCEntry struct {
+	Level    int        `json:"level"`
+	Text     string     `json:"text"`
+	Anchor   string     `json:"anchor"`
+	Children []TOCEntry `json:"children,omitempty"`
+}
+
+// Highlight holds markers wrapped around matched words in search snippets
+type Highlight struct {
+	StartSel string
+	StopSel  string
+}
+
+// PostFilter is a parameterized SQL condition on Posts aliased as p,
+// placeholders in Cond are numbered from $1 and bound to Args, PinnedFirst orders
+// posts whose pin has not expired first like default listing
+type PostFilter struct {
+	Cond        string
+	Args        []interface{}
+	PinnedFirst bool
+}
+
+// Suggestions are title completions and spelling corrections of a partial search
+type Suggestions struct {
+	Completions []string `json:"completions"`
+	Corrections []string `json:"corrections"`
 }
 
 // Comment contains info about a comment of a post in blog
 type Comment struct {
-	PostID    int     `json:"pid"`
-	CommentID int     `json: "cid`
-	Email     string  `json: "email"`
-	CDate     *Jstime `json:"cDate"`
-	Content   string  `json: "content"`
+	PostID    int    `json:"pid"`
+	CommentID int    `json:"cid"`
+	Email     string `json:"email"`
+	// AuthorName is name commenter gave, empty if none was given
+	AuthorName string `json:"authorName"`
+	// UID is uid of logined commenter, 0 for comments without login
+	UID     int     `json:"uid"`
+	CDate   *Jstime `json:"cDate"`
+	Content string  `json:"content"`
+	// Version is increased by each update of comment, EditedAt is when its content
+	// was last changed, nil if it never was
+	Version  int     `json:"version"`
+	EditedAt *Jstime `json:"editedAt"`
+	// CreatedAt is when comment was submitted, CDate keeps only its day
+	CreatedAt *Jstime `json:"-"`
+	// EditToken is sha256 of secret a commenter without login edits comment by,
+	// it is only set on insert
+	EditToken []byte `json:"-"`
+	// NotifyReplies is true if commenter asked to be emailed about direct replies
+	NotifyReplies bool `json:"notifyReplies"`
+	// Source is id of comment in export of another blog it is imported from, like disqus:123,
+	// a comment of a source is imported once
+	Source string `json:"-"`
+	// ParentID is cid of comment replied to, 0 for a top-level comment,
+	// Depth counts comments above it in its thread
+	ParentID int `json:"parentCommentId"`
+	Depth    int `json:"depth"`
+	// Deleted comments which have replies are kept with content [deleted] and no email
+	Deleted bool `json:"deleted"`
+	// Status is one of CommentPending, CommentApproved, CommentRejected and CommentSpam,
+	// only approved comments are shown to readers
+	Status string `json:"status"`
+	// SpamScores are scores spam checks gave comment when it was submitted
+	SpamScores []SpamScore `json:"spamScores,omitempty"`
+	// Replies are only filled when comments are viewed as a tree
+	Replies []Comment `json:"replies,omitempty"`
+	// PostTitle and PostSlug are only filled in recent comments of every post
+	PostTitle string `json:"postTitle,omitempty"`
+	PostSlug  string `json:"postSlug,omitempty"`
+}
+
+// moderation statuses of comments
+const (
+	CommentPending  = "pending"
+	CommentApproved = "approved"
+	CommentRejected = "rejected"
+	CommentSpam     = "spam"
+)
+
+// ValidCommentStatus checks status is a moderation status of comments
+func ValidCommentStatus(status string) bool {
+	switch status {
+	case CommentPending, CommentApproved, CommentRejected, CommentSpam:
+		return true
+	}
+	return false
+}
+
+// Mail is an email waiting in outbox, Attempts counts failed deliveries
+type Mail struct {
+	MailID   int
+	To       string
+	Subject  string
+	Body     string
+	Headers  map[string]string
+	Attempts int
+}
+
+// modes of comment policies
+const (
+	CommentsOpen    = "open"
+	CommentsClosed  = "closed"
+	CommentsMembers = "members"
+)
+
+// ValidCommentsMode checks mode is a mode of comment policies
+func ValidCommentsMode(mode string) bool {
+	switch mode {
+	case CommentsOpen, CommentsClosed, CommentsMembers:
+		return true
+	}
+	return false
+}
+
+// CommentPolicy decides who comments on a post: anyone, nobody or logined users only,
+// CloseAfterDays closes comments that many days after post is created, 0 never closes them
+type CommentPolicy struct {
+	Mode           string `json:"mode"`
+	CloseAfterDays int    `json:"closeAfterDays"`
+}
+
+// PostCommentPolicy is policy a post follows, its own or site default if Default,
+// ClosesAt is when comments are closed by CloseAfterDays and Closed tells they are
+// closed now, by mode or by date
+type PostCommentPolicy struct {
+	CommentPolicy
+	Default  bool    `json:"default"`
+	ClosesAt *Jstime `json:"closesAt"`
+	Closed   bool    `json:"closed"`
+}
+
+// SpamScore is score a spam check gave a comment, in [0, 1] where 1 is surely spam
+type SpamScore struct {
+	Check  string  `json:"check"`
+	Score  float64 `json:"score"`
+	Reason string  `json:"reason,omitempty"`
+}
+
+// TokenCounts counts spam and ham comments a token is found in
+type TokenCounts struct {
+	Spam int
+	Ham  int
+}
+
+// SpamCorpus is what spam filter learnt of some tokens from comments moderators marked
+// as spam or approved, SpamDocs and HamDocs count those comments
+type SpamCorpus struct {
+	SpamDocs int
+	HamDocs  int
+	Tokens   map[string]TokenCounts
+}
+
+// PostPatch lists fields of a post to change, nil fields are kept
+type PostPatch struct {
+	Title   *string
+	Content *string
+	// Tags replace all tags of post, an empty slice removes them
+	Tags     *[]string
+	Language *string
+}
+
+// CommentPatch lists fields of a comment to change, nil fields are kept
+type CommentPatch struct {
+	Content *string
+	Email   *string
+}
+
+// VersionConflict is returned when a post or comment was changed since the version a client expected
+type VersionConflict struct {
+	Current int `json:"version"`
+}
+
+func (vc *VersionConflict) Error() string {
+	return fmt.Sprintf("version conflict: current version is %d", vc.Current)
 }
 
 // User contains info that depicts a user
@@ -32,18 +261,170 @@ type User struct {
 	Privilege int    `json:"privilege"`
 }
 
+// UserAccount is a user with hash of its password, it is only read to move users between servers
+type UserAccount struct {
+	User
+	PassWord [sha256.Size]byte
+}
+
+// privileges of users, smaller ones are more powerful
+const (
+	PrivilegeAdmin     = 0
+	PrivilegeEditor    = 10
+	PrivilegeModerator = 50
+	PrivilegeUser      = 100
+)
+
+// Media contains info about a file uploaded to blog
+type Media struct {
+	MediaID    int     `json:"mid"`
+	UploaderID int     `json:"uploader"`
+	FileName   string  `json:"fileName"`
+	MIME       string  `json:"mime"`
+	Size       int64   `json:"size"`
+	Hash       string  `json:"hash"`
+	Width      int     `json:"width"`
+	Height     int     `json:"height"`
+	CDate      *Jstime `json:"cDate"`
+	// Key locates file in storage, URL is where browsers download it
+	Key string `json:"-"`
+	URL string `json:"url"`
+	// PostIDs are posts media is linked to
+	PostIDs []int `json:"pids"`
+	// Derivatives are scaled down copies of an image, SrcSet lists those of
+	// same type as image and Sources lists srcset of each other type
+	Derivatives []Derivative      `json:"derivatives"`
+	SrcSet      string            `json:"srcset,omitempty"`
+	Sources     map[string]string `json:"sources,omitempty"`
+}
+
+// Derivative is a scaled down copy of an uploaded image
+type Derivative struct {
+	Name   string `json:"name"`
+	MIME   string `json:"mime"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Key    string `json:"-"`
+	URL    string `json:"url"`
+}
+
+// MediaPage packs media and maxPage number of them
+type MediaPage struct {
+	Media   []Media `json:"media"`
+	MaxPage int     `json:"maxPage"`
+}
+
+// ViewRecord is views of a post on a day buffered before they are written to db,
+// Visitors are salted hashes of readers and Referrers counts views by referring domain
+type ViewRecord struct {
+	PostID    int
+	Day       time.Time
+	Views     int
+	Visitors  []string
+	Referrers map[string]int
+}
+
+// DailyViews counts views and unique visitors of a post on a day
+type DailyViews struct {
+	PostID   int     `json:"pid"`
+	Day      *Jstime `json:"day"`
+	Views    int     `json:"views"`
+	Visitors int     `json:"visitors"`
+}
+
+// TopPost counts views and unique visitors of a post in a period
+type TopPost struct {
+	PostID   int    `json:"pid"`
+	Title    string `json:"title"`
+	Views    int    `json:"views"`
+	Visitors int    `json:"visitors"`
+}
+
+// ReferrerViews counts views coming from a domain in a period
+type ReferrerViews struct {
+	Domain string `json:"domain"`
+	Views  int    `json:"views"`
+}
+
+// Analytics packs views of posts in a period
+type Analytics struct {
+	Daily     []DailyViews    `json:"daily"`
+	Top       []TopPost       `json:"top"`
+	Referrers []ReferrerViews `json:"referrers"`
+}
+
 // PostsPage packs posts and maxpage together for convenience
 type PostsPage struct {
 	Posts   []Post `json:"posts"`
 	MaxPage int    `json:"maxPage"`
 }
 
-// CommentsPage that packs comments and maxPage number of these comments
+// CommentsPage that packs comments and maxPage number of these comments,
+// comments are paged by top-level thread
 type CommentsPage struct {
-	Comments []Comment `json: "comments"`
+	Comments []Comment `json:"comments"`
 	MaxPage  int       `json:"maxPage"`
 }
 
+// PublicComment is a comment as readers see it, it leaves out email of commenter
+// and identifies them by name and avatar
+type PublicComment struct {
+	PostID     int    `json:"pid"`
+	CommentID  int    `json:"cid"`
+	AuthorName string `json:"authorName"`
+	UID        int    `json:"uid"`
+	// AvatarHash is hex of sha256 of trimmed lowercased email for Gravatar, or of an hmac
+	// of it keyed by a server secret for identicons, which clients cannot compute,
+	// AvatarURL is image of it, both are empty for deleted comments
+	AvatarHash string  `json:"avatarHash"`
+	AvatarURL  string  `json:"avatarUrl"`
+	CDate      *Jstime `json:"cDate"`
+	Content    string  `json:"content"`
+	Version    int     `json:"version"`
+	EditedAt   *Jstime `json:"editedAt"`
+	ParentID   int     `json:"parentCommentId"`
+	Depth      int     `json:"depth"`
+	Deleted    bool    `json:"deleted"`
+	// Replies are only filled when comments are viewed as a tree
+	Replies []PublicComment `json:"replies,omitempty"`
+	// PostTitle and PostSlug are only filled in recent comments of every post
+	PostTitle string `json:"postTitle,omitempty"`
+	PostSlug  string `json:"postSlug,omitempty"`
+}
+
+// CommentCursor is position of a comment in recent comments, newest first
+type CommentCursor struct {
+	CreatedAt time.Time
+	CommentID int
+}
+
+// RecentCommentsFilter selects recent comments of every post, an empty Status is any status,
+// nil dates are unbounded and comments are listed after Cursor unless it is nil
+type RecentCommentsFilter struct {
+	Status string
+	From   *time.Time
+	To     *time.Time
+	Cursor *CommentCursor
+}
+
+// RecentCommentsPage is a page of recent comments, NextCursor is empty on last page
+type RecentCommentsPage struct {
+	Comments   []Comment `json:"comments"`
+	NextCursor string    `json:"nextCursor"`
+}
+
+// PublicRecentCommentsPage is a page of recent comments as readers see it
+type PublicRecentCommentsPage struct {
+	Comments   []PublicComment `json:"comments"`
+	NextCursor string          `json:"nextCursor"`
+}
+
+// PublicCommentsPage is a page of comments as readers see it
+type PublicCommentsPage struct {
+	Comments []PublicComment `json:"comments"`
+	MaxPage  int             `json:"maxPage"`
+}
+
 // Response is our generic json response schema
 type Response struct {
 	Err  *JsError    `json:"err"`
@@ -2,6 +2,7 @@ package db
 
 import (
 	"crypto/sha256"
+	"time"
 )
 
 // DB lists essential methods for the use of blog server
@@ -9,18 +10,88 @@ type DB interface {
 	GetPostByID(id int) (*Post, error)
 	GetPosts(pageSize, page int) ([]Post, error)
 	GetPostsCount() (int, error)
-	GetPostsByFTS(search string, pageSize, page int) ([]Post, error)
-	GetPostsCountByFTS(search string) (int, error)
+	GetPostsByFTS(search, lang string, hl *Highlight, pageSize, page int) ([]Post, error)
+	GetPostsCountByFTS(search, lang string) (int, error)
+	GetPostsByFilter(f *PostFilter, pageSize, page int) ([]Post, error)
+	GetPostsCountByFilter(f *PostFilter) (int, error)
+	GetSuggestions(search string, limit int) (*Suggestions, error)
 	UserLogin(user string, pass [sha256.Size]byte) (*User, error)
-	InsertPost(title string, content string, tags []string) (int, error)
+	InsertPost(title string, content string, tags []string, lang string, authorUID int) (int, error)
+	GetPostAuthor(pid int) (uid int, email string, err error)
 	DeletePost(pid int) (bool, error)
-	UpdatePost(pid int, nTitle, nContent string, nTags []string) (bool, error)
+	UpdatePost(pid, version int, nTitle, nContent string, nTags []string, nLang string) (bool, error)
+	PatchPost(pid, version int, p *PostPatch) (bool, error)
+	SetPostPinned(pid int, pinned bool, until *time.Time) (bool, error)
+	SetPostFeatured(pid int, featured bool) (bool, error)
+	LinkTranslation(pid, groupPID int) (bool, error)
+	UnlinkTranslation(pid int) (bool, error)
+	GetTranslations(pid int) ([]Translation, error)
+	GetPostTOC(pid int) ([]TOCEntry, int, error)
+	SetPostTOC(pid, version int, toc []TOCEntry) (bool, error)
+	GetAdjacentPosts(pid int) (prev, next *PostLink, err error)
+	InsertSeries(title, description string) (int, error)
+	UpdateSeries(sid int, title, description string) (bool, error)
+	DeleteSeries(sid int) (bool, error)
+	SetSeriesParts(sid int, pids []int) (bool, error)
+	GetSeries(sid int) (*Series, error)
+	GetAllSeries() ([]Series, error)
+	GetPostSeries(pid int) (*SeriesPosition, error)
+	GetCommentPolicy(pid int) (policy *CommentPolicy, cDate time.Time, err error)
+	SetCommentPolicy(pid int, policy *CommentPolicy) (bool, error)
 	GetCommentsCount(pid int) (int, error)
+	GetThreadsCount(pid int) (int, error)
 	GetCommentsByPage(pid int, pageSize, page int) ([]Comment, error)
-	InsertComment(pid int, content, authorEmail string) (int, error)
+	GetComment(cid int) (*Comment, error)
+	InsertComment(c *Comment) (int, error)
+	GetCommentsByStatus(status string, pageSize, page int) ([]Comment, error)
+	GetRecentComments(f *RecentCommentsFilter, limit int) ([]Comment, error)
+	GetCommentsCountByStatus(status string) (int, error)
+	SetCommentsStatus(cids []int, status string) (int, error)
+	GetCommenterStatusCounts(uid int) (map[string]int, error)
+	CountCommentsByContent(content string) (int, error)
+	GetSpamCorpus(tokens []string) (*SpamCorpus, error)
+	TrainSpam(cid int, tokens []string, spam bool) (bool, error)
 	DeleteComment(cid int) (bool, error)
-	UpdateComment(cid int, nContent, nAE string) (bool, error)
+	UpdateComment(cid, version int, nContent, nAE string) (bool, error)
+	PatchComment(cid, version int, p *CommentPatch) (bool, error)
+	GetCommentEditToken(cid int) ([]byte, error)
+	EditComment(cid, version int, nContent, status string, scores []SpamScore, since time.Time) (bool, error)
 	GetUser(userName string, passWord [sha256.Size]byte) (*User, error)
 	InsertUser(userName string, passWord [sha256.Size]byte) (int, error)
 	UpdateUser(uid int, nPW [sha256.Size]byte) (bool, error)
+	SetUserEmail(uid int, email string) (bool, error)
+	EnqueueMail(m *Mail) (bool, error)
+	GetDueMails(limit int, lease time.Duration) ([]Mail, error)
+	MarkMailSent(mid int) error
+	MarkMailFailed(mid int, lastError string, nextAttempt *time.Time) error
+	OptOutEmail(email string) (bool, error)
+	RequestEmailConfirmation(email string, resendAfter time.Duration) (bool, error)
+	ConfirmEmail(email string) (bool, error)
+	IsEmailConfirmed(email string) (bool, error)
+	InsertMedia(m *Media) (int, error)
+	GetMedia(mid int) (*Media, error)
+	GetMediaByPage(pageSize, page int) ([]Media, error)
+	GetMediaCount() (int, error)
+	GetMediaOfPost(pid int) ([]Media, error)
+	DeleteMedia(mid int) (bool, error)
+	LinkMedia(mid, pid int) (bool, error)
+	UnlinkMedia(mid, pid int) (bool, error)
+	InsertDerivative(mid int, dv *Derivative) (bool, error)
+	AddReaction(pid int, reactor, emoji string) (bool, error)
+	RemoveReaction(pid int, reactor, emoji string) (bool, error)
+	GetReactions(pid int) (map[string]int, error)
+	MoveReactions(from, to string) (int, error)
+	GetPostsAfter(pid, limit int) ([]Post, error)
+	GetCommentsAfter(cid, limit int) ([]Comment, error)
+	GetUserAccounts() ([]UserAccount, error)
+	GetPostIDByTitle(title string) (int, error)
+	GetCommentIDBySource(source string) (int, error)
+	GetUserIDByName(userName string) (int, error)
+	ImportPost(p *Post) (int, error)
+	ImportComment(c *Comment) (int, error)
+	ImportUser(u *UserAccount) (int, error)
+	RecordViews(records []ViewRecord) error
+	GetDailyViews(from, to time.Time, pid int) ([]DailyViews, error)
+	GetTopPosts(from, to time.Time, limit int) ([]TopPost, error)
+	GetReferrers(from, to time.Time, limit int) ([]ReferrerViews, error)
 }
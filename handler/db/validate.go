@@ -0,0 +1,102 @@
+package db
+
+import (
+	"fmt"
+	"net/mail"
+	"unicode/utf8"
+)
+
+// limits of fields enforced by schema, see backend.md
+const (
+	MinTitleLen          = 3
+	MaxTitleLen          = 15
+	MinContentLen        = 10
+	MaxContentLen        = 3500
+	MinTagLen            = 2
+	MaxTagLen            = 6
+	MaxTags              = 5
+	MinCommentContentLen = 2
+	MaxCommentContentLen = 100
+	MinSeriesTitleLen    = 3
+	MaxSeriesTitleLen    = 30
+	MaxSeriesDescLen     = 300
+	MaxSeriesParts       = 50
+	MaxAuthorNameLen     = 30
+	MaxCloseAfterDays    = 3650
+)
+
+// validLength checks s has [min, max] characters
+func validLength(field, s string, min, max int) error {
+	if n := utf8.RuneCountInString(s); n < min || n > max {
+		return fmt.Errorf("%s must have %d to %d characters", field, min, max)
+	}
+	return nil
+}
+
+// ValidTitle checks title of a post fits in schema
+func ValidTitle(title string) error {
+	return validLength("title", title, MinTitleLen, MaxTitleLen)
+}
+
+// ValidContent checks content of a post fits in schema
+func ValidContent(content string) error {
+	return validLength("content", content, MinContentLen, MaxContentLen)
+}
+
+// ValidTags checks a post has at most MaxTags distinct tags which fit in schema
+func ValidTags(tags []string) error {
+	if len(tags) > MaxTags {
+		return fmt.Errorf("a post cannot have more than %d tags", MaxTags)
+	}
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		if err := validLength("tag", tag, MinTagLen, MaxTagLen); err != nil {
+			return err
+		}
+		if seen[tag] {
+			return fmt.Errorf("tag %q is given twice", tag)
+		}
+		seen[tag] = true
+	}
+	return nil
+}
+
+// ValidSeriesTitle checks title of a series fits in schema
+func ValidSeriesTitle(title string) error {
+	return validLength("title", title, MinSeriesTitleLen, MaxSeriesTitleLen)
+}
+
+// ValidSeriesDescription checks description of a series fits in schema
+func ValidSeriesDescription(desc string) error {
+	return validLength("description", desc, 0, MaxSeriesDescLen)
+}
+
+// ValidCommentContent checks content of a comment fits in schema
+func ValidCommentContent(content string) error {
+	return validLength("content", content, MinCommentContentLen, MaxCommentContentLen)
+}
+
+// ValidAuthorName checks name a commenter gives fits in schema, it may be empty
+func ValidAuthorName(name string) error {
+	return validLength("authorName", name, 0, MaxAuthorNameLen)
+}
+
+// ValidEmail checks email is a bare address like a@b.c
+func ValidEmail(email string) error {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return fmt.Errorf("%q is not an email address", email)
+	}
+	return nil
+}
+
+// ValidCommentPolicy checks mode of p is known and its comments close within MaxCloseAfterDays
+func ValidCommentPolicy(p *CommentPolicy) error {
+	if !ValidCommentsMode(p.Mode) {
+		return fmt.Errorf("comment policy mode %q is not one of open, closed and members", p.Mode)
+	}
+	if p.CloseAfterDays < 0 || p.CloseAfterDays > MaxCloseAfterDays {
+		return fmt.Errorf("closeAfterDays must be in [0, %d]", MaxCloseAfterDays)
+	}
+	return nil
+}
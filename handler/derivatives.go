@@ -0,0 +1,189 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"middleware/handler/db"
+	"middleware/handler/storage"
+	"path"
+	"strings"
+	"sync"
+)
+
+// imageProcessor generates derivatives of uploaded images on a bounded pool of workers
+type imageProcessor struct {
+	d    db.DB
+	st   storage.Storage
+	cfg  *ImageConfig
+	jobs chan *db.Media
+
+	mu      sync.Mutex
+	closed  bool
+	workers sync.WaitGroup
+}
+
+func newImageProcessor(d db.DB, st storage.Storage, cfg *ImageConfig) *imageProcessor {
+	ip := &imageProcessor{d: d, st: st, cfg: cfg, jobs: make(chan *db.Media, cfg.Queue)}
+	ip.workers.Add(cfg.Workers)
+	for i := 0; i < cfg.Workers; i++ {
+		go ip.work()
+	}
+	return ip
+}
+
+// close refuses new images and waits for workers to process those queued, so no
+// derivative is left half written
+func (ip *imageProcessor) close() {
+	ip.mu.Lock()
+	if !ip.closed {
+		ip.closed = true
+		close(ip.jobs)
+	}
+	ip.mu.Unlock()
+	ip.workers.Wait()
+}
+
+// decodableImage reports if derivatives can be generated for images of mimeType
+func decodableImage(mimeType string) bool {
+	return mimeType == "image/jpeg" || mimeType == "image/png" || mimeType == "image/gif"
+}
+
+// derivativeType is type derivatives of an image of mimeType are encoded in,
+// photos stay jpeg while others may need transparency
+func derivativeType(mimeType string) string {
+	if mimeType == "image/jpeg" {
+		return "image/jpeg"
+	}
+	return "image/png"
+}
+
+func derivativeKey(key, name, mimeType string) string {
+	return strings.TrimSuffix(key, path.Ext(key)) + "-" + name + mediaExt(mimeType)
+}
+
+// submit queues m without blocking, returns false if queue is full or closed
+func (ip *imageProcessor) submit(m *db.Media) bool {
+	ip.mu.Lock()
+	defer ip.mu.Unlock()
+	if ip.closed {
+		return false
+	}
+	select {
+	case ip.jobs <- m:
+		return true
+	default:
+		return false
+	}
+}
+
+func (ip *imageProcessor) work() {
+	defer ip.workers.Done()
+	for m := range ip.jobs {
+		err := ip.process(m)
+		if err != nil {
+			log.Printf("generate derivatives of media %d: %v\n", m.MediaID, err)
+		}
+	}
+}
+
+func (ip *imageProcessor) process(m *db.Media) error {
+	f, err := ip.st.Get(m.Key)
+	if err != nil {
+		return fmt.Errorf("get file: %v", err)
+	}
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("read file: %v", err)
+	}
+	// files stored before limit was lowered are checked too
+	if err := checkPixels(data, ip.cfg.MaxPixels); err != nil {
+		return err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("decode image: %v", err)
+	}
+	src := toNRGBA(img)
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+
+	for _, ds := range ip.cfg.Derivatives {
+		w, h := fitSize(sw, sh, ds.MaxWidth, ds.MaxHeight)
+		if w == sw && h == sh {
+			// original already fits, it is listed in srcset by itself
+			continue
+		}
+		scaled := resize(src, w, h)
+
+		encoders := map[string]ImageEncoder{derivativeType(m.MIME): ip.encode(derivativeType(m.MIME))}
+		for t, enc := range ip.cfg.Encoders {
+			encoders[t] = enc
+		}
+		for t, enc := range encoders {
+			buf := &bytes.Buffer{}
+			err := enc(buf, scaled)
+			if err != nil {
+				return fmt.Errorf("encode %s as %s: %v", ds.Name, t, err)
+			}
+			dv := &db.Derivative{Name: ds.Name, MIME: t, Width: w, Height: h, Key: derivativeKey(m.Key, ds.Name, t)}
+			err = ip.st.Put(dv.Key, buf)
+			if err != nil {
+				return fmt.Errorf("store %s: %v", ds.Name, err)
+			}
+			performed, err := ip.d.InsertDerivative(m.MediaID, dv)
+			if err != nil {
+				return fmt.Errorf("insert derivative: %v", err)
+			}
+			if !performed {
+				// media was deleted meanwhile
+				ip.st.Delete(dv.Key)
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+func (ip *imageProcessor) encode(mimeType string) ImageEncoder {
+	if mimeType == "image/jpeg" {
+		return func(w io.Writer, img image.Image) error {
+			return jpeg.Encode(w, img, &jpeg.Options{Quality: ip.cfg.Quality})
+		}
+	}
+	return png.Encode
+}
+
+// fillMediaURLs sets URL of media and its derivatives, and srcset of derivatives grouped by type
+func fillMediaURLs(st storage.Storage, m *db.Media) {
+	m.URL = st.URL(m.Key)
+	if len(m.Derivatives) == 0 {
+		return
+	}
+
+	sets := map[string][]string{}
+	for i := range m.Derivatives {
+		dv := &m.Derivatives[i]
+		dv.URL = st.URL(dv.Key)
+		sets[dv.MIME] = append(sets[dv.MIME], fmt.Sprintf("%s %dw", dv.URL, dv.Width))
+	}
+	primary := derivativeType(m.MIME)
+	if m.MIME == primary && m.Width > 0 {
+		sets[primary] = append(sets[primary], fmt.Sprintf("%s %dw", m.URL, m.Width))
+	}
+	m.SrcSet = strings.Join(sets[primary], ", ")
+	for t, set := range sets {
+		if t == primary {
+			continue
+		}
+		if m.Sources == nil {
+			m.Sources = map[string]string{}
+		}
+		m.Sources[t] = strings.Join(set, ", ")
+	}
+}
@@ -1,18 +1,89 @@
 package handler
 
 import (
+	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"html"
+	"log"
 	"math"
 	"middleware/handler/db"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Jeffail/gabs/v2"
 )
 
-func viewPost(d db.DB, r *http.Request) (*db.Post, error) {
+// defaultLanguage is assumed for posts inserted without language
+const defaultLanguage = "en"
+
+// validLanguage checks lang looks like an ISO 639-1 code,
+// whether it is supported is decided by Languages table
+func validLanguage(lang string) bool {
+	if len(lang) != 2 {
+		return false
+	}
+	for _, c := range lang {
+		if c < 'a' || c > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
+// default markers wrapped around matched words in search snippets
+const (
+	defaultStartSel = "<mark>"
+	defaultStopSel  = "</mark>"
+)
+
+// parseHighlight reads snippet markers from hlStart and hlStop, markers are
+// spliced into options of ts_headline so option delimiters are refused
+func parseHighlight(r *http.Request) (*db.Highlight, error) {
+	hl := &db.Highlight{StartSel: r.FormValue("hlStart"), StopSel: r.FormValue("hlStop")}
+	if hl.StartSel == "" {
+		hl.StartSel = defaultStartSel
+	}
+	if hl.StopSel == "" {
+		hl.StopSel = defaultStopSel
+	}
+	for _, sel := range []string{hl.StartSel, hl.StopSel} {
+		if len(sel) > 32 {
+			return nil, errors.New("highlight marker cannot be longer than 32 bytes")
+		}
+		if strings.ContainsAny(sel, ",=\" \t\r\n") {
+			return nil, errors.New("highlight marker cannot contain comma, equal sign, quote or space")
+		}
+	}
+	return hl, nil
+}
+
+// escapeSnippet escapes html of post content in snippet s, markers of hl are kept
+// as they are, so a snippet is rendered as html with only its highlights as tags
+func escapeSnippet(s string, hl *db.Highlight) string {
+	var b strings.Builder
+	for {
+		i, sel := strings.Index(s, hl.StartSel), hl.StartSel
+		if j := strings.Index(s, hl.StopSel); j >= 0 && (i < 0 || j < i) {
+			i, sel = j, hl.StopSel
+		}
+		if i < 0 {
+			b.WriteString(html.EscapeString(s))
+			return b.String()
+		}
+		b.WriteString(html.EscapeString(s[:i]))
+		b.WriteString(sel)
+		s = s[i+len(sel):]
+	}
+}
+
+func viewPost(d db.DB, cfg *CommentConfig, r *http.Request) (*db.Post, error) {
 	idStr := r.FormValue("id")
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
@@ -25,11 +96,58 @@ func viewPost(d db.DB, r *http.Request) (*db.Post, error) {
 	if err != nil {
 		return nil, fmt.Errorf("get post by id: %v", err)
 	}
+	if post.TranslationGroup != 0 {
+		post.Translations, err = d.GetTranslations(post.PostID)
+		if err != nil {
+			return nil, fmt.Errorf("get translations: %v", err)
+		}
+	}
+	post.TOC, err = postTOC(d, post)
+	if err != nil {
+		return nil, fmt.Errorf("get toc: %v", err)
+	}
+	post.Series, err = d.GetPostSeries(post.PostID)
+	if err != nil {
+		return nil, fmt.Errorf("get series: %v", err)
+	}
+	post.Prev, post.Next, err = d.GetAdjacentPosts(post.PostID)
+	if err != nil {
+		return nil, fmt.Errorf("get adjacent posts: %v", err)
+	}
+	post.CommentPolicy, err = commentPolicy(d, cfg, post.PostID)
+	if err != nil {
+		return nil, fmt.Errorf("get comment policy: %v", err)
+	}
 
 	return post, nil
 
 }
 
+// postTOC returns table of contents cached for current version of post, it is made
+// and cached if post was written before tables of contents were cached
+func postTOC(d db.DB, post *db.Post) ([]db.TOCEntry, error) {
+	toc, version, err := d.GetPostTOC(post.PostID)
+	if err != nil {
+		return nil, err
+	}
+	if toc != nil && version == post.Version {
+		return toc, nil
+	}
+	toc = extractTOC(post.Content)
+	if _, err := d.SetPostTOC(post.PostID, post.Version, toc); err != nil {
+		return nil, err
+	}
+	return toc, nil
+}
+
+// cacheTOC makes table of contents of content written as version of post of pid,
+// a failure is only logged since the post is written and toc is made again on view
+func cacheTOC(d db.DB, pid, version int, content string) {
+	if _, err := d.SetPostTOC(pid, version, extractTOC(content)); err != nil {
+		log.Printf("cache toc of post %d: %v", pid, err)
+	}
+}
+
 func viewPosts(d db.DB, r *http.Request) (*db.PostsPage, error) {
 	filterStr := r.FormValue("keyword")
 
@@ -55,6 +173,49 @@ func viewPosts(d db.DB, r *http.Request) (*db.PostsPage, error) {
 
 	search := filterStr
 
+	lang := r.FormValue("lang")
+	if lang != "" && !validLanguage(lang) {
+		return nil, errors.New("lang is not a two letter language code")
+	}
+
+	// listings are exclusive, a query takes words and is:featured itself
+	q, featured := r.FormValue("q"), r.FormValue("featured") == "true"
+	switch {
+	case q != "" && search != "":
+		return nil, errors.New("q cannot be combined with keyword, words of q are searched")
+	case q != "" && featured:
+		return nil, errors.New("q cannot be combined with featured, use is:featured in q")
+	case featured && search != "":
+		return nil, errors.New("featured cannot be combined with keyword")
+	}
+
+	if q != "" {
+		return queryPosts(d, q, lang, pageSize, page)
+	}
+	// featured and lang narrow default listing, so pinned posts keep their place
+	if featured {
+		var ast queryNode = &queryFeatured{}
+		if lang != "" {
+			ast = &queryAnd{[]queryNode{ast, &queryLang{lang}}}
+		}
+		filter := compileQuery(ast)
+		filter.PinnedFirst = true
+		return filterPosts(d, filter, pageSize, page)
+	}
+	if search == "" && lang != "" {
+		filter := compileQuery(&queryLang{lang})
+		filter.PinnedFirst = true
+		return filterPosts(d, filter, pageSize, page)
+	}
+
+	var hl *db.Highlight
+	if search != "" {
+		hl, err = parseHighlight(r)
+		if err != nil {
+			return nil, fmt.Errorf("parse highlight markers: %v", err)
+		}
+	}
+
 	var (
 		posts []db.Post
 		count int
@@ -62,7 +223,7 @@ func viewPosts(d db.DB, r *http.Request) (*db.PostsPage, error) {
 	if search == "" {
 		count, err = d.GetPostsCount()
 	} else {
-		count, err = d.GetPostsCountByFTS(search)
+		count, err = d.GetPostsCountByFTS(search, lang)
 	}
 	if err != nil {
 		return nil, fmt.Errorf("get count of posts: %v", err)
@@ -75,16 +236,76 @@ func viewPosts(d db.DB, r *http.Request) (*db.PostsPage, error) {
 	if search == "" {
 		posts, err = d.GetPosts(pageSize, page)
 	} else {
-		posts, err = d.GetPostsByFTS(search, pageSize, page)
+		posts, err = d.GetPostsByFTS(search, lang, hl, pageSize, page)
 	}
 	if err != nil {
 		return nil, fmt.Errorf("get posts: %v", err)
 	}
+	if search != "" {
+		for i := range posts {
+			posts[i].Snippet = escapeSnippet(posts[i].Snippet, hl)
+		}
+	}
 
 	return &db.PostsPage{Posts: posts, MaxPage: maxPage}, nil
 }
 
-func viewComments(d db.DB, r *http.Request) (*db.CommentsPage, error) {
+// queryPosts pages posts matching a structured search query, see parseQuery,
+// and written in lang if it is not empty
+func queryPosts(d db.DB, q, lang string, pageSize, page int) (*db.PostsPage, error) {
+	ast, err := parseQuery(q)
+	if err != nil {
+		return nil, fmt.Errorf("parse query: %v", err)
+	}
+	if lang != "" {
+		ast = &queryAnd{[]queryNode{ast, &queryLang{lang}}}
+	}
+	return filterPosts(d, compileQuery(ast), pageSize, page)
+}
+
+func filterPosts(d db.DB, filter *db.PostFilter, pageSize, page int) (*db.PostsPage, error) {
+	count, err := d.GetPostsCountByFilter(filter)
+	if err != nil {
+		return nil, fmt.Errorf("get count of posts: %v", err)
+	}
+	maxPage := int(math.Ceil(float64(count) / float64(pageSize)))
+	if page > maxPage && maxPage != 0 {
+		return nil, errors.New("page number bigger than maxPage")
+	}
+
+	posts, err := d.GetPostsByFilter(filter, pageSize, page)
+	if err != nil {
+		return nil, fmt.Errorf("get posts: %v", err)
+	}
+	return &db.PostsPage{Posts: posts, MaxPage: maxPage}, nil
+}
+
+// maxSuggestLen bounds length of partial search sent to /search/suggest
+const maxSuggestLen = 64
+
+func viewSuggestions(d db.DB, cache *ttlCache, limit int, r *http.Request) (*db.Suggestions, error) {
+	q := strings.ToLower(strings.TrimSpace(r.FormValue("q")))
+	if q == "" {
+		return &db.Suggestions{Completions: []string{}, Corrections: []string{}}, nil
+	}
+	if len(q) > maxSuggestLen {
+		return nil, fmt.Errorf("q cannot be longer than %d bytes", maxSuggestLen)
+	}
+
+	if sgs, ok := cache.get(q); ok {
+		return sgs.(*db.Suggestions), nil
+	}
+	sgs, err := d.GetSuggestions(q, limit)
+	if err != nil {
+		return nil, fmt.Errorf("get suggestions: %v", err)
+	}
+	cache.set(q, sgs)
+	return sgs, nil
+}
+
+// viewComments returns a page of approved comments of a post, moderators see emails
+// of commenters and spam scores, readers see names and avatars instead
+func viewComments(d db.DB, cfg *CommentConfig, r *http.Request) (interface{}, error) {
 	pidStr := r.FormValue("pid")
 	pid, err := strconv.Atoi(pidStr)
 	if err != nil {
@@ -112,9 +333,14 @@ func viewComments(d db.DB, r *http.Request) (*db.CommentsPage, error) {
 		return nil, errors.New("pageSize cannot be less than 1")
 	}
 
-	cnt, err := d.GetCommentsCount(pid)
+	view := r.FormValue("view")
+	if view != "" && view != "flat" && view != "tree" {
+		return nil, errors.New("view is neither flat nor tree")
+	}
+
+	cnt, err := d.GetThreadsCount(pid)
 	if err != nil {
-		return nil, fmt.Errorf("get counts of comments: %v", err)
+		return nil, fmt.Errorf("get counts of threads: %v", err)
 	}
 
 	maxPage := int(math.Ceil(float64(cnt) / float64(pageSize)))
@@ -126,48 +352,317 @@ func viewComments(d db.DB, r *http.Request) (*db.CommentsPage, error) {
 	if err != nil {
 		return nil, fmt.Errorf("get comments: %v", err)
 	}
-	return &db.CommentsPage{Comments: cmts, MaxPage: maxPage}, nil
+	if view == "tree" {
+		cmts = nestComments(cmts)
+	}
+	if _, err := requirePrivilege(r, db.PrivilegeModerator); err == nil {
+		return &db.CommentsPage{Comments: cmts, MaxPage: maxPage}, nil
+	}
+	return &db.PublicCommentsPage{Comments: publicComments(cmts, cfg), MaxPage: maxPage}, nil
+}
+
+// limits of recent comments listed at once
+const (
+	defaultRecentComments = 20
+	maxRecentComments     = 100
+)
 
+// encodeCommentCursor makes an opaque cursor of position of c in recent comments
+func encodeCommentCursor(c *db.Comment) string {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b[:8], uint64(time.Time(*c.CreatedAt).UnixNano()))
+	binary.BigEndian.PutUint64(b[8:], uint64(c.CommentID))
+	return base64.RawURLEncoding.EncodeToString(b)
 }
 
-func changeComment(d db.DB, action string, r *http.Request) (int, error) {
-	switch action {
-	case "insert":
-		var (
-			pid            int
-			content, email string
-		)
-		err := parseJSONReq(r, func(pJSON *gabs.Container) error {
-			var ok bool
-			pid, ok = pJSON.Path("pid").Data().(int)
+func decodeCommentCursor(cursor string) (*db.CommentCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(b) != 16 {
+		return nil, errors.New("cursor is malformed")
+	}
+	return &db.CommentCursor{CreatedAt: time.Unix(0, int64(binary.BigEndian.Uint64(b[:8]))),
+		CommentID: int(binary.BigEndian.Uint64(b[8:]))}, nil
+}
+
+// viewRecentComments returns newest approved comments of every post, a page at a time by
+// cursor, dates limit them to a range, moderators also filter them by status and see emails
+func viewRecentComments(d db.DB, cfg *CommentConfig, r *http.Request) (interface{}, error) {
+	_, err := requirePrivilege(r, db.PrivilegeModerator)
+	moderator := err == nil
+	f := &db.RecentCommentsFilter{Status: db.CommentApproved}
+	if status := r.FormValue("status"); status != "" {
+		if !moderator {
+			return nil, errors.New("status filter needs moderator privilege")
+		}
+		switch {
+		case status == "all":
+			f.Status = ""
+		case db.ValidCommentStatus(status):
+			f.Status = status
+		default:
+			return nil, errors.New("status is not one of all, pending, approved, rejected and spam")
+		}
+	}
+	if fromStr := r.FormValue("from"); fromStr != "" {
+		from, err := time.Parse("2006-01-02", fromStr)
+		if err != nil {
+			return nil, fmt.Errorf("parse from as date: %v", err)
+		}
+		f.From = &from
+	}
+	if toStr := r.FormValue("to"); toStr != "" {
+		to, err := time.Parse("2006-01-02", toStr)
+		if err != nil {
+			return nil, fmt.Errorf("parse to as date: %v", err)
+		}
+		// to is inclusive, comments of its whole day are listed
+		to = to.AddDate(0, 0, 1)
+		f.To = &to
+	}
+	if f.From != nil && f.To != nil && !f.From.Before(*f.To) {
+		return nil, errors.New("from cannot be after to")
+	}
+	if cursor := r.FormValue("cursor"); cursor != "" {
+		f.Cursor, err = decodeCommentCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+	}
+	limit := defaultRecentComments
+	if limitStr := r.FormValue("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil {
+			return nil, fmt.Errorf("convert limit to int: %v", err)
+		}
+		if limit <= 0 || limit > maxRecentComments {
+			return nil, fmt.Errorf("limit out of [1, %d]", maxRecentComments)
+		}
+	}
+
+	// one more comment than asked tells whether there is a next page
+	cmts, err := d.GetRecentComments(f, limit+1)
+	if err != nil {
+		return nil, fmt.Errorf("get recent comments: %v", err)
+	}
+	var next string
+	if len(cmts) > limit {
+		cmts = cmts[:limit]
+		next = encodeCommentCursor(&cmts[limit-1])
+	}
+	for i := range cmts {
+		cmts[i].PostSlug = slug(cmts[i].PostTitle)
+	}
+	if moderator {
+		return &db.RecentCommentsPage{Comments: cmts, NextCursor: next}, nil
+	}
+	return &db.PublicRecentCommentsPage{Comments: publicComments(cmts, cfg), NextCursor: next}, nil
+}
+
+// nestComments puts replies of comments listed parents first into Replies of their
+// parents, a reply whose parent is not listed stays at top level
+func nestComments(flat []db.Comment) []db.Comment {
+	var roots []int
+	listed := make(map[int]bool, len(flat))
+	replies := map[int][]int{}
+	for _, c := range flat {
+		listed[c.CommentID] = true
+	}
+	for i, c := range flat {
+		if c.ParentID != 0 && listed[c.ParentID] {
+			replies[c.ParentID] = append(replies[c.ParentID], i)
+			continue
+		}
+		roots = append(roots, i)
+	}
+	var nest func(is []int) []db.Comment
+	nest = func(is []int) []db.Comment {
+		cmts := make([]db.Comment, 0, len(is))
+		for _, i := range is {
+			c := flat[i]
+			c.Replies = nest(replies[c.CommentID])
+			cmts = append(cmts, c)
+		}
+		return cmts
+	}
+	return nest(roots)
+}
+
+// commentReceipt tells a commenter whether comment is shown or waits for moderation,
+// EditToken is only given once, to commenters without login, requested tells client
+// asked for receipt, others are given cid only as before receipts
+type commentReceipt struct {
+	CommentID int    `json:"cid"`
+	Status    string `json:"status"`
+	EditToken string `json:"editToken,omitempty"`
+	requested bool
+}
+
+// newEditToken returns a random edit token and its sha256 kept with comment
+func newEditToken() (string, []byte, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, fmt.Errorf("generate edit token: %v", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	sum := sha256.Sum256([]byte(token))
+	return token, sum[:], nil
+}
+
+// insertComment submits a comment of anyone, it is approved at once if commentStatus
+// trusts its author, otherwise it waits in moderation queue
+func insertComment(d db.DB, cfg *CommentConfig, ch *challenger, n *notifier, r *http.Request) (*commentReceipt, error) {
+	var (
+		pid, parent          int
+		content, email, name string
+		honeypot, token      string
+		challenge, nonce     string
+		notifyReplies        bool
+		requested            bool
+	)
+	err := parseJSONReq(r, func(pJSON *gabs.Container) error {
+		var ok bool
+		pid, ok = jsonInt(pJSON, "pid")
+		if !ok {
+			return errors.New("pid field in json is not int")
+		}
+		if pJSON.Exists("parentCommentId") && pJSON.Path("parentCommentId").Data() != nil {
+			parent, ok = jsonInt(pJSON, "parentCommentId")
 			if !ok {
-				return errors.New("pid field in json is not int")
+				return errors.New("parentCommentId field in json is not int")
 			}
-			content, ok = pJSON.Path("content").Data().(string)
+		}
+		content, ok = pJSON.Path("content").Data().(string)
+		if !ok {
+			return errors.New("content field in json is not string")
+		}
+		if err := db.ValidCommentContent(content); err != nil {
+			return err
+		}
+		// email was read before authorEmail was documented, it is still accepted
+		email, ok = pJSON.Path("authorEmail").Data().(string)
+		if !ok {
+			email, ok = pJSON.Path("email").Data().(string)
+		}
+		if !ok {
+			return errors.New("authorEmail field in json is not string")
+		}
+		if err := db.ValidEmail(email); err != nil {
+			return err
+		}
+		if pJSON.Exists("authorName") {
+			name, ok = pJSON.Path("authorName").Data().(string)
 			if !ok {
-				return errors.New("content field in json is not string")
+				return errors.New("authorName field in json is not string")
 			}
-			email, ok = pJSON.Path("email").Data().(string)
+			name = strings.TrimSpace(name)
+			if err := db.ValidAuthorName(name); err != nil {
+				return err
+			}
+		}
+		if pJSON.Exists("notifyReplies") {
+			notifyReplies, ok = pJSON.Path("notifyReplies").Data().(bool)
 			if !ok {
-				return errors.New("email field in json is not string")
+				return errors.New("notifyReplies field in json is not bool")
 			}
-			return nil
-		})
+		}
+		if pJSON.Exists("receipt") {
+			requested, ok = pJSON.Path("receipt").Data().(bool)
+			if !ok {
+				return errors.New("receipt field in json is not bool")
+			}
+		}
+		// website is a honeypot field hidden from people
+		honeypot, _ = pJSON.Path("website").Data().(string)
+		token, _ = pJSON.Path("formToken").Data().(string)
+		challenge, _ = pJSON.Path("challenge").Data().(string)
+		nonce, _ = pJSON.Path("nonce").Data().(string)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("parse json in request: %v", err)
+	}
+	usr, ok := r.Context().Value(db.BlogContext("user")).(*db.User)
+	if !ok {
+		return nil, errors.New("no user context: internal error")
+	}
+	if name == "" && usr != nil {
+		name = usr.UserName
+	}
+	policy, err := commentPolicy(d, cfg, pid)
+	if err != nil {
+		return nil, fmt.Errorf("get comment policy: %v", err)
+	}
+	if err := allowComment(policy, usr); err != nil {
+		return nil, err
+	}
+	if usr == nil {
+		if err := ch.verify(clientIP(r), challengeComment, challenge, nonce); err != nil {
+			return nil, fmt.Errorf("verify challenge: %v", err)
+		}
+	}
+	if parent != 0 {
+		pc, err := d.GetComment(parent)
 		if err != nil {
-			return -1, fmt.Errorf("parse json in request: %v", err)
+			return nil, fmt.Errorf("get parent comment: %v", err)
+		}
+		switch {
+		case pc.PostID != pid:
+			return nil, errors.New("parent comment is not a comment of post")
+		case pc.Deleted:
+			return nil, errors.New("parent comment is deleted")
+		case pc.Status != db.CommentApproved:
+			return nil, errors.New("parent comment is not approved")
+		case cfg.MaxDepth == 0:
+			return nil, errors.New("comments take no replies")
+		case pc.Depth >= cfg.MaxDepth:
+			return nil, fmt.Errorf("replies cannot be nested deeper than %d", cfg.MaxDepth)
 		}
-		cid, err := d.InsertComment(pid, content, email)
+	}
+	sub := &CommentSubmission{PostID: pid, Content: content, Email: email, IP: clientIP(r), Honeypot: honeypot, FormAge: -1}
+	if token != "" {
+		sub.FormAge = formAge(cfg.Spam.Secret, token, time.Now())
+	}
+	c := &db.Comment{PostID: pid, ParentID: parent, Content: content, Email: email, AuthorName: name, NotifyReplies: notifyReplies}
+	c.Status, c.SpamScores, err = commentStatus(d, cfg, r, sub)
+	if err != nil {
+		return nil, fmt.Errorf("moderate comment: %v", err)
+	}
+	// comments of logined users are theirs by uid, others by a token only their author is given
+	var editToken string
+	if usr != nil {
+		c.UID = usr.UID
+	} else {
+		editToken, c.EditToken, err = newEditToken()
 		if err != nil {
-			return -1, fmt.Errorf("insert comment: %v", err)
+			return nil, err
 		}
-		return cid, nil
+	}
+	cid, err := d.InsertComment(c)
+	if err != nil {
+		return nil, fmt.Errorf("insert comment: %v", err)
+	}
+	c.CommentID = cid
+	n.commentSubmitted(c)
+	if c.Status == db.CommentApproved {
+		n.commentApproved(c)
+	}
+	// spammers are not told they are caught
+	status := c.Status
+	if status == db.CommentSpam {
+		status = db.CommentPending
+	}
+	return &commentReceipt{CommentID: cid, Status: status, EditToken: editToken, requested: requested}, nil
+}
+
+func changeComment(d db.DB, action string, r *http.Request) (int, error) {
+	switch action {
 	case "delete":
 		var (
 			cid int
 		)
 		err := parseJSONReq(r, func(pJSON *gabs.Container) error {
 			var ok bool
-			cid, ok = pJSON.Path("commentID").Data().(int)
+			cid, ok = jsonInt(pJSON, "commentID")
 			if !ok {
 				return errors.New("commentID field in json is not string")
 			}
@@ -186,15 +681,20 @@ func changeComment(d db.DB, action string, r *http.Request) (int, error) {
 		return -1, nil
 	case "update":
 		var (
-			cid           int
+			cid, version  int
 			nContent, nAE string
 		)
 		err := parseJSONReq(r, func(pJSON *gabs.Container) error {
 			var ok bool
-			cid, ok = pJSON.Path("commentID").Data().(int)
+			cid, ok = jsonInt(pJSON, "commentID")
 			if !ok {
 				return errors.New("commentID field in json is not int")
 			}
+			var err error
+			version, err = expectedVersion(r, pJSON)
+			if err != nil {
+				return err
+			}
 			nContent, ok = pJSON.Path("newContent").Data().(string)
 			if !ok {
 				return errors.New("newContent field in json is not string")
@@ -208,7 +708,10 @@ func changeComment(d db.DB, action string, r *http.Request) (int, error) {
 		if err != nil {
 			return -1, fmt.Errorf("parse json in request: %v", err)
 		}
-		performed, err := d.UpdateComment(cid, nContent, nAE)
+		performed, err := d.UpdateComment(cid, version, nContent, nAE)
+		if vc, ok := err.(*db.VersionConflict); ok {
+			return -1, vc
+		}
 		if err != nil {
 			return -1, fmt.Errorf("update comment: %v", err)
 		}
@@ -216,18 +719,269 @@ func changeComment(d db.DB, action string, r *http.Request) (int, error) {
 			return -1, errors.New("no matched comment found")
 		}
 		return -1, nil
+	case "patch":
+		var (
+			cid, version int
+			patch        *db.CommentPatch
+		)
+		err := parseJSONReq(r, func(pJSON *gabs.Container) error {
+			var ok bool
+			cid, ok = jsonInt(pJSON, "commentID")
+			if !ok {
+				return errors.New("commentID field in json is not int")
+			}
+			var err error
+			version, err = expectedVersion(r, pJSON)
+			if err != nil {
+				return err
+			}
+			patch, err = parseCommentPatch(pJSON.Path("patch"))
+			return err
+		})
+		if err != nil {
+			return -1, fmt.Errorf("parse json in request: %v", err)
+		}
+		performed, err := d.PatchComment(cid, version, patch)
+		if vc, ok := err.(*db.VersionConflict); ok {
+			return -1, vc
+		}
+		if err != nil {
+			return -1, fmt.Errorf("patch comment: %v", err)
+		}
+		if !performed {
+			return -1, errors.New("no matched comment found")
+		}
+		return -1, nil
 	default:
 		return -1, errors.New("action is unknown")
 	}
 
 }
 
+// authorOfComment checks request is from author of c, by uid if author was logined,
+// otherwise by editToken given when c was submitted
+func authorOfComment(d db.DB, r *http.Request, c *db.Comment, editToken string) error {
+	usr, ok := r.Context().Value(db.BlogContext("user")).(*db.User)
+	if !ok {
+		return errors.New("no user context: internal error")
+	}
+	if c.UID != 0 {
+		if usr == nil || usr.UID != c.UID {
+			return errors.New("comment is not of logined user")
+		}
+		return nil
+	}
+	if editToken == "" {
+		return errors.New("editToken is required for comments submitted without login")
+	}
+	hash, err := d.GetCommentEditToken(c.CommentID)
+	if err != nil {
+		return fmt.Errorf("get edit token: %v", err)
+	}
+	sum := sha256.Sum256([]byte(editToken))
+	if hash == nil || subtle.ConstantTimeCompare(hash, sum[:]) != 1 {
+		return errors.New("editToken does not match comment")
+	}
+	return nil
+}
+
+// changeOwnComment lets authors edit their comments within cfg.EditWindow
+// and delete them at any time, an edit is moderated like a new comment
+func changeOwnComment(d db.DB, cfg *CommentConfig, action string, r *http.Request) (int, error) {
+	var (
+		cid, version       int
+		content, editToken string
+		honeypot, token    string
+	)
+	err := parseJSONReq(r, func(pJSON *gabs.Container) error {
+		var ok bool
+		cid, ok = jsonInt(pJSON, "commentID")
+		if !ok {
+			return errors.New("commentID field in json is not int")
+		}
+		if pJSON.Exists("editToken") {
+			editToken, ok = pJSON.Path("editToken").Data().(string)
+			if !ok {
+				return errors.New("editToken field in json is not string")
+			}
+		}
+		if action != "edit" {
+			return nil
+		}
+		var err error
+		version, err = expectedVersion(r, pJSON)
+		if err != nil {
+			return err
+		}
+		content, ok = pJSON.Path("content").Data().(string)
+		if !ok {
+			return errors.New("content field in json is not string")
+		}
+		honeypot, _ = pJSON.Path("website").Data().(string)
+		token, _ = pJSON.Path("formToken").Data().(string)
+		return db.ValidCommentContent(content)
+	})
+	if err != nil {
+		return -1, fmt.Errorf("parse json in request: %v", err)
+	}
+	c, err := d.GetComment(cid)
+	if err != nil {
+		return -1, fmt.Errorf("get comment: %v", err)
+	}
+	if c.Deleted {
+		return -1, errors.New("no matched comment found")
+	}
+	if err := authorOfComment(d, r, c, editToken); err != nil {
+		return -1, err
+	}
+	var performed bool
+	switch action {
+	case "edit":
+		since := time.Now().Add(-cfg.EditWindow)
+		if time.Time(*c.CreatedAt).Before(since) {
+			return -1, fmt.Errorf("comments can only be edited within %v of submitting them", cfg.EditWindow)
+		}
+		usr, ok := r.Context().Value(db.BlogContext("user")).(*db.User)
+		if !ok {
+			return -1, errors.New("no user context: internal error")
+		}
+		policy, err := commentPolicy(d, cfg, c.PostID)
+		if err != nil {
+			return -1, fmt.Errorf("get comment policy: %v", err)
+		}
+		if err := allowComment(policy, usr); err != nil {
+			return -1, err
+		}
+		// new content is scored and trusted as a new comment would be, so an approved
+		// comment cannot be turned into spam, rejected and spam comments stay so
+		sub := &CommentSubmission{PostID: c.PostID, Content: content, Email: c.Email, IP: clientIP(r), Honeypot: honeypot, FormAge: -1}
+		if token != "" {
+			sub.FormAge = formAge(cfg.Spam.Secret, token, time.Now())
+		}
+		status, scores, err := commentStatus(d, cfg, r, sub)
+		if err != nil {
+			return -1, fmt.Errorf("moderate comment: %v", err)
+		}
+		if c.Status == db.CommentRejected || c.Status == db.CommentSpam {
+			status = c.Status
+		}
+		performed, err = d.EditComment(cid, version, content, status, scores, since)
+		if vc, ok := err.(*db.VersionConflict); ok {
+			return -1, vc
+		}
+		if err != nil {
+			return -1, fmt.Errorf("edit comment: %v", err)
+		}
+	case "delete":
+		performed, err = d.DeleteComment(cid)
+		if err != nil {
+			return -1, fmt.Errorf("delete comment: %v", err)
+		}
+	default:
+		return -1, errors.New("action is unknown")
+	}
+	if !performed {
+		return -1, errors.New("no matched comment found")
+	}
+	return -1, nil
+}
+
+// patchMembers reads members of a JSON Merge Patch (RFC 7386), an empty patch is refused
+func patchMembers(patch *gabs.Container) (map[string]interface{}, error) {
+	members, ok := patch.Data().(map[string]interface{})
+	if !ok {
+		return nil, errors.New("patch field in json is not object")
+	}
+	if len(members) == 0 {
+		return nil, errors.New("patch changes nothing")
+	}
+	return members, nil
+}
+
+// patchString reads a string member of a patch and validates it,
+// null is refused since fields patched by it cannot be removed
+func patchString(name string, v interface{}, valid func(string) error) (*string, error) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s in patch is not string", name)
+	}
+	if err := valid(s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// parsePostPatch reads a merge patch of a post, tags are replaced as a whole
+// and removed by null, members left out are kept
+func parsePostPatch(patch *gabs.Container) (*db.PostPatch, error) {
+	members, err := patchMembers(patch)
+	if err != nil {
+		return nil, err
+	}
+	p := &db.PostPatch{}
+	for name, v := range members {
+		switch name {
+		case "title":
+			p.Title, err = patchString(name, v, db.ValidTitle)
+		case "content":
+			p.Content, err = patchString(name, v, db.ValidContent)
+		case "language":
+			p.Language, err = patchString(name, v, func(lang string) error {
+				if !validLanguage(lang) {
+					return errors.New("language in patch is not a two letter language code")
+				}
+				return nil
+			})
+		case "tags":
+			tags := []string{}
+			if v != nil {
+				var ok bool
+				tags, ok = jsonStrings(patch, "tags")
+				if !ok {
+					return nil, errors.New("tags in patch is not string array")
+				}
+			}
+			err = db.ValidTags(tags)
+			p.Tags = &tags
+		default:
+			err = fmt.Errorf("%s of post cannot be patched", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// parseCommentPatch reads a merge patch of a comment, members left out are kept
+func parseCommentPatch(patch *gabs.Container) (*db.CommentPatch, error) {
+	members, err := patchMembers(patch)
+	if err != nil {
+		return nil, err
+	}
+	p := &db.CommentPatch{}
+	for name, v := range members {
+		switch name {
+		case "content":
+			p.Content, err = patchString(name, v, db.ValidCommentContent)
+		case "email":
+			p.Email, err = patchString(name, v, db.ValidEmail)
+		default:
+			err = fmt.Errorf("%s of comment cannot be patched", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
 func changePost(d db.DB, action string, r *http.Request) (int, error) {
 	switch action {
 	case "insert":
 		var (
-			title, content string
-			tags           []string
+			title, content, lang string
+			tags                 []string
 		)
 		err := parseJSONReq(r, func(pJSON *gabs.Container) error {
 			var ok bool
@@ -239,19 +993,32 @@ func changePost(d db.DB, action string, r *http.Request) (int, error) {
 			if !ok {
 				return errors.New("content field in json is not string")
 			}
-			tags, ok = pJSON.Path("tags").Data().([]string)
+			tags, ok = jsonStrings(pJSON, "tags")
 			if !ok {
 				return errors.New("tags field in json is not string array")
 			}
+			lang = defaultLanguage
+			if pJSON.Exists("language") {
+				lang, ok = pJSON.Path("language").Data().(string)
+				if !ok || !validLanguage(lang) {
+					return errors.New("language field in json is not a two letter language code")
+				}
+			}
 			return nil
 		})
 		if err != nil {
 			return -1, fmt.Errorf("parse json in request: %v", err)
 		}
-		pid, err := d.InsertPost(title, content, tags)
+		usr, ok := r.Context().Value(db.BlogContext("user")).(*db.User)
+		if !ok || usr == nil {
+			return -1, errors.New("no user context: internal error")
+		}
+		pid, err := d.InsertPost(title, content, tags, lang, usr.UID)
 		if err != nil {
 			return -1, fmt.Errorf("insert post: %v", err)
 		}
+		// versions of posts start at 1
+		cacheTOC(d, pid, 1, content)
 		return pid, nil
 	case "delete":
 		var (
@@ -259,7 +1026,7 @@ func changePost(d db.DB, action string, r *http.Request) (int, error) {
 		)
 		err := parseJSONReq(r, func(pJSON *gabs.Container) error {
 			var ok bool
-			pid, ok = pJSON.Path("pid").Data().(int)
+			pid, ok = jsonInt(pJSON, "pid")
 			if !ok {
 				return errors.New("pid field in json is not int")
 			}
@@ -278,16 +1045,21 @@ func changePost(d db.DB, action string, r *http.Request) (int, error) {
 		return -1, nil
 	case "update":
 		var (
-			pid              int
-			nTitle, nContent string
-			nTags            []string
+			pid, version            int
+			nTitle, nContent, nLang string
+			nTags                   []string
 		)
 		err := parseJSONReq(r, func(pJSON *gabs.Container) error {
 			var ok bool
-			pid, ok = pJSON.Path("pid").Data().(int)
+			pid, ok = jsonInt(pJSON, "pid")
 			if !ok {
 				return errors.New("pid field in json is not int")
 			}
+			var err error
+			version, err = expectedVersion(r, pJSON)
+			if err != nil {
+				return err
+			}
 			nTitle, ok = pJSON.Path("newTitle").Data().(string)
 			if !ok {
 				return errors.New("newTitle field in json is not string")
@@ -296,22 +1068,221 @@ func changePost(d db.DB, action string, r *http.Request) (int, error) {
 			if !ok {
 				return errors.New("newContent field in json is not string")
 			}
-			nTags, ok = pJSON.Path("newTags").Data().([]string)
+			nTags, ok = jsonStrings(pJSON, "newTags")
 			if !ok {
 				return errors.New("newTags field in json is not string array")
 			}
+			if pJSON.Exists("newLanguage") {
+				nLang, ok = pJSON.Path("newLanguage").Data().(string)
+				if !ok || !validLanguage(nLang) {
+					return errors.New("newLanguage field in json is not a two letter language code")
+				}
+			}
 			return nil
 		})
 		if err != nil {
 			return -1, fmt.Errorf("parse json in request: %v", err)
 		}
-		performed, err := d.UpdatePost(pid, nTitle, nContent, nTags)
+		performed, err := d.UpdatePost(pid, version, nTitle, nContent, nTags, nLang)
+		if vc, ok := err.(*db.VersionConflict); ok {
+			return -1, vc
+		}
 		if err != nil {
 			return -1, fmt.Errorf("update post: %v", err)
 		}
 		if !performed {
 			return -1, fmt.Errorf("no matched post found in db")
 		}
+		cacheTOC(d, pid, version+1, nContent)
+		return -1, nil
+	case "patch":
+		var (
+			pid, version int
+			patch        *db.PostPatch
+		)
+		err := parseJSONReq(r, func(pJSON *gabs.Container) error {
+			var ok bool
+			pid, ok = jsonInt(pJSON, "pid")
+			if !ok {
+				return errors.New("pid field in json is not int")
+			}
+			var err error
+			version, err = expectedVersion(r, pJSON)
+			if err != nil {
+				return err
+			}
+			patch, err = parsePostPatch(pJSON.Path("patch"))
+			return err
+		})
+		if err != nil {
+			return -1, fmt.Errorf("parse json in request: %v", err)
+		}
+		performed, err := d.PatchPost(pid, version, patch)
+		if vc, ok := err.(*db.VersionConflict); ok {
+			return -1, vc
+		}
+		if err != nil {
+			return -1, fmt.Errorf("patch post: %v", err)
+		}
+		if !performed {
+			return -1, fmt.Errorf("no matched post found in db")
+		}
+		if patch.Content != nil {
+			cacheTOC(d, pid, version+1, *patch.Content)
+		}
+		return -1, nil
+	case "pin":
+		var (
+			pid    int
+			pinned bool
+			until  *time.Time
+		)
+		err := parseJSONReq(r, func(pJSON *gabs.Container) error {
+			var ok bool
+			pid, ok = jsonInt(pJSON, "pid")
+			if !ok {
+				return errors.New("pid field in json is not int")
+			}
+			pinned, ok = pJSON.Path("pinned").Data().(bool)
+			if !ok {
+				return errors.New("pinned field in json is not bool")
+			}
+			if pJSON.Exists("pinnedUntil") {
+				untilStr, ok := pJSON.Path("pinnedUntil").Data().(string)
+				if !ok {
+					return errors.New("pinnedUntil field in json is not string")
+				}
+				t, err := time.Parse(time.RFC3339, untilStr)
+				if err != nil {
+					return fmt.Errorf("parse pinnedUntil as RFC3339 time: %v", err)
+				}
+				until = &t
+			}
+			return nil
+		})
+		if err != nil {
+			return -1, fmt.Errorf("parse json in request: %v", err)
+		}
+		if until != nil && until.Before(time.Now()) {
+			return -1, errors.New("pinnedUntil cannot be in the past")
+		}
+		performed, err := d.SetPostPinned(pid, pinned, until)
+		if err != nil {
+			return -1, fmt.Errorf("pin post: %v", err)
+		}
+		if !performed {
+			return -1, errors.New("no matched post found in db")
+		}
+		return -1, nil
+	case "commentPolicy":
+		var (
+			pid    int
+			policy *db.CommentPolicy
+		)
+		err := parseJSONReq(r, func(pJSON *gabs.Container) error {
+			var ok bool
+			pid, ok = jsonInt(pJSON, "pid")
+			if !ok {
+				return errors.New("pid field in json is not int")
+			}
+			if !pJSON.Exists("policy") {
+				return errors.New("policy field in json is missing")
+			}
+			var err error
+			policy, err = parseCommentPolicy(pJSON.Path("policy"))
+			return err
+		})
+		if err != nil {
+			return -1, fmt.Errorf("parse json in request: %v", err)
+		}
+		performed, err := d.SetCommentPolicy(pid, policy)
+		if err != nil {
+			return -1, fmt.Errorf("set comment policy: %v", err)
+		}
+		if !performed {
+			return -1, errors.New("no matched post found in db")
+		}
+		return -1, nil
+	case "feature":
+		var (
+			pid      int
+			featured bool
+		)
+		err := parseJSONReq(r, func(pJSON *gabs.Container) error {
+			var ok bool
+			pid, ok = jsonInt(pJSON, "pid")
+			if !ok {
+				return errors.New("pid field in json is not int")
+			}
+			featured, ok = pJSON.Path("featured").Data().(bool)
+			if !ok {
+				return errors.New("featured field in json is not bool")
+			}
+			return nil
+		})
+		if err != nil {
+			return -1, fmt.Errorf("parse json in request: %v", err)
+		}
+		performed, err := d.SetPostFeatured(pid, featured)
+		if err != nil {
+			return -1, fmt.Errorf("feature post: %v", err)
+		}
+		if !performed {
+			return -1, errors.New("no matched post found in db")
+		}
+		return -1, nil
+	case "link":
+		var (
+			pid, groupPID int
+		)
+		err := parseJSONReq(r, func(pJSON *gabs.Container) error {
+			var ok bool
+			pid, ok = jsonInt(pJSON, "pid")
+			if !ok {
+				return errors.New("pid field in json is not int")
+			}
+			groupPID, ok = jsonInt(pJSON, "translationOf")
+			if !ok {
+				return errors.New("translationOf field in json is not int")
+			}
+			return nil
+		})
+		if err != nil {
+			return -1, fmt.Errorf("parse json in request: %v", err)
+		}
+		if pid == groupPID {
+			return -1, errors.New("post cannot be a translation of itself")
+		}
+		performed, err := d.LinkTranslation(pid, groupPID)
+		if err != nil {
+			return -1, fmt.Errorf("link translation: %v", err)
+		}
+		if !performed {
+			return -1, errors.New("no matched post found in db")
+		}
+		return -1, nil
+	case "unlink":
+		var (
+			pid int
+		)
+		err := parseJSONReq(r, func(pJSON *gabs.Container) error {
+			var ok bool
+			pid, ok = jsonInt(pJSON, "pid")
+			if !ok {
+				return errors.New("pid field in json is not int")
+			}
+			return nil
+		})
+		if err != nil {
+			return -1, fmt.Errorf("parse json in request: %v", err)
+		}
+		performed, err := d.UnlinkTranslation(pid)
+		if err != nil {
+			return -1, fmt.Errorf("unlink translation: %v", err)
+		}
+		if !performed {
+			return -1, errors.New("no matched post found in db")
+		}
 		return -1, nil
 	default:
 		return -1, errors.New("unknown action")
@@ -348,11 +1319,12 @@ func viewUser(d db.DB, r *http.Request) (*db.User, error) {
 	return usr, nil
 }
 
-func changeUser(d db.DB, action string, r *http.Request) (int, error) {
+func changeUser(d db.DB, ch *challenger, action string, r *http.Request) (int, error) {
 	switch action {
 	case "register":
 		var (
-			uN, pW string
+			uN, pW           string
+			challenge, nonce string
 		)
 		err := parseJSONReq(r, func(pJSON *gabs.Container) error {
 			var ok bool
@@ -366,12 +1338,17 @@ func changeUser(d db.DB, action string, r *http.Request) (int, error) {
 				return errors.New("cannot parse passWord field as string in json")
 			}
 
+			challenge, _ = pJSON.Path("challenge").Data().(string)
+			nonce, _ = pJSON.Path("nonce").Data().(string)
 			return nil
 		})
 
 		if err != nil {
 			return -1, fmt.Errorf("cannot parse json in request: %v", err)
 		}
+		if err := ch.verify(clientIP(r), challengeRegister, challenge, nonce); err != nil {
+			return -1, fmt.Errorf("cannot verify challenge: %v", err)
+		}
 
 		uid, err := d.InsertUser(uN, sha256.Sum256([]byte(pW)))
 		if err != nil {
@@ -385,7 +1362,7 @@ func changeUser(d db.DB, action string, r *http.Request) (int, error) {
 		)
 		err := parseJSONReq(r, func(pJSON *gabs.Container) error {
 			var ok bool
-			uid, ok = pJSON.Path("uid").Data().(int)
+			uid, ok = jsonInt(pJSON, "uid")
 			if !ok {
 				return errors.New("cannot parse uid field in json as int")
 			}
@@ -410,6 +1387,34 @@ func changeUser(d db.DB, action string, r *http.Request) (int, error) {
 			return -1, errors.New("no matched user found")
 		}
 		return -1, nil
+	case "setEmail":
+		usr, err := requirePrivilege(r, db.PrivilegeUser)
+		if err != nil {
+			return -1, err
+		}
+		var email string
+		err = parseJSONReq(r, func(pJSON *gabs.Container) error {
+			var ok bool
+			email, ok = pJSON.Path("email").Data().(string)
+			if !ok {
+				return errors.New("email field in json is not string")
+			}
+			if email == "" {
+				return nil
+			}
+			return db.ValidEmail(email)
+		})
+		if err != nil {
+			return -1, fmt.Errorf("parse json in request: %v", err)
+		}
+		performed, err := d.SetUserEmail(usr.UID, email)
+		if err != nil {
+			return -1, fmt.Errorf("set email of user: %v", err)
+		}
+		if !performed {
+			return -1, errors.New("no matched user found")
+		}
+		return -1, nil
 	default:
 		return -1, fmt.Errorf("cannot perform action %s on resource: unknown action", action)
 	}
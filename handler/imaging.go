@@ -0,0 +1,380 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+var (
+	pngSignature = []byte("\x89PNG\r\n\x1a\n")
+	exifHeader   = []byte("Exif\x00\x00")
+)
+
+// stripMetadata drops EXIF, XMP and text metadata from an image without
+// re-encoding it, images of other types are returned untouched
+func stripMetadata(mimeType string, data []byte) ([]byte, error) {
+	switch mimeType {
+	case "image/jpeg":
+		return stripJPEG(data)
+	case "image/png":
+		return stripPNG(data)
+	case "image/webp":
+		return stripWebP(data)
+	case "image/gif":
+		return stripGIF(data)
+	default:
+		return data, nil
+	}
+}
+
+// walkJPEG calls fn with marker and whole bytes of each segment before start of scan,
+// it returns offset of start of scan segment
+func walkJPEG(data []byte, fn func(marker byte, seg []byte)) (int, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 0, errors.New("not a jpeg")
+	}
+	i := 2
+	for {
+		if i+1 >= len(data) || data[i] != 0xFF {
+			return 0, errors.New("broken jpeg segment")
+		}
+		// markers may be preceded by fill bytes
+		for i+1 < len(data) && data[i+1] == 0xFF {
+			i++
+		}
+		if i+1 >= len(data) {
+			return 0, errors.New("broken jpeg segment")
+		}
+		marker := data[i+1]
+		if marker == 0xDA {
+			return i, nil
+		}
+		if marker == 0xD9 || (marker >= 0xD0 && marker <= 0xD7) || marker == 0x01 {
+			fn(marker, data[i:i+2])
+			i += 2
+			continue
+		}
+		if i+4 > len(data) {
+			return 0, errors.New("broken jpeg segment")
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+		if end > len(data) || end < i+4 {
+			return 0, errors.New("broken jpeg segment")
+		}
+		fn(marker, data[i:end])
+		i = end
+	}
+}
+
+// stripJPEG drops APP1 (EXIF, XMP), APP13 (IPTC) and comment segments
+func stripJPEG(data []byte) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+	sos, err := walkJPEG(data, func(marker byte, seg []byte) {
+		if marker == 0xE1 || marker == 0xED || marker == 0xFE {
+			return
+		}
+		out.Write(seg)
+	})
+	if err != nil {
+		return nil, err
+	}
+	out.Write(data[sos:])
+	return out.Bytes(), nil
+}
+
+// jpegOrientation reads orientation tag of EXIF, 1 means no transform is needed
+func jpegOrientation(data []byte) int {
+	orientation := 1
+	walkJPEG(data, func(marker byte, seg []byte) {
+		if marker == 0xE1 && len(seg) > 4 && bytes.HasPrefix(seg[4:], exifHeader) {
+			orientation = exifOrientation(seg[4+len(exifHeader):])
+		}
+	})
+	return orientation
+}
+
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var bo binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		bo = binary.LittleEndian
+	case "MM":
+		bo = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(bo.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	n := int(bo.Uint16(tiff[ifd:]))
+	for k := 0; k < n; k++ {
+		e := ifd + 2 + 12*k
+		if e+12 > len(tiff) {
+			break
+		}
+		if bo.Uint16(tiff[e:]) == 0x0112 {
+			if o := int(bo.Uint16(tiff[e+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			break
+		}
+	}
+	return 1
+}
+
+// stripPNG drops eXIf, text and time chunks
+func stripPNG(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, errors.New("not a png")
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(pngSignature)
+	for i := len(pngSignature); i < len(data); {
+		if i+8 > len(data) {
+			return nil, errors.New("broken png chunk")
+		}
+		end := i + 12 + int(binary.BigEndian.Uint32(data[i:]))
+		if end > len(data) || end < i+12 {
+			return nil, errors.New("broken png chunk")
+		}
+		switch string(data[i+4 : i+8]) {
+		case "eXIf", "tEXt", "zTXt", "iTXt", "tIME":
+		default:
+			out.Write(data[i:end])
+		}
+		i = end
+	}
+	return out.Bytes(), nil
+}
+
+// skipGIFBlocks returns offset past data sub-blocks starting at i, which end with an empty one
+func skipGIFBlocks(data []byte, i int) (int, error) {
+	for {
+		if i >= len(data) {
+			return 0, errors.New("broken gif block")
+		}
+		n := int(data[i])
+		i++
+		if n == 0 {
+			return i, nil
+		}
+		i += n
+	}
+}
+
+// stripGIF drops comment extensions and application extensions other than looping
+// of animations, which hold XMP among others, anything after trailer is dropped too
+func stripGIF(data []byte) ([]byte, error) {
+	if len(data) < 13 || (string(data[:6]) != "GIF87a" && string(data[:6]) != "GIF89a") {
+		return nil, errors.New("not a gif")
+	}
+	i := 13
+	if data[10]&0x80 != 0 {
+		i += 3 << (uint(data[10]&0x07) + 1)
+	}
+	if i > len(data) {
+		return nil, errors.New("broken gif color table")
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:i])
+	for {
+		if i >= len(data) {
+			return nil, errors.New("broken gif block")
+		}
+		switch data[i] {
+		case 0x3B:
+			out.WriteByte(0x3B)
+			return out.Bytes(), nil
+		case 0x2C:
+			if i+10 > len(data) {
+				return nil, errors.New("broken gif image")
+			}
+			end := i + 10
+			if data[i+9]&0x80 != 0 {
+				end += 3 << (uint(data[i+9]&0x07) + 1)
+			}
+			// lzw minimum code size comes before image data
+			end, err := skipGIFBlocks(data, end+1)
+			if err != nil {
+				return nil, err
+			}
+			out.Write(data[i:end])
+			i = end
+		case 0x21:
+			if i+2 > len(data) {
+				return nil, errors.New("broken gif extension")
+			}
+			end, err := skipGIFBlocks(data, i+2)
+			if err != nil {
+				return nil, err
+			}
+			label := data[i+1]
+			loop := label == 0xFF && i+14 <= end &&
+				(string(data[i+3:i+14]) == "NETSCAPE2.0" || string(data[i+3:i+14]) == "ANIMEXTS1.0")
+			if label != 0xFE && (label != 0xFF || loop) {
+				out.Write(data[i:end])
+			}
+			i = end
+		default:
+			return nil, errors.New("broken gif block")
+		}
+	}
+}
+
+// stripWebP drops EXIF and XMP chunks and clears their flags in VP8X chunk
+func stripWebP(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errors.New("not a webp")
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:12])
+	for i := 12; i < len(data); {
+		if i+8 > len(data) {
+			return nil, errors.New("broken webp chunk")
+		}
+		size := int(binary.LittleEndian.Uint32(data[i+4:]))
+		end := i + 8 + size + size%2
+		if end > len(data) || size < 0 {
+			return nil, errors.New("broken webp chunk")
+		}
+		switch string(data[i : i+4]) {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			start := out.Len()
+			out.Write(data[i:end])
+			if size > 0 {
+				out.Bytes()[start+8] &^= 0x08 | 0x04
+			}
+		default:
+			out.Write(data[i:end])
+		}
+		i = end
+	}
+	b := out.Bytes()
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(b)-8))
+	return b, nil
+}
+
+// checkPixels refuses an image in data declaring more than max pixels, so a small file
+// cannot make decoding take memory of a huge image, formats without decoder pass
+func checkPixels(data []byte, max int64) error {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > max {
+		return fmt.Errorf("image of %dx%d pixels has more than %d pixels", cfg.Width, cfg.Height, max)
+	}
+	return nil
+}
+
+// toNRGBA copies img into an NRGBA image placed at origin
+func toNRGBA(img image.Image) *image.NRGBA {
+	b := img.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+	return dst
+}
+
+// orient applies transform of an EXIF orientation to src
+func orient(src *image.NRGBA, orientation int) *image.NRGBA {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):dst.PixOffset(dx, dy)+4], src.Pix[src.PixOffset(x, y):src.PixOffset(x, y)+4])
+		}
+	}
+	return dst
+}
+
+// fitSize scales w x h down to fit in maxW x maxH keeping aspect ratio,
+// a zero bound is not applied, images are never scaled up
+func fitSize(w, h, maxW, maxH int) (int, int) {
+	scale := 1.0
+	if maxW > 0 && w > maxW {
+		scale = float64(maxW) / float64(w)
+	}
+	if maxH > 0 && float64(h)*scale > float64(maxH) {
+		scale = float64(maxH) / float64(h)
+	}
+	nw, nh := int(float64(w)*scale+0.5), int(float64(h)*scale+0.5)
+	if nw < 1 {
+		nw = 1
+	}
+	if nh < 1 {
+		nh = 1
+	}
+	return nw, nh
+}
+
+// resize scales src down to w x h, each pixel is average of source pixels it covers
+// weighted by their alpha
+func resize(src *image.NRGBA, w, h int) *image.NRGBA {
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		sy0, sy1 := y*sh/h, (y+1)*sh/h
+		if sy1 == sy0 {
+			sy1 = sy0 + 1
+		}
+		for x := 0; x < w; x++ {
+			sx0, sx1 := x*sw/w, (x+1)*sw/w
+			if sx1 == sx0 {
+				sx1 = sx0 + 1
+			}
+			var r, g, b, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				p := src.Pix[src.PixOffset(sx0, sy) : src.PixOffset(sx1-1, sy)+4]
+				for i := 0; i < len(p); i += 4 {
+					pa := uint64(p[i+3])
+					r += uint64(p[i]) * pa
+					g += uint64(p[i+1]) * pa
+					b += uint64(p[i+2]) * pa
+					a += pa
+					n++
+				}
+			}
+			c := color.NRGBA{}
+			if a > 0 {
+				c = color.NRGBA{uint8(r / a), uint8(g / a), uint8(b / a), uint8(a / n)}
+			}
+			dst.SetNRGBA(x, y, c)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,16 @@
+package mailer
+
+// Message is a plain text email, Headers are added to To, From, Subject and Date
+type Message struct {
+	From    string
+	To      string
+	Subject string
+	Body    string
+	Headers map[string]string
+}
+
+// Mailer lists essential methods to deliver emails of blog server,
+// a failed Send is retried later so it should not retry itself
+type Mailer interface {
+	Send(m *Message) error
+}
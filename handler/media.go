@@ -0,0 +1,342 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	// decoders of image formats whose dimensions are recorded
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"middleware/handler/db"
+	"middleware/handler/storage"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/Jeffail/gabs/v2"
+)
+
+// mediaExts maps common media types to extensions of stored files
+var mediaExts = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"application/pdf": ".pdf",
+}
+
+func mediaExt(mimeType string) string {
+	if ext, ok := mediaExts[mimeType]; ok {
+		return ext
+	}
+	exts, err := mime.ExtensionsByType(mimeType)
+	if err != nil || len(exts) == 0 {
+		return ""
+	}
+	return exts[0]
+}
+
+// mediaKey is content addressed, so a file uploaded twice is stored once
+func mediaKey(hash, mimeType string) string {
+	return hash[:2] + "/" + hash + mediaExt(mimeType)
+}
+
+func viewMedia(d db.DB, st storage.Storage, r *http.Request) (*db.Media, error) {
+	mid, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		return nil, fmt.Errorf("convert id to int: %v", err)
+	}
+	m, err := d.GetMedia(mid)
+	if err != nil {
+		return nil, fmt.Errorf("get media: %v", err)
+	}
+	fillMediaURLs(st, m)
+	return m, nil
+}
+
+func viewMediaOfPost(d db.DB, st storage.Storage, r *http.Request) ([]db.Media, error) {
+	pid, err := strconv.Atoi(r.FormValue("pid"))
+	if err != nil {
+		return nil, fmt.Errorf("convert pid to int: %v", err)
+	}
+	media, err := d.GetMediaOfPost(pid)
+	if err != nil {
+		return nil, fmt.Errorf("get media of post: %v", err)
+	}
+	for i := range media {
+		fillMediaURLs(st, &media[i])
+	}
+	return media, nil
+}
+
+func viewMediaPage(d db.DB, st storage.Storage, r *http.Request) (*db.MediaPage, error) {
+	page, err := strconv.Atoi(r.FormValue("page"))
+	if err != nil {
+		return nil, fmt.Errorf("convert page to int: %v", err)
+	}
+	if page <= 0 {
+		return nil, errors.New("page cannot be less than 1")
+	}
+	pageSize, err := strconv.Atoi(r.FormValue("pageSize"))
+	if err != nil {
+		return nil, fmt.Errorf("convert pageSize to int: %v", err)
+	}
+	if pageSize <= 0 {
+		return nil, errors.New("pageSize cannot be less than 1")
+	}
+
+	cnt, err := d.GetMediaCount()
+	if err != nil {
+		return nil, fmt.Errorf("get count of media: %v", err)
+	}
+	maxPage := int(math.Ceil(float64(cnt) / float64(pageSize)))
+	if page > maxPage && maxPage != 0 {
+		return nil, errors.New("page number bigger than max page")
+	}
+
+	media, err := d.GetMediaByPage(pageSize, page)
+	if err != nil {
+		return nil, fmt.Errorf("get media: %v", err)
+	}
+	for i := range media {
+		fillMediaURLs(st, &media[i])
+	}
+	return &db.MediaPage{Media: media, MaxPage: maxPage}, nil
+}
+
+// uploadMedia stores file field of a multipart request and records its metadata,
+// media is linked to post if pid field is given, metadata like EXIF is stripped
+// from images before they are stored and their derivatives are queued to ip
+func uploadMedia(d db.DB, mc *MediaConfig, ip *imageProcessor, usr *db.User, w http.ResponseWriter, r *http.Request) (*db.Media, error) {
+	// room is left for other fields and headers of multipart body
+	r.Body = http.MaxBytesReader(w, r.Body, mc.MaxSize+1<<16)
+	err := r.ParseMultipartForm(1 << 20)
+	if err != nil {
+		return nil, fmt.Errorf("parse multipart form: %v", err)
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	f, fh, err := r.FormFile("file")
+	if err != nil {
+		return nil, fmt.Errorf("get file field: %v", err)
+	}
+	defer f.Close()
+	if fh.Size > mc.MaxSize {
+		return nil, fmt.Errorf("file is larger than %d bytes", mc.MaxSize)
+	}
+
+	var pid int
+	if pidStr := r.FormValue("pid"); pidStr != "" {
+		pid, err = strconv.Atoi(pidStr)
+		if err != nil {
+			return nil, fmt.Errorf("convert pid to int: %v", err)
+		}
+		// post is checked before file is stored, so a wrong pid leaves no media behind
+		if _, err := d.GetPostByID(pid); err != nil {
+			return nil, fmt.Errorf("get post: %v", err)
+		}
+	}
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("read file: %v", err)
+	}
+	mimeType := http.DetectContentType(data)
+	if i := strings.IndexByte(mimeType, ';'); i >= 0 {
+		mimeType = mimeType[:i]
+	}
+	allowed := false
+	for _, t := range mc.Types {
+		allowed = allowed || t == mimeType
+	}
+	if !allowed {
+		return nil, fmt.Errorf("media type %s is not allowed", mimeType)
+	}
+
+	if strings.HasPrefix(mimeType, "image/") {
+		if err := checkPixels(data, mc.Images.MaxPixels); err != nil {
+			return nil, err
+		}
+	}
+	if mimeType == "image/jpeg" {
+		// orientation is lost with EXIF, so it is applied to pixels beforehand
+		if o := jpegOrientation(data); o != 1 {
+			img, err := jpeg.Decode(bytes.NewReader(data))
+			if err != nil {
+				return nil, fmt.Errorf("decode jpeg: %v", err)
+			}
+			buf := &bytes.Buffer{}
+			err = jpeg.Encode(buf, orient(toNRGBA(img), o), &jpeg.Options{Quality: mc.Images.Quality})
+			if err != nil {
+				return nil, fmt.Errorf("encode jpeg: %v", err)
+			}
+			data = buf.Bytes()
+		}
+	}
+	data, err = stripMetadata(mimeType, data)
+	if err != nil {
+		return nil, fmt.Errorf("strip metadata: %v", err)
+	}
+
+	hash := sha256.Sum256(data)
+	m := &db.Media{
+		UploaderID: usr.UID,
+		FileName:   path.Base(fh.Filename),
+		MIME:       mimeType,
+		Size:       int64(len(data)),
+		Hash:       hex.EncodeToString(hash[:]),
+	}
+	m.Key = mediaKey(m.Hash, mimeType)
+
+	if strings.HasPrefix(mimeType, "image/") {
+		// formats without registered decoder are kept without dimensions
+		if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+			m.Width, m.Height = cfg.Width, cfg.Height
+		}
+	}
+
+	err = mc.Storage.Put(m.Key, bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("store file: %v", err)
+	}
+
+	mid, err := d.InsertMedia(m)
+	if err != nil {
+		return nil, fmt.Errorf("insert media: %v", err)
+	}
+	if pid != 0 {
+		performed, err := d.LinkMedia(mid, pid)
+		if err != nil {
+			return nil, fmt.Errorf("link media: %v", err)
+		}
+		if !performed {
+			return nil, errors.New("no matched post found in db")
+		}
+	}
+
+	m, err = d.GetMedia(mid)
+	if err != nil {
+		return nil, fmt.Errorf("get media: %v", err)
+	}
+	// a file uploaded before already has its derivatives
+	if decodableImage(m.MIME) && len(m.Derivatives) == 0 && !ip.submit(m) {
+		log.Printf("image queue full or closed, media %d gets no derivatives\n", m.MediaID)
+	}
+	fillMediaURLs(mc.Storage, m)
+	return m, nil
+}
+
+func changeMedia(d db.DB, st storage.Storage, action string, r *http.Request) (int, error) {
+	switch action {
+	case "delete":
+		var (
+			mid int
+		)
+		err := parseJSONReq(r, func(pJSON *gabs.Container) error {
+			var ok bool
+			mid, ok = jsonInt(pJSON, "mid")
+			if !ok {
+				return errors.New("mid field in json is not int")
+			}
+			return nil
+		})
+		if err != nil {
+			return -1, fmt.Errorf("parse json in request: %v", err)
+		}
+		m, err := d.GetMedia(mid)
+		if err != nil {
+			return -1, fmt.Errorf("get media: %v", err)
+		}
+		performed, err := d.DeleteMedia(mid)
+		if err != nil {
+			return -1, fmt.Errorf("delete media: %v", err)
+		}
+		if !performed {
+			return -1, errors.New("no matched media found")
+		}
+		for _, dv := range m.Derivatives {
+			err = st.Delete(dv.Key)
+			if err != nil {
+				return -1, fmt.Errorf("delete file of %s: %v", dv.Name, err)
+			}
+		}
+		err = st.Delete(m.Key)
+		if err != nil {
+			return -1, fmt.Errorf("delete file: %v", err)
+		}
+		return -1, nil
+	case "link", "unlink":
+		var (
+			mid, pid int
+		)
+		err := parseJSONReq(r, func(pJSON *gabs.Container) error {
+			var ok bool
+			mid, ok = jsonInt(pJSON, "mid")
+			if !ok {
+				return errors.New("mid field in json is not int")
+			}
+			pid, ok = jsonInt(pJSON, "pid")
+			if !ok {
+				return errors.New("pid field in json is not int")
+			}
+			return nil
+		})
+		if err != nil {
+			return -1, fmt.Errorf("parse json in request: %v", err)
+		}
+		var performed bool
+		if action == "link" {
+			performed, err = d.LinkMedia(mid, pid)
+		} else {
+			performed, err = d.UnlinkMedia(mid, pid)
+		}
+		if err != nil {
+			return -1, fmt.Errorf("%s media: %v", action, err)
+		}
+		if !performed {
+			return -1, errors.New("no matched media or post found")
+		}
+		return -1, nil
+	default:
+		return -1, errors.New("unknown action")
+	}
+}
+
+// serveMediaFile streams file stored under key following prefix of request path
+func serveMediaFile(st storage.Storage, prefix string, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "request method is not GET", http.StatusMethodNotAllowed)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, prefix)
+	f, err := st.Get(key)
+	if err == storage.ErrNotExist {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, "open file", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	if t := mime.TypeByExtension(path.Ext(key)); t != "" {
+		w.Header().Set(`Content-Type`, t)
+	}
+	// keys are hashes of content, so files never change
+	w.Header().Set(`Cache-Control`, `public, max-age=31536000, immutable`)
+	if r.Method == http.MethodHead {
+		return
+	}
+	io.Copy(w, f)
+}
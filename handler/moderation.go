@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"middleware/handler/db"
+	"net/http"
+	"strconv"
+
+	"github.com/Jeffail/gabs/v2"
+)
+
+// maxModerated is max number of comments moderated by a request
+const maxModerated = 100
+
+// moderationActions maps actions of moderators to statuses they move comments into
+var moderationActions = map[string]string{
+	"approve": db.CommentApproved,
+	"reject":  db.CommentRejected,
+	"spam":    db.CommentSpam,
+}
+
+// commentStatus approves comments of moderators, other comments are checked by spam filters:
+// a comment scoring at least SpamScore is spam and one scoring at least HoldScore is pending,
+// others are approved if their logined author has at least TrustAfter approved comments and
+// none marked as spam, or pending otherwise, scores are nil for moderators, trust is never
+// given by email since anyone may write any email
+func commentStatus(d db.DB, cfg *CommentConfig, r *http.Request, s *CommentSubmission) (string, []db.SpamScore, error) {
+	usr, ok := r.Context().Value(db.BlogContext("user")).(*db.User)
+	if !ok {
+		return "", nil, errors.New("no user context: internal error")
+	}
+	if usr != nil && usr.Privilege <= db.PrivilegeModerator {
+		return db.CommentApproved, nil, nil
+	}
+	scores, total := checkSpam(d, cfg.Spam.Filters, s)
+	switch {
+	case total >= cfg.Spam.SpamScore:
+		return db.CommentSpam, scores, nil
+	case total >= cfg.Spam.HoldScore:
+		return db.CommentPending, scores, nil
+	}
+	if usr == nil {
+		return db.CommentPending, scores, nil
+	}
+	counts, err := d.GetCommenterStatusCounts(usr.UID)
+	if err != nil {
+		return "", nil, fmt.Errorf("get comments of commenter: %v", err)
+	}
+	if counts[db.CommentSpam] == 0 && counts[db.CommentApproved] >= cfg.TrustAfter {
+		return db.CommentApproved, scores, nil
+	}
+	return db.CommentPending, scores, nil
+}
+
+// viewModerationQueue returns a page of comments of every post in a status, pending by default
+func viewModerationQueue(d db.DB, r *http.Request) (*db.CommentsPage, error) {
+	status := r.FormValue("status")
+	if status == "" {
+		status = db.CommentPending
+	}
+	if !db.ValidCommentStatus(status) {
+		return nil, errors.New("status is not one of pending, approved, rejected and spam")
+	}
+	page, err := strconv.Atoi(r.FormValue("page"))
+	if err != nil {
+		return nil, fmt.Errorf("convert page to int: %v", err)
+	}
+	if page <= 0 {
+		return nil, errors.New("page cannot be less than 1")
+	}
+	pageSize, err := strconv.Atoi(r.FormValue("pageSize"))
+	if err != nil {
+		return nil, fmt.Errorf("convert pageSize to int: %v", err)
+	}
+	if pageSize <= 0 {
+		return nil, errors.New("pageSize cannot be less than 1")
+	}
+
+	cnt, err := d.GetCommentsCountByStatus(status)
+	if err != nil {
+		return nil, fmt.Errorf("get count of comments: %v", err)
+	}
+	maxPage := int(math.Ceil(float64(cnt) / float64(pageSize)))
+	if page > maxPage && maxPage != 0 {
+		return nil, errors.New("page number bigger than max page")
+	}
+
+	cmts, err := d.GetCommentsByStatus(status, pageSize, page)
+	if err != nil {
+		return nil, fmt.Errorf("get comments: %v", err)
+	}
+	return &db.CommentsPage{Comments: cmts, MaxPage: maxPage}, nil
+}
+
+// moderateComments moves comments listed in cids of request into status of action,
+// returns how many of them are found
+func moderateComments(d db.DB, n *notifier, action string, r *http.Request) (int, error) {
+	status, ok := moderationActions[action]
+	if !ok {
+		return -1, errors.New("unknown action")
+	}
+	var cids []int
+	err := parseJSONReq(r, func(pJSON *gabs.Container) error {
+		var ok bool
+		cids, ok = jsonInts(pJSON, "cids")
+		if !ok {
+			return errors.New("cids field in json is not array of int")
+		}
+		return nil
+	})
+	if err != nil {
+		return -1, fmt.Errorf("parse json in request: %v", err)
+	}
+	if len(cids) == 0 || len(cids) > maxModerated {
+		return -1, fmt.Errorf("cids must list 1 to %d comments", maxModerated)
+	}
+	// comments approved now, not those approved before, are notified
+	var approved []*db.Comment
+	if status == db.CommentApproved {
+		for _, cid := range cids {
+			c, err := d.GetComment(cid)
+			if err != nil {
+				// comments which are not found are left out of count below too
+				continue
+			}
+			if c.Status != db.CommentApproved && !c.Deleted {
+				approved = append(approved, c)
+			}
+		}
+	}
+	count, err := d.SetCommentsStatus(cids, status)
+	if err != nil {
+		return -1, fmt.Errorf("set status of comments: %v", err)
+	}
+	for _, c := range approved {
+		// spam is not asked to confirm its address when submitted, so it is asked now
+		c.Status = db.CommentApproved
+		n.commentSubmitted(c)
+		n.commentApproved(c)
+	}
+	// approved comments teach spam filter what ham looks like, rejected ones are left out
+	// since they may be off topic rather than spam
+	if status != db.CommentRejected {
+		if err := trainSpam(d, cids, status == db.CommentSpam); err != nil {
+			log.Printf("train spam filter: %v", err)
+		}
+	}
+	return count, nil
+}
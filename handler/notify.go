@@ -0,0 +1,318 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"middleware/handler/db"
+	"middleware/handler/mailer"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// emailMACSize is size of mac kept in tokens of email links
+const emailMACSize = 16
+
+// maxRetryDelay caps delay between deliveries of a failing email
+const maxRetryDelay = 24 * time.Hour
+
+// notifier queues emails about comments in outbox of db and delivers them in background,
+// emails which fail are kept and tried again
+type notifier struct {
+	d   db.DB
+	cfg *NotifyConfig
+
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+func newNotifier(d db.DB, cfg *NotifyConfig) *notifier {
+	n := &notifier{d: d, cfg: cfg, done: make(chan struct{}), stopped: make(chan struct{})}
+	if cfg.Mailer != nil {
+		go n.deliverer()
+	} else {
+		close(n.stopped)
+	}
+	return n
+}
+
+// deliverer delivers outbox on interval until notifier is closed
+func (n *notifier) deliverer() {
+	ticker := time.NewTicker(n.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n.deliver()
+		case <-n.done:
+			close(n.stopped)
+			return
+		}
+	}
+}
+
+// close stops deliverer, and waits for a delivery under way
+func (n *notifier) close() {
+	n.closeOnce.Do(func() {
+		close(n.done)
+	})
+	<-n.stopped
+}
+
+// confirmKey derives key signing confirmations from secret, so an unsubscribe
+// token, signed with secret itself, never confirms an address
+func confirmKey(secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("confirm replies"))
+	return mac.Sum(nil)
+}
+
+// signEmail makes a token of email signed with key
+func signEmail(key []byte, email string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(email))
+	return base64.RawURLEncoding.EncodeToString([]byte(email)) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:emailMACSize])
+}
+
+// verifyEmail returns email of token if it is signed with key
+func verifyEmail(key []byte, token string) (string, error) {
+	i := strings.IndexByte(token, '.')
+	if i < 0 {
+		return "", errors.New("token is malformed")
+	}
+	email, err := base64.RawURLEncoding.DecodeString(token[:i])
+	if err != nil {
+		return "", errors.New("token is malformed")
+	}
+	sum, err := base64.RawURLEncoding.DecodeString(token[i+1:])
+	if err != nil {
+		return "", errors.New("token is malformed")
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(email)
+	if !hmac.Equal(mac.Sum(nil)[:emailMACSize], sum) {
+		return "", errors.New("token is not issued by server")
+	}
+	return string(email), nil
+}
+
+// enqueue puts an email to address into outbox with a link unsubscribing it,
+// nothing is queued without mailer
+func (n *notifier) enqueue(to, subject, body string) error {
+	if n.cfg.Mailer == nil {
+		return nil
+	}
+	to = strings.ToLower(strings.TrimSpace(to))
+	link := n.cfg.BaseURL + "/unsubscribe?token=" + url.QueryEscape(signEmail(n.cfg.Secret, to))
+	m := &db.Mail{To: to, Subject: strings.Join(strings.Fields(subject), " "),
+		Body: body + "\n\n--\nStop these emails: " + link + "\n",
+		Headers: map[string]string{
+			// one-click unsubscribe of RFC 8058, mail clients POST to link
+			"List-Unsubscribe":      "<" + link + ">",
+			"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+		}}
+	if _, err := n.d.EnqueueMail(m); err != nil {
+		return fmt.Errorf("enqueue mail: %v", err)
+	}
+	return nil
+}
+
+// commentApproved tells author of post about approved comment c, and author of comment
+// c replies to if they opted in and confirmed their address, neither hears of their own
+// comments, failures are logged since comment is kept anyway
+func (n *notifier) commentApproved(c *db.Comment) {
+	if n.cfg.Mailer == nil {
+		return
+	}
+	if err := n.notifyComment(c); err != nil {
+		log.Printf("notify comment %d: %v", c.CommentID, err)
+	}
+}
+
+func (n *notifier) notifyComment(c *db.Comment) error {
+	post, err := n.d.GetPostByID(c.PostID)
+	if err != nil {
+		return fmt.Errorf("get post: %v", err)
+	}
+	name := c.AuthorName
+	if name == "" {
+		name = anonymousName
+	}
+	link := fmt.Sprintf(n.cfg.PostURL, c.PostID)
+
+	authorUID, authorEmail, err := n.d.GetPostAuthor(c.PostID)
+	if err != nil {
+		return fmt.Errorf("get author of post: %v", err)
+	}
+	ownPost := c.UID != 0 && c.UID == authorUID || strings.EqualFold(c.Email, authorEmail)
+	if authorEmail != "" && !ownPost {
+		err := n.enqueue(authorEmail, fmt.Sprintf("New comment on %q", post.Title),
+			fmt.Sprintf("%s commented on %q:\n\n%s\n\n%s", name, post.Title, c.Content, link))
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.ParentID == 0 {
+		return nil
+	}
+	parent, err := n.d.GetComment(c.ParentID)
+	if err != nil {
+		return fmt.Errorf("get parent comment: %v", err)
+	}
+	// author of post who opted in hears of reply once, by email above
+	if !parent.NotifyReplies || parent.Deleted || strings.EqualFold(parent.Email, c.Email) ||
+		authorEmail != "" && !ownPost && strings.EqualFold(parent.Email, authorEmail) {
+		return nil
+	}
+	// address of commenter is only trusted once they confirmed it
+	confirmed, err := n.d.IsEmailConfirmed(parent.Email)
+	if err != nil {
+		return fmt.Errorf("check email is confirmed: %v", err)
+	}
+	if !confirmed {
+		return nil
+	}
+	return n.enqueue(parent.Email, fmt.Sprintf("New reply to your comment on %q", post.Title),
+		fmt.Sprintf("%s replied to your comment on %q:\n\n> %s\n\n%s\n\n%s", name, post.Title,
+			strings.Replace(parent.Content, "\n", "\n> ", -1), c.Content, link))
+}
+
+// commentSubmitted asks author of comment c to confirm their address if they opted in
+// to replies, replies are only emailed to confirmed addresses, spam is not answered,
+// failures are logged since comment is kept anyway
+func (n *notifier) commentSubmitted(c *db.Comment) {
+	if n.cfg.Mailer == nil || !c.NotifyReplies || c.Status == db.CommentSpam {
+		return
+	}
+	if err := n.requestConfirmation(c.Email); err != nil {
+		log.Printf("request confirmation of comment %d: %v", c.CommentID, err)
+	}
+}
+
+// requestConfirmation emails a link confirming email unless it is confirmed, or was
+// asked to confirm within ConfirmResend, so an address is not flooded by comments naming it
+func (n *notifier) requestConfirmation(email string) error {
+	email = strings.ToLower(strings.TrimSpace(email))
+	requested, err := n.d.RequestEmailConfirmation(email, n.cfg.ConfirmResend)
+	if err != nil {
+		return fmt.Errorf("request email confirmation: %v", err)
+	}
+	if !requested {
+		return nil
+	}
+	link := n.cfg.BaseURL + "/confirmReplies?token=" + url.QueryEscape(signEmail(confirmKey(n.cfg.Secret), email))
+	return n.enqueue(email, "Confirm emails about replies to your comments",
+		fmt.Sprintf("A comment was written with this address, asking to be emailed about replies to it.\n\n"+
+			"Confirm it was you: %s\n\nNo replies are emailed until it is confirmed, ignore this email otherwise.", link))
+}
+
+// deliver sends emails due in outbox, a failed email is tried again after a delay
+// which doubles each time, until it failed MaxAttempts times
+func (n *notifier) deliver() {
+	// mails are claimed for Lease, so other instances sharing outbox skip them
+	mails, err := n.d.GetDueMails(n.cfg.Batch, n.cfg.Lease)
+	if err != nil {
+		log.Printf("get due mails: %v", err)
+		return
+	}
+	for _, m := range mails {
+		err := n.cfg.Mailer.Send(&mailer.Message{From: n.cfg.From, To: m.To, Subject: m.Subject, Body: m.Body, Headers: m.Headers})
+		if err == nil {
+			if err := n.d.MarkMailSent(m.MailID); err != nil {
+				log.Printf("mark mail %d sent: %v", m.MailID, err)
+			}
+			continue
+		}
+		var next *time.Time
+		if m.Attempts+1 < n.cfg.MaxAttempts {
+			delay := n.cfg.RetryDelay << uint(m.Attempts)
+			if delay <= 0 || delay > maxRetryDelay {
+				delay = maxRetryDelay
+			}
+			t := time.Now().Add(delay)
+			next = &t
+		} else {
+			log.Printf("give up mail %d to %s after %d attempts: %v", m.MailID, m.To, m.Attempts+1, err)
+		}
+		if err := n.d.MarkMailFailed(m.MailID, err.Error(), next); err != nil {
+			log.Printf("mark mail %d failed: %v", m.MailID, err)
+		}
+	}
+}
+
+// linkedEmail returns address of token in request, which is signed with secret of cfg,
+// or with key derived from it for confirmations
+func linkedEmail(cfg *NotifyConfig, confirm bool, r *http.Request) (string, error) {
+	if len(cfg.Secret) == 0 {
+		return "", errors.New("notifications are off")
+	}
+	key := cfg.Secret
+	if confirm {
+		key = confirmKey(cfg.Secret)
+	}
+	email, err := verifyEmail(key, r.FormValue("token"))
+	if err != nil {
+		return "", fmt.Errorf("verify token: %v", err)
+	}
+	return email, nil
+}
+
+// unsubscribe stops all emails to address of token in request
+func unsubscribe(d db.DB, cfg *NotifyConfig, r *http.Request) (string, error) {
+	email, err := linkedEmail(cfg, false, r)
+	if err != nil {
+		return "", err
+	}
+	if _, err := d.OptOutEmail(email); err != nil {
+		return "", fmt.Errorf("opt out: %v", err)
+	}
+	return email, nil
+}
+
+// confirmReplies confirms address of token in request, so replies are emailed to it
+func confirmReplies(d db.DB, cfg *NotifyConfig, r *http.Request) (string, error) {
+	email, err := linkedEmail(cfg, true, r)
+	if err != nil {
+		return "", err
+	}
+	if _, err := d.ConfirmEmail(email); err != nil {
+		return "", fmt.Errorf("confirm email: %v", err)
+	}
+	return email, nil
+}
+
+var emailPageTmpl = template.Must(template.New("emailPage").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta name="robots" content="noindex"><title>{{.Message}}</title></head>
+<body><p>{{.Message}}</p>
+{{- if .Action}}
+<form method="post">
+{{- if .OneClick}}<input type="hidden" name="List-Unsubscribe" value="One-Click">{{end -}}
+<button type="submit">{{.Action}}</button></form>
+{{- end}}
+</body></html>
+`))
+
+// emailPage answers links of emails, which are opened in browsers, a page with Action
+// asks to post its form back to same url, as link scanners of mail servers open links too
+type emailPage struct {
+	Message  string
+	Action   string
+	OneClick bool
+}
+
+func (p emailPage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(`Content-Type`, `text/html; charset=utf-8`)
+	w.Header().Set(`Cache-Control`, `no-store`)
+	if err := emailPageTmpl.Execute(w, p); err != nil {
+		log.Printf("write email page: %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"middleware/handler/db"
+	"time"
+
+	"github.com/Jeffail/gabs/v2"
+)
+
+// effectivePolicy is policy of post created on cDate, own unless it is nil, site default def
+// otherwise, as it applies at now
+func effectivePolicy(own, def *db.CommentPolicy, cDate, now time.Time) *db.PostCommentPolicy {
+	pp := &db.PostCommentPolicy{Default: own == nil}
+	if own != nil {
+		pp.CommentPolicy = *own
+	} else {
+		pp.CommentPolicy = *def
+	}
+	pp.Closed = pp.Mode == db.CommentsClosed
+	if pp.CloseAfterDays > 0 {
+		closesAt := db.Jstime(cDate.AddDate(0, 0, pp.CloseAfterDays))
+		pp.ClosesAt = &closesAt
+		pp.Closed = pp.Closed || !now.Before(time.Time(closesAt))
+	}
+	return pp
+}
+
+// commentPolicy returns policy comments of post of pid follow now
+func commentPolicy(d db.DB, cfg *CommentConfig, pid int) (*db.PostCommentPolicy, error) {
+	own, cDate, err := d.GetCommentPolicy(pid)
+	if err != nil {
+		return nil, err
+	}
+	return effectivePolicy(own, &cfg.Policy, cDate, time.Now()), nil
+}
+
+// allowComment checks policy lets usr comment, usr is nil without login
+func allowComment(pp *db.PostCommentPolicy, usr *db.User) error {
+	switch {
+	case pp.Mode == db.CommentsClosed:
+		return errors.New("comments on post are closed")
+	case pp.Closed:
+		return fmt.Errorf("comments on post are closed since %s", time.Time(*pp.ClosesAt).Format("2006-01-02"))
+	case pp.Mode == db.CommentsMembers && usr == nil:
+		return errors.New("comments on post are for logined users only")
+	}
+	return nil
+}
+
+// parseCommentPolicy reads a comment policy, null makes post follow site default
+func parseCommentPolicy(pJSON *gabs.Container) (*db.CommentPolicy, error) {
+	if pJSON.Data() == nil {
+		return nil, nil
+	}
+	p := &db.CommentPolicy{}
+	var ok bool
+	p.Mode, ok = pJSON.Path("mode").Data().(string)
+	if !ok {
+		return nil, errors.New("mode of policy is not string")
+	}
+	if pJSON.Exists("closeAfterDays") {
+		p.CloseAfterDays, ok = jsonInt(pJSON, "closeAfterDays")
+		if !ok {
+			return nil, errors.New("closeAfterDays of policy is not int")
+		}
+	}
+	if err := db.ValidCommentPolicy(p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
@@ -0,0 +1,373 @@
+package handler
+
+import (
+	"fmt"
+	"middleware/handler/db"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// limits keeping compiled queries small
+const (
+	maxQueryLen     = 256
+	maxQueryClauses = 16
+)
+
+// QuerySyntaxError reports the byte position where a search query cannot be parsed
+type QuerySyntaxError struct {
+	Pos int
+	Msg string
+}
+
+func (e *QuerySyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at position %d: %s", e.Pos, e.Msg)
+}
+
+// queryNode is a node in AST of a search query
+type queryNode interface {
+	compile(c *queryCompiler) string
+}
+
+// queryAnd matches posts matching all of its nodes
+type queryAnd struct {
+	nodes []queryNode
+}
+
+// queryOr matches posts matching any of its nodes
+type queryOr struct {
+	nodes []queryNode
+}
+
+// queryNot matches posts not matching its node
+type queryNot struct {
+	node queryNode
+}
+
+// queryText matches words or a quoted phrase against fullTextSearch
+type queryText struct {
+	text   string
+	phrase bool
+}
+
+// queryTag matches posts having tag
+type queryTag struct {
+	tag string
+}
+
+// queryDate matches posts created before or after date
+type queryDate struct {
+	before bool
+	date   time.Time
+}
+
+// queryTitle matches posts whose title contains text
+type queryTitle struct {
+	text string
+}
+
+// queryLang matches posts written in lang
+type queryLang struct {
+	lang string
+}
+
+// queryFeatured matches featured posts
+type queryFeatured struct{}
+
+// queryHas matches posts having comments or tags
+type queryHas struct {
+	what string
+}
+
+// queryCompiler collects positional arguments while compiling AST
+type queryCompiler struct {
+	args []interface{}
+}
+
+func (c *queryCompiler) arg(v interface{}) string {
+	c.args = append(c.args, v)
+	return "$" + strconv.Itoa(len(c.args))
+}
+
+func (n *queryAnd) compile(c *queryCompiler) string {
+	conds := make([]string, len(n.nodes))
+	for i, sub := range n.nodes {
+		conds[i] = sub.compile(c)
+	}
+	return "(" + strings.Join(conds, " AND ") + ")"
+}
+
+func (n *queryOr) compile(c *queryCompiler) string {
+	conds := make([]string, len(n.nodes))
+	for i, sub := range n.nodes {
+		conds[i] = sub.compile(c)
+	}
+	return "(" + strings.Join(conds, " OR ") + ")"
+}
+
+func (n *queryNot) compile(c *queryCompiler) string {
+	return "NOT " + n.node.compile(c)
+}
+
+// tsConfigOfPost selects text search configuration fullTextSearch of p is computed with
+const tsConfigOfPost = "(SELECT l.tsConfig FROM Languages l WHERE l.code = p.language)"
+
+func (n *queryText) compile(c *queryCompiler) string {
+	if n.phrase {
+		return "(p.fullTextSearch @@ phraseto_tsquery(" + tsConfigOfPost + ", " + c.arg(n.text) + "))"
+	}
+	return "(p.fullTextSearch @@ plainto_tsquery(" + tsConfigOfPost + ", " + c.arg(n.text) + "))"
+}
+
+func (n *queryTag) compile(c *queryCompiler) string {
+	return "EXISTS (SELECT 1 FROM Tags t WHERE t.postID = p.postID AND t.tag = " + c.arg(n.tag) + ")"
+}
+
+func (n *queryDate) compile(c *queryCompiler) string {
+	if n.before {
+		return "(p.cDate < " + c.arg(n.date) + ")"
+	}
+	return "(p.cDate > " + c.arg(n.date) + ")"
+}
+
+func (n *queryTitle) compile(c *queryCompiler) string {
+	pattern := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(n.text)
+	return "(p.title ILIKE " + c.arg("%"+pattern+"%") + ")"
+}
+
+func (n *queryLang) compile(c *queryCompiler) string {
+	return "(p.language = " + c.arg(n.lang) + ")"
+}
+
+func (n *queryFeatured) compile(c *queryCompiler) string {
+	return "p.featured"
+}
+
+func (n *queryHas) compile(c *queryCompiler) string {
+	if n.what == "comments" {
+		// counted like commentCount of posts, so pending, spam and deleted comments do not count
+		return "EXISTS (SELECT 1 FROM CommentCounts cc WHERE cc.postID = p.postID AND cc.count > 0)"
+	}
+	return "EXISTS (SELECT 1 FROM Tags t WHERE t.postID = p.postID)"
+}
+
+// compileQuery turns AST into a parameterized condition on Posts aliased as p
+func compileQuery(n queryNode) *db.PostFilter {
+	c := &queryCompiler{}
+	cond := n.compile(c)
+	return &db.PostFilter{Cond: cond, Args: c.args}
+}
+
+// query tokens
+const (
+	tokWord = iota
+	tokPhrase
+	tokMinus
+	tokColon
+	tokOr
+	tokEOF
+)
+
+type queryToken struct {
+	kind int
+	text string
+	pos  int
+	// glued is true when no space separates the token from the previous one
+	glued bool
+}
+
+func lexQuery(q string) ([]queryToken, error) {
+	var (
+		toks  []queryToken
+		glued bool
+	)
+	for i := 0; i < len(q); {
+		r, size := utf8.DecodeRuneInString(q[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			return nil, &QuerySyntaxError{i, "invalid utf-8"}
+		case unicode.IsSpace(r):
+			i += size
+			glued = false
+			continue
+		case r == '"':
+			end := strings.IndexByte(q[i+1:], '"')
+			if end < 0 {
+				return nil, &QuerySyntaxError{i, "unterminated quote"}
+			}
+			toks = append(toks, queryToken{tokPhrase, q[i+1 : i+1+end], i, glued})
+			i += end + 2
+		case r == '-' && !glued:
+			toks = append(toks, queryToken{tokMinus, "-", i, glued})
+			i += size
+		case r == ':':
+			toks = append(toks, queryToken{tokColon, ":", i, glued})
+			i += size
+		default:
+			start := i
+			for i < len(q) {
+				r, size := utf8.DecodeRuneInString(q[i:])
+				if unicode.IsSpace(r) || r == '"' || r == ':' {
+					break
+				}
+				i += size
+			}
+			kind := tokWord
+			if q[start:i] == "OR" {
+				kind = tokOr
+			}
+			toks = append(toks, queryToken{kind, q[start:i], start, glued})
+		}
+		glued = true
+	}
+	return append(toks, queryToken{tokEOF, "", len(q), false}), nil
+}
+
+type queryParser struct {
+	toks    []queryToken
+	cur     int
+	clauses int
+}
+
+func (p *queryParser) peek() queryToken {
+	return p.toks[p.cur]
+}
+
+func (p *queryParser) next() queryToken {
+	t := p.toks[p.cur]
+	if t.kind != tokEOF {
+		p.cur++
+	}
+	return t
+}
+
+// parseQuery parses a search query into AST, a query is a list of clauses
+// that all have to match, clauses can be joined by OR and negated by a
+// leading -, a clause is a word, a "quoted phrase" or one of qualifiers
+// tag:, before:, after:, title:, lang:, is: and has:
+func parseQuery(q string) (queryNode, error) {
+	if len(q) > maxQueryLen {
+		return nil, &QuerySyntaxError{maxQueryLen, fmt.Sprintf("query longer than %d bytes", maxQueryLen)}
+	}
+	toks, err := lexQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{toks: toks}
+	and := &queryAnd{}
+	for p.peek().kind != tokEOF {
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		and.nodes = append(and.nodes, n)
+	}
+	if len(and.nodes) == 0 {
+		return nil, &QuerySyntaxError{0, "empty query"}
+	}
+	if len(and.nodes) == 1 {
+		return and.nodes[0], nil
+	}
+	return and, nil
+}
+
+func (p *queryParser) parseOr() (queryNode, error) {
+	n, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokOr {
+		return n, nil
+	}
+	or := &queryOr{nodes: []queryNode{n}}
+	for p.peek().kind == tokOr {
+		p.next()
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		or.nodes = append(or.nodes, n)
+	}
+	return or, nil
+}
+
+func (p *queryParser) parseUnary() (queryNode, error) {
+	if p.peek().kind == tokMinus {
+		minus := p.next()
+		if p.peek().kind == tokEOF || !p.peek().glued {
+			return nil, &QuerySyntaxError{minus.pos, "- must be followed by a clause"}
+		}
+		n, err := p.parseClause()
+		if err != nil {
+			return nil, err
+		}
+		return &queryNot{n}, nil
+	}
+	return p.parseClause()
+}
+
+func (p *queryParser) parseClause() (queryNode, error) {
+	t := p.next()
+	p.clauses++
+	if p.clauses > maxQueryClauses {
+		return nil, &QuerySyntaxError{t.pos, fmt.Sprintf("query has more than %d clauses", maxQueryClauses)}
+	}
+	switch t.kind {
+	case tokPhrase:
+		if strings.TrimSpace(t.text) == "" {
+			return nil, &QuerySyntaxError{t.pos, "empty phrase"}
+		}
+		return &queryText{text: t.text, phrase: true}, nil
+	case tokWord:
+		if p.peek().kind == tokColon && p.peek().glued {
+			p.next()
+			return p.parseQualifier(t)
+		}
+		return &queryText{text: t.text}, nil
+	case tokEOF:
+		return nil, &QuerySyntaxError{t.pos, "unexpected end of query"}
+	default:
+		return nil, &QuerySyntaxError{t.pos, fmt.Sprintf("unexpected %q", t.text)}
+	}
+}
+
+func (p *queryParser) parseQualifier(name queryToken) (queryNode, error) {
+	v := p.next()
+	if (v.kind != tokWord && v.kind != tokPhrase) || !v.glued {
+		return nil, &QuerySyntaxError{v.pos, fmt.Sprintf("missing value of %s:", name.text)}
+	}
+	switch name.text {
+	case "tag":
+		return &queryTag{v.text}, nil
+	case "title":
+		if strings.TrimSpace(v.text) == "" {
+			return nil, &QuerySyntaxError{v.pos, "empty title"}
+		}
+		return &queryTitle{v.text}, nil
+	case "before", "after":
+		date, err := time.Parse("2006-01-02", v.text)
+		if err != nil {
+			return nil, &QuerySyntaxError{v.pos, fmt.Sprintf("%s: expects a date like 2006-01-02", name.text)}
+		}
+		return &queryDate{before: name.text == "before", date: date}, nil
+	case "lang":
+		if !validLanguage(v.text) {
+			return nil, &QuerySyntaxError{v.pos, "lang: expects a two letter language code"}
+		}
+		return &queryLang{v.text}, nil
+	case "is":
+		if v.text != "featured" {
+			return nil, &QuerySyntaxError{v.pos, "is: expects featured"}
+		}
+		return &queryFeatured{}, nil
+	case "has":
+		if v.text != "comments" && v.text != "tags" {
+			return nil, &QuerySyntaxError{v.pos, "has: expects comments or tags"}
+		}
+		return &queryHas{v.text}, nil
+	default:
+		return nil, &QuerySyntaxError{name.pos, fmt.Sprintf("unknown qualifier %s:", name.text)}
+	}
+}
@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"middleware/handler/db"
+	"net/http"
+	"strconv"
+
+	"github.com/Jeffail/gabs/v2"
+)
+
+// reactorOf identifies who reacts by uid of logined user or by session of anonymous reader,
+// a session is only taken once its cookie came back, otherwise each request without
+// cookie would react as a new reader
+func reactorOf(r *http.Request) (string, error) {
+	usr, ok := r.Context().Value(db.BlogContext("user")).(*db.User)
+	if !ok {
+		return "", errors.New("no user context: internal error")
+	}
+	if usr != nil {
+		return "u:" + strconv.Itoa(usr.UID), nil
+	}
+	uuid, ok := r.Context().Value(db.BlogContext("uuid")).(*UUID)
+	if !ok {
+		return "", errors.New("no uuid context: internal error")
+	}
+	if uuid.New {
+		return "", errors.New("session cookie is required to react")
+	}
+	return "s:" + uuid.Val, nil
+}
+
+// adoptReactions moves reactions of anonymous session of uuid to user of uid logining
+// in it, so nobody reacts once before login and again after, failures are logged since
+// login goes on anyway
+func adoptReactions(d db.DB, uuid *UUID, uid int) {
+	if uuid.New {
+		return
+	}
+	if _, err := d.MoveReactions("s:"+uuid.Val, "u:"+strconv.Itoa(uid)); err != nil {
+		log.Printf("move reactions of session to user %d: %v", uid, err)
+	}
+}
+
+// changeReaction adds or removes a reaction, then returns counts of reactions on the post
+func changeReaction(d db.DB, emojis []string, action string, r *http.Request) (map[string]int, error) {
+	var (
+		pid   int
+		emoji string
+	)
+	err := parseJSONReq(r, func(pJSON *gabs.Container) error {
+		var ok bool
+		pid, ok = jsonInt(pJSON, "pid")
+		if !ok {
+			return errors.New("pid field in json is not int")
+		}
+		emoji, ok = pJSON.Path("emoji").Data().(string)
+		if !ok {
+			return errors.New("emoji field in json is not string")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("parse json in request: %v", err)
+	}
+	known := false
+	for _, e := range emojis {
+		known = known || e == emoji
+	}
+	if !known {
+		return nil, errors.New("emoji is not one of reactions of blog")
+	}
+	reactor, err := reactorOf(r)
+	if err != nil {
+		return nil, err
+	}
+
+	switch action {
+	case "add":
+		_, err = d.AddReaction(pid, reactor, emoji)
+		if err != nil {
+			return nil, fmt.Errorf("add reaction: %v", err)
+		}
+	case "remove":
+		_, err = d.RemoveReaction(pid, reactor, emoji)
+		if err != nil {
+			return nil, fmt.Errorf("remove reaction: %v", err)
+		}
+	default:
+		return nil, errors.New("unknown action")
+	}
+
+	reactions, err := d.GetReactions(pid)
+	if err != nil {
+		return nil, fmt.Errorf("get reactions: %v", err)
+	}
+	return reactions, nil
+}
@@ -0,0 +1,129 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"middleware/handler/db"
+	"net/http"
+	"strconv"
+
+	"github.com/Jeffail/gabs/v2"
+)
+
+// viewSeries returns series of id with its posts, or every series without id
+func viewSeries(d db.DB, r *http.Request) (interface{}, error) {
+	if r.FormValue("id") == "" {
+		series, err := d.GetAllSeries()
+		if err != nil {
+			return nil, fmt.Errorf("get all series: %v", err)
+		}
+		return series, nil
+	}
+	sid, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		return nil, fmt.Errorf("convert id to int: %v", err)
+	}
+	s, err := d.GetSeries(sid)
+	if err != nil {
+		return nil, fmt.Errorf("get series: %v", err)
+	}
+	return s, nil
+}
+
+// parseSeriesFields reads title and description of a series
+func parseSeriesFields(pJSON *gabs.Container) (title, desc string, err error) {
+	var ok bool
+	title, ok = pJSON.Path("title").Data().(string)
+	if !ok {
+		return "", "", errors.New("title field in json is not string")
+	}
+	if err := db.ValidSeriesTitle(title); err != nil {
+		return "", "", err
+	}
+	if pJSON.Exists("description") {
+		desc, ok = pJSON.Path("description").Data().(string)
+		if !ok {
+			return "", "", errors.New("description field in json is not string")
+		}
+	}
+	if err := db.ValidSeriesDescription(desc); err != nil {
+		return "", "", err
+	}
+	return title, desc, nil
+}
+
+// changeSeries inserts, updates or deletes a series, or sets its posts in order
+func changeSeries(d db.DB, action string, r *http.Request) (int, error) {
+	var (
+		sid         int
+		title, desc string
+		pids        []int
+	)
+	err := parseJSONReq(r, func(pJSON *gabs.Container) error {
+		var (
+			ok  bool
+			err error
+		)
+		if action != "insert" {
+			sid, ok = jsonInt(pJSON, "sid")
+			if !ok {
+				return errors.New("sid field in json is not int")
+			}
+		}
+		switch action {
+		case "insert", "update":
+			title, desc, err = parseSeriesFields(pJSON)
+			return err
+		case "setParts":
+			pids, ok = jsonInts(pJSON, "pids")
+			if !ok {
+				return errors.New("pids field in json is not array of int")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return -1, fmt.Errorf("parse json in request: %v", err)
+	}
+
+	var performed bool
+	switch action {
+	case "insert":
+		sid, err = d.InsertSeries(title, desc)
+		if err != nil {
+			return -1, fmt.Errorf("insert series: %v", err)
+		}
+		return sid, nil
+	case "update":
+		performed, err = d.UpdateSeries(sid, title, desc)
+		if err != nil {
+			return -1, fmt.Errorf("update series: %v", err)
+		}
+	case "delete":
+		performed, err = d.DeleteSeries(sid)
+		if err != nil {
+			return -1, fmt.Errorf("delete series: %v", err)
+		}
+	case "setParts":
+		if len(pids) > db.MaxSeriesParts {
+			return -1, fmt.Errorf("a series cannot have more than %d parts", db.MaxSeriesParts)
+		}
+		seen := make(map[int]bool, len(pids))
+		for _, pid := range pids {
+			if seen[pid] {
+				return -1, fmt.Errorf("post %d is given twice", pid)
+			}
+			seen[pid] = true
+		}
+		performed, err = d.SetSeriesParts(sid, pids)
+		if err != nil {
+			return -1, fmt.Errorf("set parts of series: %v", err)
+		}
+	default:
+		return -1, errors.New("unknown action")
+	}
+	if !performed {
+		return -1, errors.New("no matched series found in db")
+	}
+	return -1, nil
+}
@@ -6,34 +6,52 @@ import (
 	"fmt"
 	"middleware/handler/db"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Jeffail/gabs/v2"
 	uuidLib "github.com/google/uuid"
 )
 
+// Handler serves blog api and runs its background work, which Close stops
+type Handler struct {
+	http.Handler
+	views         *viewCounter
+	notifications *notifier
+	images        *imageProcessor
+}
+
+// Close stops background work of h after flushing what it buffered, it is
+// called once server has shut down
+func (h *Handler) Close() {
+	h.views.close()
+	h.notifications.close()
+	h.images.close()
+}
+
 // New inits a http handler with functions of preprocessing, postprocessing and servemux
-func New(d db.DB) http.Handler {
+func New(d db.DB, c *Config) (*Handler, error) {
+	cfg, err := validConfig(c)
+	if err != nil {
+		return nil, fmt.Errorf("validate config: %v", err)
+	}
+
 	var ServeMux = http.NewServeMux()
 
+	views := newViewCounter(d, &cfg.Analytics)
+	notifications := newNotifier(d, &cfg.Notify)
 	ServeMux.Handle(`/post`, handlerWrapper(func(w http.ResponseWriter, r *http.Request) http.Handler {
 		switch r.Method {
 		case http.MethodGet:
-			post, err := viewPost(d, r)
+			post, err := viewPost(d, &cfg.Comments, r)
 			if err != nil {
 				return Err{fmt.Errorf("process request: %v", err)}
 			}
+			views.record(post.PostID, r)
+			w.Header().Set(`ETag`, etag(post.Version))
 			return JSONData{post}
 		case http.MethodPost:
-			usr, ok := r.Context().Value(db.BlogContext("user")).(*db.User)
-			if !ok {
-				return Err{errors.New("no user context: internal error")}
-			}
-			if usr == nil {
-				return Err{errors.New("user unlogined")}
-			}
-			if usr.Privilege != 0 {
-				return Err{errors.New("not enough privilege")}
-			}
 			var action string
 			err := parseJSONReq(r, func(pJSON *gabs.Container) error {
 				var ok bool
@@ -46,7 +64,18 @@ func New(d db.DB) http.Handler {
 			if err != nil {
 				return Err{fmt.Errorf("parse json request: %v", err)}
 			}
+			// editors curate posts, only admins write them
+			priv := db.PrivilegeAdmin
+			if action == "pin" || action == "feature" || action == "commentPolicy" {
+				priv = db.PrivilegeEditor
+			}
+			if _, err := requirePrivilege(r, priv); err != nil {
+				return Err{err}
+			}
 			pid, err := changePost(d, action, r)
+			if vc, ok := err.(*db.VersionConflict); ok {
+				return Conflict{vc}
+			}
 			if err != nil {
 				return Err{fmt.Errorf("change post : %v", err)}
 			}
@@ -56,6 +85,40 @@ func New(d db.DB) http.Handler {
 		}
 	}))
 
+	ServeMux.Handle(`/series`, handlerWrapper(func(w http.ResponseWriter, r *http.Request) http.Handler {
+		switch r.Method {
+		case http.MethodGet:
+			series, err := viewSeries(d, r)
+			if err != nil {
+				return Err{fmt.Errorf("process request: %v", err)}
+			}
+			return JSONData{series}
+		case http.MethodPost:
+			if _, err := requirePrivilege(r, db.PrivilegeEditor); err != nil {
+				return Err{err}
+			}
+			var action string
+			err := parseJSONReq(r, func(pJSON *gabs.Container) error {
+				var ok bool
+				action, ok = pJSON.Path("action").Data().(string)
+				if !ok {
+					return errors.New("action field in json is not string")
+				}
+				return nil
+			})
+			if err != nil {
+				return Err{fmt.Errorf("parse json in request: %v", err)}
+			}
+			sid, err := changeSeries(d, action, r)
+			if err != nil {
+				return Err{fmt.Errorf("change series: %v", err)}
+			}
+			return JSONData{sid}
+		default:
+			return Err{errors.New("request method is not POST/GET")}
+		}
+	}))
+
 	ServeMux.Handle(`/posts`, handlerWrapper(func(w http.ResponseWriter, r *http.Request) http.Handler {
 		switch r.Method {
 		case http.MethodGet:
@@ -68,10 +131,29 @@ func New(d db.DB) http.Handler {
 			return Err{errors.New("request method is not GET")}
 		}
 	}))
+	suggestLimiter := newRateLimiter(cfg.Suggest.Rate, cfg.Suggest.Burst)
+	suggestCache := newTTLCache(cfg.Suggest.CacheTTL, cfg.Suggest.CacheSize)
+	ServeMux.Handle(`/search/suggest`, handlerWrapper(func(w http.ResponseWriter, r *http.Request) http.Handler {
+		switch r.Method {
+		case http.MethodGet:
+			if !suggestLimiter.allow(clientIP(r)) {
+				return Err{errors.New("too many suggest requests")}
+			}
+			sgs, err := viewSuggestions(d, suggestCache, cfg.Suggest.Limit, r)
+			if err != nil {
+				return Err{fmt.Errorf("process request: %v", err)}
+			}
+			w.Header().Set(`Cache-Control`, `public, max-age=`+strconv.Itoa(int(cfg.Suggest.CacheTTL.Seconds())))
+			return JSONData{sgs}
+		default:
+			return Err{errors.New("request method is not GET")}
+		}
+	}))
+
 	ServeMux.Handle(`/comments`, handlerWrapper(func(w http.ResponseWriter, r *http.Request) http.Handler {
 		switch r.Method {
 		case http.MethodGet:
-			cmtsPage, err := viewComments(d, r)
+			cmtsPage, err := viewComments(d, &cfg.Comments, r)
 			if err != nil {
 				return Err{fmt.Errorf("process request: %v", err)}
 			}
@@ -81,19 +163,141 @@ func New(d db.DB) http.Handler {
 		}
 	}))
 
-	ServeMux.Handle(`/comment`, handlerWrapper(func(w http.ResponseWriter, r *http.Request) http.Handler {
+	ServeMux.Handle(`/unsubscribe`, handlerWrapper(func(w http.ResponseWriter, r *http.Request) http.Handler {
 		switch r.Method {
+		// link scanners of mail servers GET links too, so GET only asks, and address is
+		// unsubscribed by POST of that page or of mail clients in one click
+		case http.MethodGet:
+			email, err := linkedEmail(&cfg.Notify, false, r)
+			if err != nil {
+				return Err{fmt.Errorf("process request: %v", err)}
+			}
+			return emailPage{Message: fmt.Sprintf("Stop all emails to %s?", email), Action: "Unsubscribe", OneClick: true}
 		case http.MethodPost:
-			usr, ok := r.Context().Value(db.BlogContext("user")).(*db.User)
-			if !ok {
-				return Err{errors.New("no user context: internal error")}
+			email, err := unsubscribe(d, &cfg.Notify, r)
+			if err != nil {
+				return Err{fmt.Errorf("process request: %v", err)}
 			}
-			if usr == nil {
-				return Err{errors.New("user unlogined")}
+			return emailPage{Message: fmt.Sprintf("%s gets no more emails.", email)}
+		default:
+			return Err{errors.New("request method is not GET/POST")}
+		}
+	}))
+
+	ServeMux.Handle(`/confirmReplies`, handlerWrapper(func(w http.ResponseWriter, r *http.Request) http.Handler {
+		switch r.Method {
+		// confirmed like unsubscribed, by POST of page GET shows
+		case http.MethodGet:
+			email, err := linkedEmail(&cfg.Notify, true, r)
+			if err != nil {
+				return Err{fmt.Errorf("process request: %v", err)}
+			}
+			return emailPage{Message: fmt.Sprintf("Email replies to comments of %s?", email), Action: "Confirm"}
+		case http.MethodPost:
+			email, err := confirmReplies(d, &cfg.Notify, r)
+			if err != nil {
+				return Err{fmt.Errorf("process request: %v", err)}
+			}
+			return emailPage{Message: fmt.Sprintf("Replies to comments of %s are emailed to it.", email)}
+		default:
+			return Err{errors.New("request method is not GET/POST")}
+		}
+	}))
+
+	ServeMux.Handle(`/comments/recent`, handlerWrapper(func(w http.ResponseWriter, r *http.Request) http.Handler {
+		switch r.Method {
+		case http.MethodGet:
+			cmtsPage, err := viewRecentComments(d, &cfg.Comments, r)
+			if err != nil {
+				return Err{fmt.Errorf("process request: %v", err)}
+			}
+			return JSONData{cmtsPage}
+		default:
+			return Err{errors.New("request method is not GET")}
+		}
+	}))
+
+	ServeMux.Handle(`/avatar/`, handlerWrapper(func(w http.ResponseWriter, r *http.Request) http.Handler {
+		switch r.Method {
+		case http.MethodGet:
+			img, err := viewIdenticon(r)
+			if err != nil {
+				return Err{fmt.Errorf("process request: %v", err)}
+			}
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// identicon of a hash never changes
+				w.Header().Set(`Cache-Control`, `public, max-age=31536000, immutable`)
+				w.Header().Set(`Content-Type`, `image/png`)
+				w.Write(img)
+			})
+		default:
+			return Err{errors.New("request method is not GET")}
+		}
+	}))
+
+	ServeMux.Handle(`/comments/queue`, handlerWrapper(func(w http.ResponseWriter, r *http.Request) http.Handler {
+		if _, err := requirePrivilege(r, db.PrivilegeModerator); err != nil {
+			return Err{err}
+		}
+		switch r.Method {
+		case http.MethodGet:
+			cmtsPage, err := viewModerationQueue(d, r)
+			if err != nil {
+				return Err{fmt.Errorf("process request: %v", err)}
 			}
-			if usr.Privilege != 0 {
-				return Err{errors.New("not enough privilege")}
+			return JSONData{cmtsPage}
+		case http.MethodPost:
+			var action string
+			err := parseJSONReq(r, func(pJSON *gabs.Container) error {
+				var ok bool
+				action, ok = pJSON.Path("action").Data().(string)
+				if !ok {
+					return errors.New("action field in json is not string")
+				}
+				return nil
+			})
+			if err != nil {
+				return Err{fmt.Errorf("parse json in request: %v", err)}
+			}
+			n, err := moderateComments(d, notifications, action, r)
+			if err != nil {
+				return Err{fmt.Errorf("moderate comments: %v", err)}
 			}
+			return JSONData{n}
+		default:
+			return Err{errors.New("request method is not POST/GET")}
+		}
+	}))
+
+	challenges := newChallenger(&cfg.Challenge)
+	ServeMux.Handle(`/challenge`, handlerWrapper(func(w http.ResponseWriter, r *http.Request) http.Handler {
+		switch r.Method {
+		case http.MethodGet:
+			c, err := viewChallenge(challenges, r)
+			if err != nil {
+				return Err{fmt.Errorf("process request: %v", err)}
+			}
+			w.Header().Set(`Cache-Control`, `no-store`)
+			return JSONData{c}
+		default:
+			return Err{errors.New("request method is not GET")}
+		}
+	}))
+
+	ServeMux.Handle(`/comment/form`, handlerWrapper(func(w http.ResponseWriter, r *http.Request) http.Handler {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set(`Cache-Control`, `no-store`)
+			return JSONData{map[string]string{"formToken": signFormToken(cfg.Comments.Spam.Secret, time.Now())}}
+		default:
+			return Err{errors.New("request method is not GET")}
+		}
+	}))
+
+	commentLimiter := newRateLimiter(cfg.Comments.Rate, cfg.Comments.Burst)
+	ServeMux.Handle(`/comment`, handlerWrapper(func(w http.ResponseWriter, r *http.Request) http.Handler {
+		switch r.Method {
+		case http.MethodPost:
 			var (
 				action string
 			)
@@ -108,7 +312,39 @@ func New(d db.DB) http.Handler {
 			if err != nil {
 				return Err{fmt.Errorf("parse json in request: %v", err)}
 			}
+			// anyone may comment, authors edit and delete their comments, admins change any comment
+			if action == "insert" {
+				if !commentLimiter.allow(clientIP(r)) {
+					return Err{errors.New("too many comment requests")}
+				}
+				receipt, err := insertComment(d, &cfg.Comments, challenges, notifications, r)
+				if err != nil {
+					return Err{fmt.Errorf("submit comment: %v", err)}
+				}
+				if !receipt.requested {
+					return JSONData{receipt.CommentID}
+				}
+				return JSONData{receipt}
+			}
+			// authors edit their own comments only, and delete them unless they are admins
+			_, err = requirePrivilege(r, db.PrivilegeAdmin)
+			if action == "edit" || (action == "delete" && err != nil) {
+				cid, err := changeOwnComment(d, &cfg.Comments, action, r)
+				if vc, ok := err.(*db.VersionConflict); ok {
+					return Conflict{vc}
+				}
+				if err != nil {
+					return Err{fmt.Errorf("change own comment: %v", err)}
+				}
+				return JSONData{cid}
+			}
+			if err != nil {
+				return Err{err}
+			}
 			cid, err := changeComment(d, action, r)
+			if vc, ok := err.(*db.VersionConflict); ok {
+				return Conflict{vc}
+			}
 			if err != nil {
 				return Err{fmt.Errorf("change comment: %v", err)}
 			}
@@ -148,6 +384,7 @@ func New(d db.DB) http.Handler {
 					return Err{errors.New("no uuid context: internal error")}
 				}
 
+				adoptReactions(d, uuid, usr.UID)
 				// uuidVal := uuid.Val
 				if !uuid.New {
 					nUUID := newUUID()
@@ -161,7 +398,7 @@ func New(d db.DB) http.Handler {
 				return JSONData{usr}
 
 			default:
-				uid, err := changeUser(d, action, r)
+				uid, err := changeUser(d, challenges, action, r)
 
 				if err != nil {
 					return Err{fmt.Errorf("change user info: %v", err)}
@@ -173,6 +410,134 @@ func New(d db.DB) http.Handler {
 		}
 	}))
 
+	imgProcessor := newImageProcessor(d, cfg.Media.Storage, &cfg.Media.Images)
+	ServeMux.Handle(`/media`, handlerWrapper(func(w http.ResponseWriter, r *http.Request) http.Handler {
+		switch r.Method {
+		case http.MethodGet:
+			switch {
+			case r.FormValue("id") != "":
+				m, err := viewMedia(d, cfg.Media.Storage, r)
+				if err != nil {
+					return Err{fmt.Errorf("process request: %v", err)}
+				}
+				return JSONData{m}
+			case r.FormValue("pid") != "":
+				media, err := viewMediaOfPost(d, cfg.Media.Storage, r)
+				if err != nil {
+					return Err{fmt.Errorf("process request: %v", err)}
+				}
+				return JSONData{media}
+			default:
+				if _, err := requirePrivilege(r, db.PrivilegeEditor); err != nil {
+					return Err{err}
+				}
+				mediaPage, err := viewMediaPage(d, cfg.Media.Storage, r)
+				if err != nil {
+					return Err{fmt.Errorf("process request: %v", err)}
+				}
+				return JSONData{mediaPage}
+			}
+		case http.MethodPost:
+			usr, err := requirePrivilege(r, db.PrivilegeEditor)
+			if err != nil {
+				return Err{err}
+			}
+			if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+				m, err := uploadMedia(d, &cfg.Media, imgProcessor, usr, w, r)
+				if err != nil {
+					return Err{fmt.Errorf("upload media: %v", err)}
+				}
+				return JSONData{m}
+			}
+			var action string
+			err = parseJSONReq(r, func(pJSON *gabs.Container) error {
+				var ok bool
+				action, ok = pJSON.Path("action").Data().(string)
+				if !ok {
+					return errors.New("action field in json is not string")
+				}
+				return nil
+			})
+			if err != nil {
+				return Err{fmt.Errorf("parse json in request: %v", err)}
+			}
+			mid, err := changeMedia(d, cfg.Media.Storage, action, r)
+			if err != nil {
+				return Err{fmt.Errorf("change media: %v", err)}
+			}
+			return JSONData{mid}
+		default:
+			return Err{errors.New("request method is not POST/GET")}
+		}
+	}))
+
+	ServeMux.HandleFunc(`/media/files/`, func(w http.ResponseWriter, r *http.Request) {
+		serveMediaFile(cfg.Media.Storage, `/media/files/`, w, r)
+	})
+
+	reactionLimiter := newRateLimiter(cfg.Reactions.Rate, cfg.Reactions.Burst)
+	ServeMux.Handle(`/reaction`, handlerWrapper(func(w http.ResponseWriter, r *http.Request) http.Handler {
+		switch r.Method {
+		case http.MethodPost:
+			if !reactionLimiter.allow(clientIP(r)) {
+				return Err{errors.New("too many reaction requests")}
+			}
+			var action string
+			err := parseJSONReq(r, func(pJSON *gabs.Container) error {
+				var ok bool
+				action, ok = pJSON.Path("action").Data().(string)
+				if !ok {
+					return errors.New("action field in json is not string")
+				}
+				return nil
+			})
+			if err != nil {
+				return Err{fmt.Errorf("parse json in request: %v", err)}
+			}
+			reactions, err := changeReaction(d, cfg.Reactions.Emojis, action, r)
+			if err != nil {
+				return Err{fmt.Errorf("change reaction: %v", err)}
+			}
+			return JSONData{reactions}
+		default:
+			return Err{errors.New("request method is not POST")}
+		}
+	}))
+
+	ServeMux.Handle(`/analytics`, handlerWrapper(func(w http.ResponseWriter, r *http.Request) http.Handler {
+		switch r.Method {
+		case http.MethodGet:
+			if _, err := requirePrivilege(r, db.PrivilegeAdmin); err != nil {
+				return Err{err}
+			}
+			an, err := viewAnalytics(d, r)
+			if err != nil {
+				return Err{fmt.Errorf("process request: %v", err)}
+			}
+			return JSONData{an}
+		default:
+			return Err{errors.New("request method is not GET")}
+		}
+	}))
+
+	ServeMux.Handle(`/archive`, handlerWrapper(func(w http.ResponseWriter, r *http.Request) http.Handler {
+		if _, err := requirePrivilege(r, db.PrivilegeAdmin); err != nil {
+			return Err{err}
+		}
+		switch r.Method {
+		case http.MethodGet:
+			return archiveExport{d}
+		case http.MethodPost:
+			rp, err := importArchive(d, &cfg.Archive, w, r)
+			if err != nil {
+				return Err{fmt.Errorf("process request: %v", err)}
+			}
+			return JSONData{rp}
+		default:
+			return Err{errors.New("request method is not POST/GET")}
+		}
+	}))
+
 	ServeMux.HandleFunc(`/ping`, func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("pong"))
 		user, ok := r.Context().Value(db.BlogContext("user")).(*db.User)
@@ -182,7 +547,7 @@ func New(d db.DB) http.Handler {
 		return
 	})
 
-	return postProcess(preProcess(ServeMux))
+	return &Handler{Handler: postProcess(preProcess(limitJSON(cfg.MaxJSONSize, ServeMux))), views: views, notifications: notifications, images: imgProcessor}, nil
 }
 
 func preProcess(h http.Handler) http.Handler {
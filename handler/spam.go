@@ -0,0 +1,224 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"middleware/handler/db"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// CommentSubmission is a comment submitted by a reader, as spam filters see it
+type CommentSubmission struct {
+	PostID  int
+	Content string
+	Email   string
+	IP      string
+	// Honeypot is value of a form field hidden from people, bots fill it
+	Honeypot string
+	// FormAge is how long ago comment form was loaded by its form token, negative if token is missing or invalid
+	FormAge time.Duration
+}
+
+// SpamFilter is a check of submitted comments, scores of checks are added up and
+// compared with thresholds of SpamConfig
+type SpamFilter interface {
+	// Name identifies check in scores stored with comments
+	Name() string
+	// Check scores s in [0, 1] where 0 is clean and 1 is surely spam, reason explains a positive score
+	Check(d db.DB, s *CommentSubmission) (score float64, reason string, err error)
+}
+
+// checkSpam runs every filter on s, a filter which fails is logged and left out
+// so comments are not refused when a check cannot run
+func checkSpam(d db.DB, filters []SpamFilter, s *CommentSubmission) ([]db.SpamScore, float64) {
+	scores := []db.SpamScore{}
+	total := 0.0
+	for _, f := range filters {
+		score, reason, err := f.Check(d, s)
+		if err != nil {
+			log.Printf("spam check %s: %v", f.Name(), err)
+			continue
+		}
+		score = clampScore(score)
+		scores = append(scores, db.SpamScore{Check: f.Name(), Score: score, Reason: reason})
+		total += score
+	}
+	return scores, total
+}
+
+func clampScore(score float64) float64 {
+	switch {
+	case score < 0:
+		return 0
+	case score > 1:
+		return 1
+	}
+	return score
+}
+
+// link matches urls and bare www. hosts in comments
+var link = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"']+`)
+
+// linkHosts returns lowercased hosts of links in content
+func linkHosts(content string) []string {
+	var hosts []string
+	for _, l := range link.FindAllString(content, -1) {
+		// punctuation ending a sentence is not part of link
+		l = strings.TrimRight(l, ".,;:!?)]")
+		if !strings.Contains(l, "://") {
+			l = "http://" + l
+		}
+		u, err := url.Parse(l)
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		hosts = append(hosts, strings.ToLower(u.Hostname()))
+	}
+	return hosts
+}
+
+// LinkFilter scores comments with more than Max links, each extra link adds PerLink
+type LinkFilter struct {
+	Max     int
+	PerLink float64
+}
+
+// Name implements SpamFilter
+func (f *LinkFilter) Name() string { return "links" }
+
+// Check implements SpamFilter
+func (f *LinkFilter) Check(d db.DB, s *CommentSubmission) (float64, string, error) {
+	n := len(link.FindAllString(s.Content, -1))
+	if n <= f.Max {
+		return 0, "", nil
+	}
+	return float64(n-f.Max) * f.PerLink, fmt.Sprintf("%d links, %d allowed", n, f.Max), nil
+}
+
+// BlocklistFilter scores 1 for comments containing one of Words, or linking to or written
+// from an email of one of Domains or their subdomains, both are matched ignoring case
+type BlocklistFilter struct {
+	Words   []string
+	Domains []string
+}
+
+// Name implements SpamFilter
+func (f *BlocklistFilter) Name() string { return "blocklist" }
+
+// Check implements SpamFilter
+func (f *BlocklistFilter) Check(d db.DB, s *CommentSubmission) (float64, string, error) {
+	content := strings.ToLower(s.Content)
+	for _, w := range f.Words {
+		if w != "" && strings.Contains(content, strings.ToLower(w)) {
+			return 1, fmt.Sprintf("blocked word %q", w), nil
+		}
+	}
+	hosts := linkHosts(s.Content)
+	if i := strings.LastIndex(s.Email, "@"); i >= 0 {
+		hosts = append(hosts, strings.ToLower(s.Email[i+1:]))
+	}
+	for _, h := range hosts {
+		for _, dm := range f.Domains {
+			dm = strings.ToLower(dm)
+			if dm != "" && (h == dm || strings.HasSuffix(h, "."+dm)) {
+				return 1, fmt.Sprintf("blocked domain %q", dm), nil
+			}
+		}
+	}
+	return 0, "", nil
+}
+
+// HoneypotFilter scores 1 for comments which fill honeypot field
+type HoneypotFilter struct{}
+
+// Name implements SpamFilter
+func (f *HoneypotFilter) Name() string { return "honeypot" }
+
+// Check implements SpamFilter
+func (f *HoneypotFilter) Check(d db.DB, s *CommentSubmission) (float64, string, error) {
+	if s.Honeypot != "" {
+		return 1, "honeypot field is filled", nil
+	}
+	return 0, "", nil
+}
+
+// TimeToSubmitFilter scores 1 for comments submitted less than Min after comment form
+// was loaded, and Missing for those without a valid form token or with one older than MaxAge
+type TimeToSubmitFilter struct {
+	Min     time.Duration
+	MaxAge  time.Duration
+	Missing float64
+}
+
+// Name implements SpamFilter
+func (f *TimeToSubmitFilter) Name() string { return "timeToSubmit" }
+
+// Check implements SpamFilter
+func (f *TimeToSubmitFilter) Check(d db.DB, s *CommentSubmission) (float64, string, error) {
+	switch {
+	case s.FormAge < 0:
+		return f.Missing, "form token is missing or invalid", nil
+	case s.FormAge < f.Min:
+		return 1, fmt.Sprintf("submitted %v after form was loaded", s.FormAge.Round(time.Millisecond)), nil
+	case f.MaxAge > 0 && s.FormAge > f.MaxAge:
+		return f.Missing, "form token is expired", nil
+	}
+	return 0, "", nil
+}
+
+// DuplicateFilter scores Score for comments whose content was already posted
+type DuplicateFilter struct {
+	Score float64
+}
+
+// Name implements SpamFilter
+func (f *DuplicateFilter) Name() string { return "duplicate" }
+
+// Check implements SpamFilter
+func (f *DuplicateFilter) Check(d db.DB, s *CommentSubmission) (float64, string, error) {
+	n, err := d.CountCommentsByContent(s.Content)
+	if err != nil {
+		return 0, "", err
+	}
+	if n == 0 {
+		return 0, "", nil
+	}
+	return f.Score, fmt.Sprintf("same content was posted %d times", n), nil
+}
+
+// formTokenMACSize is size of mac kept in form tokens
+const formTokenMACSize = 16
+
+// signFormToken makes a form token recording t, signed with key
+func signFormToken(key []byte, t time.Time) string {
+	b := make([]byte, 8, 8+formTokenMACSize)
+	binary.BigEndian.PutUint64(b, uint64(t.Unix()))
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(b)[:8+formTokenMACSize])
+}
+
+// formAge returns how long ago form token was signed with key, -1 if it is invalid
+func formAge(key []byte, token string, now time.Time) time.Duration {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(b) != 8+formTokenMACSize {
+		return -1
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b[:8])
+	if !hmac.Equal(mac.Sum(nil)[:formTokenMACSize], b[8:]) {
+		return -1
+	}
+	age := now.Sub(time.Unix(int64(binary.BigEndian.Uint64(b[:8])), 0))
+	if age < 0 {
+		return -1
+	}
+	return age
+}
@@ -0,0 +1,19 @@
+package storage
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrNotExist is returned by Get when no file is stored under key
+var ErrNotExist = errors.New("file does not exist")
+
+// Storage lists essential methods to keep files uploaded to blog server,
+// keys are slash separated paths like ab/cdef.png
+type Storage interface {
+	Put(key string, r io.Reader) error
+	Get(key string) (io.ReadCloser, error)
+	Delete(key string) error
+	// URL returns where file of key can be downloaded by browsers
+	URL(key string) string
+}
@@ -0,0 +1,141 @@
+package handler
+
+import (
+	"html"
+	"middleware/handler/db"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var (
+	atxHeading    = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	setextLine    = regexp.MustCompile(`^ {0,3}(=+|-{2,})[ \t]*$`)
+	htmlHeading   = regexp.MustCompile(`(?i)<h([1-6])((?:\s[^>]*)?)>(.*?)</h[1-6]>`)
+	htmlID        = regexp.MustCompile(`(?i)\sid\s*=\s*["']([^"']+)["']`)
+	customAnchor  = regexp.MustCompile(`\s*\{#([^}\s]+)\}$`)
+	fence         = regexp.MustCompile("^ {0,3}(`{3,}|~{3,})")
+	inlineLink    = regexp.MustCompile(`!?\[([^\]]*)\]\([^)]*\)`)
+	inlineMarkup  = regexp.MustCompile("[*_`~]+")
+	inlineHTMLTag = regexp.MustCompile(`<[^>]*>`)
+)
+
+// extractTOC reads headings of Markdown content, both ATX (# title) and setext
+// (title underlined by === or ---) headings and html headings count, headings in
+// fenced code do not, anchors are made of heading text like GitHub does unless
+// given by {#anchor} or an id attribute, and made unique by -1, -2 suffixes
+func extractTOC(content string) []db.TOCEntry {
+	var (
+		flat    []db.TOCEntry
+		fenceBy string
+		prev    string
+	)
+	used := map[string]int{}
+	add := func(level int, text, anchor string) {
+		if m := customAnchor.FindStringSubmatch(text); m != nil {
+			text, anchor = text[:len(text)-len(m[0])], m[1]
+		}
+		text = headingText(text)
+		if text == "" {
+			return
+		}
+		if anchor == "" {
+			anchor = slug(text)
+		}
+		// used counts suffixes tried on each anchor, a suffixed anchor may be taken
+		// by a heading of its own, like a-1 after headings a and a-1
+		if n, ok := used[anchor]; ok {
+			base := anchor
+			for {
+				n++
+				anchor = base + "-" + strconv.Itoa(n)
+				if _, taken := used[anchor]; !taken {
+					break
+				}
+			}
+			used[base] = n
+		}
+		used[anchor] = 0
+		flat = append(flat, db.TOCEntry{Level: level, Text: text, Anchor: anchor})
+	}
+
+	for _, line := range strings.Split(strings.Replace(content, "\r\n", "\n", -1), "\n") {
+		if m := fence.FindStringSubmatch(line); m != nil {
+			switch {
+			case fenceBy == "":
+				fenceBy = m[1]
+			case strings.HasPrefix(m[1], fenceBy[:3]) && len(m[1]) >= len(fenceBy):
+				fenceBy = ""
+			}
+			prev = ""
+			continue
+		}
+		if fenceBy != "" {
+			continue
+		}
+		if m := atxHeading.FindStringSubmatch(line); m != nil {
+			add(len(m[1]), m[2], "")
+			prev = ""
+			continue
+		}
+		if m := setextLine.FindStringSubmatch(line); m != nil && strings.TrimSpace(prev) != "" {
+			level := 2
+			if m[1][0] == '=' {
+				level = 1
+			}
+			add(level, prev, "")
+			prev = ""
+			continue
+		}
+		for _, m := range htmlHeading.FindAllStringSubmatch(line, -1) {
+			level, _ := strconv.Atoi(m[1])
+			anchor := ""
+			if id := htmlID.FindStringSubmatch(m[2]); id != nil {
+				anchor = id[1]
+			}
+			add(level, m[3], anchor)
+		}
+		prev = line
+	}
+
+	i := 0
+	return nestTOC(flat, &i, 0)
+}
+
+// nestTOC puts each heading under the closest heading before it which has a smaller level
+func nestTOC(flat []db.TOCEntry, i *int, level int) []db.TOCEntry {
+	var entries []db.TOCEntry
+	for *i < len(flat) && flat[*i].Level > level {
+		e := flat[*i]
+		*i++
+		e.Children = nestTOC(flat, i, e.Level)
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// headingText drops links, emphasis, code marks and html tags of a heading
+func headingText(s string) string {
+	s = inlineLink.ReplaceAllString(s, "$1")
+	s = inlineHTMLTag.ReplaceAllString(s, "")
+	s = inlineMarkup.ReplaceAllString(s, "")
+	return strings.Join(strings.Fields(html.UnescapeString(s)), " ")
+}
+
+// slug lowercases text, drops punctuation and joins words by -
+func slug(text string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsNumber(r) || r == '_' || r == '-':
+			b.WriteRune(r)
+		case unicode.IsSpace(r):
+			b.WriteRune('-')
+		}
+	}
+	if b.Len() == 0 {
+		return "section"
+	}
+	return b.String()
+}
@@ -1,12 +1,17 @@
 package handler
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"math"
 	"middleware/handler/db"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/Jeffail/gabs/v2"
 )
@@ -53,6 +58,45 @@ func (data JSONData) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// Conflict responds a version conflict with current version, so client can merge
+type Conflict struct {
+	vc *db.VersionConflict
+}
+
+func (c Conflict) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(`Content-Type`, `application/json`)
+	w.Header().Set(`ETag`, etag(c.vc.Current))
+	w.WriteHeader(http.StatusConflict)
+	err := writeJSON(&db.Response{Err: &db.JsError{Err: c.vc}, Data: c.vc}, w)
+	if err != nil {
+		log.Printf("write http json response: %v", err)
+		return
+	}
+	return
+}
+
+// etag quotes version of a post or comment as an entity tag
+func etag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// expectedVersion reads version a client expects to update from If-Match header,
+// or from expectedVersion field in json if header is missing
+func expectedVersion(r *http.Request, pJSON *gabs.Container) (int, error) {
+	if im := r.Header.Get("If-Match"); im != "" {
+		v, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(im, "W/"), `"`))
+		if err != nil {
+			return 0, fmt.Errorf("parse If-Match header as version: %v", err)
+		}
+		return v, nil
+	}
+	v, ok := jsonInt(pJSON, "expectedVersion")
+	if !ok {
+		return 0, errors.New("expectedVersion field in json is not int and If-Match header is missing")
+	}
+	return v, nil
+}
+
 func writeJSON(resp *db.Response, w http.ResponseWriter) error {
 	w.Header().Set(`Content-Type`, `application/json`)
 
@@ -69,6 +113,16 @@ func writeJSON(resp *db.Response, w http.ResponseWriter) error {
 	return nil
 }
 
+// limitJSON caps json request bodies at max bytes, as parseJSONReq reads them whole
+func limitJSON(max int64, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") == "application/json" {
+			r.Body = http.MaxBytesReader(w, r.Body, max)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
 func parseJSONReq(r *http.Request, callback func(pJSON *gabs.Container) error) error {
 	if r.Method != http.MethodPost {
 		return errors.New("request is not POST")
@@ -78,7 +132,14 @@ func parseJSONReq(r *http.Request, callback func(pJSON *gabs.Container) error) e
 		return errors.New("request body is not application/json")
 	}
 
-	jsParsed, err := gabs.ParseJSONBuffer(r.Body)
+	// body is kept for later calls, the action field is parsed before the rest of request
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return fmt.Errorf("read request body: %v", err)
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	jsParsed, err := gabs.ParseJSON(body)
 	if err != nil {
 		return fmt.Errorf("parse request body as json: %v", err)
 	}
@@ -86,3 +147,45 @@ func parseJSONReq(r *http.Request, callback func(pJSON *gabs.Container) error) e
 	return callback(jsParsed)
 
 }
+
+// jsonInt reads a whole number at path, json numbers are decoded as float64
+func jsonInt(pJSON *gabs.Container, path string) (int, bool) {
+	f, ok := pJSON.Path(path).Data().(float64)
+	if !ok || f != math.Trunc(f) || math.Abs(f) > math.MaxInt32 {
+		return 0, false
+	}
+	return int(f), true
+}
+
+// jsonStrings reads an array of strings at path
+func jsonStrings(pJSON *gabs.Container, path string) ([]string, bool) {
+	arr, ok := pJSON.Path(path).Data().([]interface{})
+	if !ok {
+		return nil, false
+	}
+	strs := make([]string, len(arr))
+	for i, v := range arr {
+		strs[i], ok = v.(string)
+		if !ok {
+			return nil, false
+		}
+	}
+	return strs, true
+}
+
+// jsonInts reads an array of ints at path
+func jsonInts(pJSON *gabs.Container, path string) ([]int, bool) {
+	arr, ok := pJSON.Path(path).Data().([]interface{})
+	if !ok {
+		return nil, false
+	}
+	ints := make([]int, len(arr))
+	for i, v := range arr {
+		f, ok := v.(float64)
+		if !ok || f != math.Trunc(f) || math.Abs(f) > math.MaxInt32 {
+			return nil, false
+		}
+		ints[i] = int(f)
+	}
+	return ints, true
+}
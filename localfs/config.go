@@ -0,0 +1,9 @@
+package localfs
+
+// FSConfig contains necessary of a LocalFS
+type FSConfig struct {
+	// Dir is root directory of stored files
+	Dir string
+	// BaseURL is prefix of URLs files are served at
+	BaseURL string
+}
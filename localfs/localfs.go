@@ -0,0 +1,123 @@
+package localfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"middleware/handler/storage"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// LocalFS stores files in a directory of local filesystem
+type LocalFS struct {
+	config *FSConfig
+}
+
+// New uses FSConfig, returns LocalFS instance
+func New(c *FSConfig) (*LocalFS, error) {
+	cfg, err := validConfig(c)
+	if err != nil {
+		return nil, fmt.Errorf("validate config: %v", err)
+	}
+	err = os.MkdirAll(cfg.Dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("create root dir: %v", err)
+	}
+	return &LocalFS{config: cfg}, nil
+}
+
+func validConfig(r *FSConfig) (*FSConfig, error) {
+	n := *r
+
+	if n.Dir == "" {
+		return nil, errors.New("empty root dir")
+	}
+	if n.BaseURL == "" {
+		n.BaseURL = "/media/files"
+	}
+	n.BaseURL = strings.TrimSuffix(n.BaseURL, "/")
+	return &n, nil
+}
+
+// path converts key to a path inside root dir, keys escaping root dir are refused
+func (fs *LocalFS) path(key string) (string, error) {
+	if key == "" || path.Clean(key) != key || strings.HasPrefix(key, "/") || strings.HasPrefix(key, "..") {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+	return filepath.Join(fs.config.Dir, filepath.FromSlash(key)), nil
+}
+
+// Put writes r into file of key, file is replaced at once after r is drained
+func (fs *LocalFS) Put(key string, r io.Reader) error {
+	p, err := fs.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return fmt.Errorf("create dir: %v", err)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(p), ".upload-")
+	if err != nil {
+		return fmt.Errorf("create temp file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("write file: %v", err)
+	}
+	err = tmp.Close()
+	if err != nil {
+		return fmt.Errorf("close file: %v", err)
+	}
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return fmt.Errorf("chmod file: %v", err)
+	}
+	err = os.Rename(tmp.Name(), p)
+	if err != nil {
+		return fmt.Errorf("rename file: %v", err)
+	}
+	return nil
+}
+
+// Get opens file of key, returns storage.ErrNotExist if it is not found
+func (fs *LocalFS) Get(key string) (io.ReadCloser, error) {
+	p, err := fs.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, storage.ErrNotExist
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open file: %v", err)
+	}
+	return f, nil
+}
+
+// Delete removes file of key, missing files are not treated as error
+func (fs *LocalFS) Delete(key string) error {
+	p, err := fs.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove file: %v", err)
+	}
+	return nil
+}
+
+// URL returns BaseURL joined with key
+func (fs *LocalFS) URL(key string) string {
+	return fs.config.BaseURL + "/" + key
+}
@@ -0,0 +1,119 @@
+package pgsql
+
+import (
+	"fmt"
+	"middleware/handler/db"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// RecordViews adds buffered views to daily counters of posts in one transaction
+func (pg *PGSQL) RecordViews(records []db.ViewRecord) error {
+	tx, err := pg.instance.Begin()
+	if err != nil {
+		return fmt.Errorf("begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`SELECT public.recordViews($1, $2, $3, $4, $5, $6)`)
+	if err != nil {
+		return fmt.Errorf("prepare recordViews(): %v", err)
+	}
+	defer stmt.Close()
+
+	for _, rec := range records {
+		var (
+			domains []string
+			counts  []int64
+		)
+		for domain, n := range rec.Referrers {
+			domains = append(domains, domain)
+			counts = append(counts, int64(n))
+		}
+		_, err := stmt.Exec(rec.PostID, rec.Day, rec.Views, pq.StringArray(rec.Visitors), pq.StringArray(domains), pq.Int64Array(counts))
+		if err != nil {
+			return fmt.Errorf("select from recordViews(): %v", err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("commit transaction: %v", err)
+	}
+	return nil
+}
+
+// GetDailyViews returns views per post per day from from to to inclusive,
+// only of post of pid if it is not 0
+func (pg *PGSQL) GetDailyViews(from, to time.Time, pid int) ([]db.DailyViews, error) {
+	dvs := []db.DailyViews{}
+	rs, err := pg.instance.Query(`SELECT * FROM public.getDailyViews($1, $2, $3)`, from, to, pid)
+	if err != nil {
+		return nil, fmt.Errorf("select from getDailyViews(): %v", err)
+	}
+	defer rs.Close()
+
+	for rs.Next() {
+		var (
+			dv  db.DailyViews
+			day time.Time
+		)
+		err := rs.Scan(&dv.PostID, &day, &dv.Views, &dv.Visitors)
+		if err != nil {
+			return nil, fmt.Errorf("parse query result: %v", err)
+		}
+		d := db.Jstime(day)
+		dv.Day = &d
+		dvs = append(dvs, dv)
+	}
+	if rs.Err() != nil {
+		return nil, fmt.Errorf("perform query: %v", rs.Err())
+	}
+	return dvs, nil
+}
+
+// GetTopPosts returns at most limit posts viewed most from from to to inclusive
+func (pg *PGSQL) GetTopPosts(from, to time.Time, limit int) ([]db.TopPost, error) {
+	tps := []db.TopPost{}
+	rs, err := pg.instance.Query(`SELECT * FROM public.getTopPosts($1, $2, $3)`, from, to, limit)
+	if err != nil {
+		return nil, fmt.Errorf("select from getTopPosts(): %v", err)
+	}
+	defer rs.Close()
+
+	for rs.Next() {
+		var tp db.TopPost
+		err := rs.Scan(&tp.PostID, &tp.Title, &tp.Views, &tp.Visitors)
+		if err != nil {
+			return nil, fmt.Errorf("parse query result: %v", err)
+		}
+		tps = append(tps, tp)
+	}
+	if rs.Err() != nil {
+		return nil, fmt.Errorf("perform query: %v", rs.Err())
+	}
+	return tps, nil
+}
+
+// GetReferrers returns at most limit domains referring most views from from to to inclusive
+func (pg *PGSQL) GetReferrers(from, to time.Time, limit int) ([]db.ReferrerViews, error) {
+	rvs := []db.ReferrerViews{}
+	rs, err := pg.instance.Query(`SELECT * FROM public.getReferrers($1, $2, $3)`, from, to, limit)
+	if err != nil {
+		return nil, fmt.Errorf("select from getReferrers(): %v", err)
+	}
+	defer rs.Close()
+
+	for rs.Next() {
+		var rv db.ReferrerViews
+		err := rs.Scan(&rv.Domain, &rv.Views)
+		if err != nil {
+			return nil, fmt.Errorf("parse query result: %v", err)
+		}
+		rvs = append(rvs, rv)
+	}
+	if rs.Err() != nil {
+		return nil, fmt.Errorf("perform query: %v", rs.Err())
+	}
+	return rvs, nil
+}
@@ -0,0 +1,167 @@
+package pgsql
+
+import (
+	"database/sql"
+	"fmt"
+	"middleware/handler/db"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// GetPostsAfter returns at most limit posts whose pid is bigger than pid, ordered by pid
+func (pg *PGSQL) GetPostsAfter(pid, limit int) ([]db.Post, error) {
+	posts := []db.Post{}
+	rs, err := pg.instance.Query(`SELECT * FROM public.getPostsAfter($1, $2)`, pid, limit)
+	if err != nil {
+		return nil, fmt.Errorf("select from getPostsAfter(): %v", err)
+	}
+	defer rs.Close()
+	for rs.Next() {
+		p, err := scanPost(rs)
+		if err != nil {
+			return nil, fmt.Errorf("parse query result: %v", err)
+		}
+		posts = append(posts, *p)
+	}
+	if rs.Err() != nil {
+		return nil, fmt.Errorf("perform query: %v", rs.Err())
+	}
+	return posts, nil
+}
+
+// GetCommentsAfter returns at most limit comments of any post whose cid is bigger than cid, ordered by cid
+func (pg *PGSQL) GetCommentsAfter(cid, limit int) ([]db.Comment, error) {
+	cmts := []db.Comment{}
+	rs, err := pg.instance.Query(`SELECT * FROM public.getCommentsAfter($1, $2)`, cid, limit)
+	if err != nil {
+		return nil, fmt.Errorf("select from getCommentsAfter(): %v", err)
+	}
+	defer rs.Close()
+	for rs.Next() {
+		c, err := scanComment(rs)
+		if err != nil {
+			return nil, fmt.Errorf("parse query result: %v", err)
+		}
+		cmts = append(cmts, *c)
+	}
+	if rs.Err() != nil {
+		return nil, fmt.Errorf("perform query: %v", rs.Err())
+	}
+	return cmts, nil
+}
+
+// GetUserAccounts returns every user with hash of its password, ordered by uid
+func (pg *PGSQL) GetUserAccounts() ([]db.UserAccount, error) {
+	users := []db.UserAccount{}
+	rs, err := pg.instance.Query(`SELECT * FROM public.getUserAccounts()`)
+	if err != nil {
+		return nil, fmt.Errorf("select from getUserAccounts(): %v", err)
+	}
+	defer rs.Close()
+	for rs.Next() {
+		var (
+			u  db.UserAccount
+			pw []byte
+		)
+		err := rs.Scan(&u.UID, &u.UserName, &pw, &u.Privilege)
+		if err != nil {
+			return nil, fmt.Errorf("parse query result: %v", err)
+		}
+		if len(pw) != len(u.PassWord) {
+			return nil, fmt.Errorf("password of user %d is not a sha256 hash", u.UID)
+		}
+		copy(u.PassWord[:], pw)
+		users = append(users, u)
+	}
+	if rs.Err() != nil {
+		return nil, fmt.Errorf("perform query: %v", rs.Err())
+	}
+	return users, nil
+}
+
+// GetPostIDByTitle returns pid of post titled title, or 0 if there is none
+func (pg *PGSQL) GetPostIDByTitle(title string) (int, error) {
+	var (
+		pid sql.NullInt64
+	)
+	err := pg.instance.QueryRow(`SELECT public.getPostIDByTitle($1)`, title).Scan(&pid)
+	if err != nil {
+		return -1, fmt.Errorf("select from getPostIDByTitle(): %v", err)
+	}
+	return int(pid.Int64), nil
+}
+
+// GetCommentIDBySource returns cid of comment imported from source, or 0 if there is none
+func (pg *PGSQL) GetCommentIDBySource(source string) (int, error) {
+	var (
+		cid sql.NullInt64
+	)
+	err := pg.instance.QueryRow(`SELECT public.getCommentIDBySource($1)`, source).Scan(&cid)
+	if err != nil {
+		return -1, fmt.Errorf("select from getCommentIDBySource(): %v", err)
+	}
+	return int(cid.Int64), nil
+}
+
+// GetUserIDByName returns uid of user named userName, or 0 if there is none
+func (pg *PGSQL) GetUserIDByName(userName string) (int, error) {
+	var (
+		uid sql.NullInt64
+	)
+	err := pg.instance.QueryRow(`SELECT public.getUserIDByName($1)`, userName).Scan(&uid)
+	if err != nil {
+		return -1, fmt.Errorf("select from getUserIDByName(): %v", err)
+	}
+	return int(uid.Int64), nil
+}
+
+// nullTime maps a missing date to null
+func nullTime(t *db.Jstime) pq.NullTime {
+	if t == nil {
+		return pq.NullTime{}
+	}
+	return pq.NullTime{Time: time.Time(*t), Valid: true}
+}
+
+// ImportPost inserts p keeping its dates and flags, its pid, translation group and version are not kept,
+// language defaults to en if empty, returns pid of inserted post
+func (pg *PGSQL) ImportPost(p *db.Post) (int, error) {
+	var (
+		pid int
+	)
+	err := pg.instance.QueryRow(`SELECT public.importPost($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		p.Title, p.Content, pq.StringArray(append([]string{}, p.Tags...)), sql.NullString{String: p.Language, Valid: p.Language != ""},
+		nullTime(p.CDate), nullTime(p.MDate), p.Pinned, nullTime(p.PinnedUntil), p.Featured).Scan(&pid)
+	if err != nil {
+		return -1, fmt.Errorf("select from importPost(): %v", err)
+	}
+	return pid, nil
+}
+
+// ImportComment inserts c into post of its pid keeping its author name, date, parent, deleted flag,
+// status and source, an empty status is approved, returns cid of inserted comment
+func (pg *PGSQL) ImportComment(c *db.Comment) (int, error) {
+	var (
+		cid int
+	)
+	err := pg.instance.QueryRow(`SELECT public.importComment($1, $2, $3, $4, $5, $6, $7, $8, $9)`, c.PostID, c.Content, c.Email, c.AuthorName,
+		nullTime(c.CDate), nullID(c.ParentID), c.Deleted, sql.NullString{String: c.Status, Valid: c.Status != ""},
+		sql.NullString{String: c.Source, Valid: c.Source != ""}).Scan(&cid)
+	if err != nil {
+		return -1, fmt.Errorf("select from importComment(): %v", err)
+	}
+	return cid, nil
+}
+
+// ImportUser inserts u keeping its password and privilege, returns uid of inserted user
+func (pg *PGSQL) ImportUser(u *db.UserAccount) (int, error) {
+	var (
+		uid int
+	)
+	err := pg.instance.QueryRow(`SELECT public.importUser($1, $2, $3)`, u.UserName, u.PassWord[:], u.Privilege).Scan(&uid)
+	if err != nil {
+		return -1, fmt.Errorf("select from importUser(): %v", err)
+	}
+	return uid, nil
+}
@@ -0,0 +1,160 @@
+package pgsql
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"middleware/handler/db"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// GetPostAuthor returns uid and email of user who wrote post of pid, 0 and empty if
+// it is unknown, email is empty if author has none
+func (pg *PGSQL) GetPostAuthor(pid int) (int, string, error) {
+	var (
+		uid   sql.NullInt64
+		email sql.NullString
+	)
+	err := pg.instance.QueryRow(`SELECT * FROM public.getPostAuthor($1)`, pid).Scan(&uid, &email)
+	if err != nil {
+		return 0, "", fmt.Errorf("select from getPostAuthor(): %v", err)
+	}
+	return int(uid.Int64), email.String, nil
+}
+
+// SetUserEmail sets email notifications of user of uid are sent to, an empty one removes it,
+// returns false if user is not found
+func (pg *PGSQL) SetUserEmail(uid int, email string) (bool, error) {
+	var (
+		performed bool
+	)
+	err := pg.instance.QueryRow(`SELECT * FROM public.setUserEmail($1, $2)`, uid,
+		sql.NullString{String: email, Valid: email != ""}).Scan(&performed)
+	if err != nil {
+		return false, fmt.Errorf("select from setUserEmail(): %v", err)
+	}
+	return performed, nil
+}
+
+// EnqueueMail puts m into outbox, returns false if its recipient opted out of mails
+func (pg *PGSQL) EnqueueMail(m *db.Mail) (bool, error) {
+	var (
+		queued bool
+	)
+	headers, err := json.Marshal(m.Headers)
+	if err != nil {
+		return false, fmt.Errorf("marshal headers: %v", err)
+	}
+	err = pg.instance.QueryRow(`SELECT * FROM public.enqueueMail($1, $2, $3, $4)`, m.To, m.Subject, m.Body, headers).Scan(&queued)
+	if err != nil {
+		return false, fmt.Errorf("select from enqueueMail(): %v", err)
+	}
+	return queued, nil
+}
+
+// GetDueMails claims up to limit mails of outbox which are due to be sent, oldest first,
+// they are not due again for lease, mails claimed by others are skipped
+func (pg *PGSQL) GetDueMails(limit int, lease time.Duration) ([]db.Mail, error) {
+	mails := []db.Mail{}
+	rs, err := pg.instance.Query(`SELECT * FROM public.getDueMails($1, $2)`, limit, int(lease/time.Second))
+	if err != nil {
+		return nil, fmt.Errorf("select from getDueMails(): %v", err)
+	}
+	defer rs.Close()
+	for rs.Next() {
+		var (
+			m       db.Mail
+			headers []byte
+		)
+		err := rs.Scan(&m.MailID, &m.To, &m.Subject, &m.Body, &headers, &m.Attempts)
+		if err != nil {
+			return nil, fmt.Errorf("parse query result: %v", err)
+		}
+		if err := json.Unmarshal(headers, &m.Headers); err != nil {
+			return nil, fmt.Errorf("unmarshal headers: %v", err)
+		}
+		mails = append(mails, m)
+	}
+	if rs.Err() != nil {
+		return nil, fmt.Errorf("perform query: %v", rs.Err())
+	}
+	return mails, nil
+}
+
+// MarkMailSent records mail of mid is delivered
+func (pg *PGSQL) MarkMailSent(mid int) error {
+	_, err := pg.instance.Exec(`SELECT public.markMailSent($1)`, mid)
+	if err != nil {
+		return fmt.Errorf("select from markMailSent(): %v", err)
+	}
+	return nil
+}
+
+// MarkMailFailed records a failed delivery of mail of mid, it is tried again at nextAttempt
+// or given up if nextAttempt is nil
+func (pg *PGSQL) MarkMailFailed(mid int, lastError string, nextAttempt *time.Time) error {
+	var (
+		next pq.NullTime
+	)
+	if nextAttempt != nil {
+		next = pq.NullTime{Time: *nextAttempt, Valid: true}
+	}
+	_, err := pg.instance.Exec(`SELECT public.markMailFailed($1, $2, $3)`, mid, lastError, next)
+	if err != nil {
+		return fmt.Errorf("select from markMailFailed(): %v", err)
+	}
+	return nil
+}
+
+// OptOutEmail stops all mails to email, those waiting in outbox included,
+// returns false if it opted out already
+func (pg *PGSQL) OptOutEmail(email string) (bool, error) {
+	var (
+		performed bool
+	)
+	err := pg.instance.QueryRow(`SELECT * FROM public.optOutEmail($1)`, email).Scan(&performed)
+	if err != nil {
+		return false, fmt.Errorf("select from optOutEmail(): %v", err)
+	}
+	return performed, nil
+}
+
+// RequestEmailConfirmation records email is asked to be confirmed, returns false if it is
+// confirmed or opted out already, or was asked within resendAfter
+func (pg *PGSQL) RequestEmailConfirmation(email string, resendAfter time.Duration) (bool, error) {
+	var (
+		performed bool
+	)
+	err := pg.instance.QueryRow(`SELECT * FROM public.requestEmailConfirmation($1, $2)`, email,
+		int(resendAfter/time.Second)).Scan(&performed)
+	if err != nil {
+		return false, fmt.Errorf("select from requestEmailConfirmation(): %v", err)
+	}
+	return performed, nil
+}
+
+// ConfirmEmail records owner of email confirmed it, returns false if it is confirmed already
+func (pg *PGSQL) ConfirmEmail(email string) (bool, error) {
+	var (
+		performed bool
+	)
+	err := pg.instance.QueryRow(`SELECT * FROM public.confirmEmail($1)`, email).Scan(&performed)
+	if err != nil {
+		return false, fmt.Errorf("select from confirmEmail(): %v", err)
+	}
+	return performed, nil
+}
+
+// IsEmailConfirmed reports whether owner of email confirmed it
+func (pg *PGSQL) IsEmailConfirmed(email string) (bool, error) {
+	var (
+		confirmed bool
+	)
+	err := pg.instance.QueryRow(`SELECT public.isEmailConfirmed($1)`, email).Scan(&confirmed)
+	if err != nil {
+		return false, fmt.Errorf("select from isEmailConfirmed(): %v", err)
+	}
+	return confirmed, nil
+}
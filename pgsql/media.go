@@ -0,0 +1,162 @@
+package pgsql
+
+import (
+	"encoding/json"
+	"fmt"
+	"middleware/handler/db"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// scanMedia scans columns of MediaView into a media
+func scanMedia(rs rowScanner) (*db.Media, error) {
+	var (
+		m     db.Media
+		cDate time.Time
+		pids  pq.Int64Array
+		dvs   []byte
+	)
+	err := rs.Scan(&m.MediaID, &m.UploaderID, &m.FileName, &m.MIME, &m.Size, &m.Hash, &m.Width, &m.Height, &cDate, &m.Key, &pids, &dvs)
+	if err != nil {
+		return nil, err
+	}
+	// storage key is hidden from json of db.Derivative
+	var rows []struct {
+		Name   string `json:"name"`
+		MIME   string `json:"mime"`
+		Width  int    `json:"width"`
+		Height int    `json:"height"`
+		Key    string `json:"storageKey"`
+	}
+	err = json.Unmarshal(dvs, &rows)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal derivatives: %v", err)
+	}
+	m.Derivatives = make([]db.Derivative, len(rows))
+	for i, r := range rows {
+		m.Derivatives[i] = db.Derivative{Name: r.Name, MIME: r.MIME, Width: r.Width, Height: r.Height, Key: r.Key}
+	}
+	cD := db.Jstime(cDate)
+	m.CDate = &cD
+	m.PostIDs = make([]int, len(pids))
+	for i, pid := range pids {
+		m.PostIDs[i] = int(pid)
+	}
+	return &m, nil
+}
+
+func (pg *PGSQL) queryMedia(fn string, args ...interface{}) ([]db.Media, error) {
+	media := []db.Media{}
+	rs, err := pg.instance.Query(`SELECT * FROM public.`+fn, args...)
+	if err != nil {
+		return nil, fmt.Errorf("select from %s: %v", fn, err)
+	}
+	defer rs.Close()
+
+	for rs.Next() {
+		m, err := scanMedia(rs)
+		if err != nil {
+			return nil, fmt.Errorf("parse query result: %v", err)
+		}
+		media = append(media, *m)
+	}
+	if rs.Err() != nil {
+		return nil, fmt.Errorf("perform query: %v", rs.Err())
+	}
+	return media, nil
+}
+
+// InsertMedia inserts metadata of an uploaded file and returns its mid,
+// mid of existing media is returned if a file of same hash was uploaded before
+func (pg *PGSQL) InsertMedia(m *db.Media) (int, error) {
+	var (
+		mid int
+	)
+	err := pg.instance.QueryRow(`SELECT * FROM public.insertMedia($1, $2, $3, $4, $5, $6, $7, $8)`,
+		m.UploaderID, m.FileName, m.MIME, m.Size, m.Hash, m.Width, m.Height, m.Key).Scan(&mid)
+	if err != nil {
+		return -1, fmt.Errorf("select from insertMedia(): %v", err)
+	}
+	return mid, nil
+}
+
+// GetMedia use mid to filter media, then returns it
+func (pg *PGSQL) GetMedia(mid int) (*db.Media, error) {
+	m, err := scanMedia(pg.instance.QueryRow(`SELECT * FROM public.getMedia($1)`, mid))
+	if err != nil {
+		return nil, fmt.Errorf("select from getMedia(): %v", err)
+	}
+	return m, nil
+}
+
+// GetMediaByPage use page and pageSize to select media, newest first
+func (pg *PGSQL) GetMediaByPage(pageSize, page int) ([]db.Media, error) {
+	return pg.queryMedia(`getMediaByPage($1, $2)`, pageSize, page)
+}
+
+// GetMediaCount returns count of total media in db
+func (pg *PGSQL) GetMediaCount() (int, error) {
+	var (
+		count int
+	)
+	err := pg.instance.QueryRow(`SELECT public.getMediaCount()`).Scan(&count)
+	if err != nil {
+		return -1, fmt.Errorf("select from getMediaCount(): %v", err)
+	}
+	return count, nil
+}
+
+// GetMediaOfPost returns media linked to post of pid
+func (pg *PGSQL) GetMediaOfPost(pid int) ([]db.Media, error) {
+	return pg.queryMedia(`getMediaOfPost($1)`, pid)
+}
+
+// DeleteMedia deletes metadata of media and its links to posts, returns false if not found
+func (pg *PGSQL) DeleteMedia(mid int) (bool, error) {
+	var (
+		performed bool
+	)
+	err := pg.instance.QueryRow(`SELECT * FROM public.deleteMedia($1)`, mid).Scan(&performed)
+	if err != nil {
+		return false, fmt.Errorf("select from deleteMedia(): %v", err)
+	}
+	return performed, nil
+}
+
+// LinkMedia links media of mid to post of pid, returns false if either is not found
+func (pg *PGSQL) LinkMedia(mid, pid int) (bool, error) {
+	var (
+		performed bool
+	)
+	err := pg.instance.QueryRow(`SELECT * FROM public.linkMedia($1, $2)`, mid, pid).Scan(&performed)
+	if err != nil {
+		return false, fmt.Errorf("select from linkMedia(): %v", err)
+	}
+	return performed, nil
+}
+
+// UnlinkMedia removes link between media of mid and post of pid, returns false if not linked
+func (pg *PGSQL) UnlinkMedia(mid, pid int) (bool, error) {
+	var (
+		performed bool
+	)
+	err := pg.instance.QueryRow(`SELECT * FROM public.unlinkMedia($1, $2)`, mid, pid).Scan(&performed)
+	if err != nil {
+		return false, fmt.Errorf("select from unlinkMedia(): %v", err)
+	}
+	return performed, nil
+}
+
+// InsertDerivative records a derivative of media of mid, returns false if media is not found
+func (pg *PGSQL) InsertDerivative(mid int, dv *db.Derivative) (bool, error) {
+	var (
+		performed bool
+	)
+	err := pg.instance.QueryRow(`SELECT * FROM public.insertDerivative($1, $2, $3, $4, $5, $6)`,
+		mid, dv.Name, dv.MIME, dv.Width, dv.Height, dv.Key).Scan(&performed)
+	if err != nil {
+		return false, fmt.Errorf("select from insertDerivative(): %v", err)
+	}
+	return performed, nil
+}
@@ -0,0 +1,179 @@
+package pgsql
+
+import (
+	"database/sql"
+	"fmt"
+	"middleware/handler/db"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// GetCommentsByStatus returns comments of every post in moderation status, oldest first
+func (pg *PGSQL) GetCommentsByStatus(status string, pageSize, page int) ([]db.Comment, error) {
+	cmts := []db.Comment{}
+	rs, err := pg.instance.Query(`SELECT * FROM public.getCommentsByStatus($1, $2, $3)`, status, pageSize, page)
+	if err != nil {
+		return nil, fmt.Errorf("select from getCommentsByStatus(): %v", err)
+	}
+	defer rs.Close()
+	for rs.Next() {
+		c, err := scanComment(rs)
+		if err != nil {
+			return nil, fmt.Errorf("parse query result: %v", err)
+		}
+		cmts = append(cmts, *c)
+	}
+	if rs.Err() != nil {
+		return nil, fmt.Errorf("perform query: %v", rs.Err())
+	}
+	return cmts, nil
+}
+
+// GetRecentComments returns up to limit comments of every post selected by f, newest first,
+// each with title of its post, deleted comments are left out and so are approved replies
+// below a comment which is not approved or is deleted
+func (pg *PGSQL) GetRecentComments(f *db.RecentCommentsFilter, limit int) ([]db.Comment, error) {
+	var (
+		afterTime pq.NullTime
+		afterID   sql.NullInt64
+	)
+	if f.Cursor != nil {
+		afterTime = pq.NullTime{Time: f.Cursor.CreatedAt, Valid: true}
+		afterID = nullID(f.Cursor.CommentID)
+	}
+	cmts := []db.Comment{}
+	rs, err := pg.instance.Query(`SELECT * FROM public.getRecentComments($1, $2, $3, $4, $5, $6)`,
+		sql.NullString{String: f.Status, Valid: f.Status != ""}, nullTimePtr(f.From), nullTimePtr(f.To), afterTime, afterID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("select from getRecentComments(): %v", err)
+	}
+	defer rs.Close()
+	for rs.Next() {
+		var title string
+		c, err := scanComment(rs, &title)
+		if err != nil {
+			return nil, fmt.Errorf("parse query result: %v", err)
+		}
+		c.PostTitle = title
+		cmts = append(cmts, *c)
+	}
+	if rs.Err() != nil {
+		return nil, fmt.Errorf("perform query: %v", rs.Err())
+	}
+	return cmts, nil
+}
+
+// nullTimePtr maps a nil time to null
+func nullTimePtr(t *time.Time) pq.NullTime {
+	if t == nil {
+		return pq.NullTime{}
+	}
+	return pq.NullTime{Time: *t, Valid: true}
+}
+
+// GetCommentsCountByStatus returns count of comments of every post in moderation status
+func (pg *PGSQL) GetCommentsCountByStatus(status string) (int, error) {
+	var (
+		count int
+	)
+	err := pg.instance.QueryRow(`SELECT public.getCommentsCountByStatus($1)`, status).Scan(&count)
+	if err != nil {
+		return -1, fmt.Errorf("select from getCommentsCountByStatus(): %v", err)
+	}
+	return count, nil
+}
+
+// SetCommentsStatus moves comments of cids into moderation status, returns how many are found
+func (pg *PGSQL) SetCommentsStatus(cids []int, status string) (int, error) {
+	var (
+		count int
+	)
+	ids := make(pq.Int64Array, len(cids))
+	for i, cid := range cids {
+		ids[i] = int64(cid)
+	}
+	err := pg.instance.QueryRow(`SELECT public.setCommentsStatus($1, $2)`, ids, status).Scan(&count)
+	if err != nil {
+		return -1, fmt.Errorf("select from setCommentsStatus(): %v", err)
+	}
+	return count, nil
+}
+
+// GetCommenterStatusCounts counts comments written by logined user of uid by moderation status
+func (pg *PGSQL) GetCommenterStatusCounts(uid int) (map[string]int, error) {
+	counts := map[string]int{}
+	rs, err := pg.instance.Query(`SELECT * FROM public.getCommenterStatusCounts($1)`, uid)
+	if err != nil {
+		return nil, fmt.Errorf("select from getCommenterStatusCounts(): %v", err)
+	}
+	defer rs.Close()
+	for rs.Next() {
+		var (
+			status string
+			count  int
+		)
+		if err := rs.Scan(&status, &count); err != nil {
+			return nil, fmt.Errorf("parse query result: %v", err)
+		}
+		counts[status] = count
+	}
+	if rs.Err() != nil {
+		return nil, fmt.Errorf("perform query: %v", rs.Err())
+	}
+	return counts, nil
+}
+
+// CountCommentsByContent counts comments of every post whose content is content, ignoring case and surrounding spaces
+func (pg *PGSQL) CountCommentsByContent(content string) (int, error) {
+	var (
+		count int
+	)
+	err := pg.instance.QueryRow(`SELECT public.countCommentsByContent($1)`, content).Scan(&count)
+	if err != nil {
+		return -1, fmt.Errorf("select from countCommentsByContent(): %v", err)
+	}
+	return count, nil
+}
+
+// GetSpamCorpus returns counts of comments trained as spam and ham, and counts of tokens
+// among them, tokens never trained are left out
+func (pg *PGSQL) GetSpamCorpus(tokens []string) (*db.SpamCorpus, error) {
+	corpus := db.SpamCorpus{Tokens: map[string]db.TokenCounts{}}
+	err := pg.instance.QueryRow(`SELECT * FROM public.getSpamDocs()`).Scan(&corpus.SpamDocs, &corpus.HamDocs)
+	if err != nil {
+		return nil, fmt.Errorf("select from getSpamDocs(): %v", err)
+	}
+	rs, err := pg.instance.Query(`SELECT * FROM public.getSpamTokens($1)`, pq.StringArray(tokens))
+	if err != nil {
+		return nil, fmt.Errorf("select from getSpamTokens(): %v", err)
+	}
+	defer rs.Close()
+	for rs.Next() {
+		var (
+			token string
+			tc    db.TokenCounts
+		)
+		if err := rs.Scan(&token, &tc.Spam, &tc.Ham); err != nil {
+			return nil, fmt.Errorf("parse query result: %v", err)
+		}
+		corpus.Tokens[token] = tc
+	}
+	if rs.Err() != nil {
+		return nil, fmt.Errorf("perform query: %v", rs.Err())
+	}
+	return &corpus, nil
+}
+
+// TrainSpam learns tokens of comment of cid as spam or ham, tokens it was trained with
+// before as the other are unlearnt, returns false if it was trained so already
+func (pg *PGSQL) TrainSpam(cid int, tokens []string, spam bool) (bool, error) {
+	var (
+		performed bool
+	)
+	err := pg.instance.QueryRow(`SELECT public.trainSpam($1, $2, $3)`, cid, pq.StringArray(tokens), spam).Scan(&performed)
+	if err != nil {
+		return false, fmt.Errorf("select from trainSpam(): %v", err)
+	}
+	return performed, nil
+}
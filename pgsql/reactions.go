@@ -0,0 +1,61 @@
+package pgsql
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// AddReaction records reaction of emoji from reactor on post of pid,
+// returns false if reactor already reacted so
+func (pg *PGSQL) AddReaction(pid int, reactor, emoji string) (bool, error) {
+	var (
+		performed bool
+	)
+	err := pg.instance.QueryRow(`SELECT * FROM public.addReaction($1, $2, $3)`, pid, reactor, emoji).Scan(&performed)
+	if err != nil {
+		return false, fmt.Errorf("select from addReaction(): %v", err)
+	}
+	return performed, nil
+}
+
+// RemoveReaction deletes reaction of emoji from reactor on post of pid, returns false if not found
+func (pg *PGSQL) RemoveReaction(pid int, reactor, emoji string) (bool, error) {
+	var (
+		performed bool
+	)
+	err := pg.instance.QueryRow(`SELECT * FROM public.removeReaction($1, $2, $3)`, pid, reactor, emoji).Scan(&performed)
+	if err != nil {
+		return false, fmt.Errorf("select from removeReaction(): %v", err)
+	}
+	return performed, nil
+}
+
+// GetReactions returns counts of reactions on post of pid by emoji
+func (pg *PGSQL) GetReactions(pid int) (map[string]int, error) {
+	var (
+		js        []byte
+		reactions map[string]int
+	)
+	err := pg.instance.QueryRow(`SELECT public.getReactions($1)`, pid).Scan(&js)
+	if err != nil {
+		return nil, fmt.Errorf("select from getReactions(): %v", err)
+	}
+	err = json.Unmarshal(js, &reactions)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal reactions: %v", err)
+	}
+	return reactions, nil
+}
+
+// MoveReactions gives reactions of reactor from to reactor to, those to already reacted
+// with are dropped, returns how many are moved
+func (pg *PGSQL) MoveReactions(from, to string) (int, error) {
+	var (
+		count int
+	)
+	err := pg.instance.QueryRow(`SELECT public.moveReactions($1, $2)`, from, to).Scan(&count)
+	if err != nil {
+		return -1, fmt.Errorf("select from moveReactions(): %v", err)
+	}
+	return count, nil
+}
@@ -0,0 +1,157 @@
+package pgsql
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"middleware/handler/db"
+
+	"github.com/lib/pq"
+)
+
+// postLink makes a link of nullable columns of a post, nil if there is no post
+func postLink(pid sql.NullInt64, title sql.NullString) *db.PostLink {
+	if !pid.Valid {
+		return nil
+	}
+	return &db.PostLink{PostID: int(pid.Int64), Title: title.String}
+}
+
+// GetAdjacentPosts returns posts created just before and after post of pid,
+// either is nil if post of pid is first or last
+func (pg *PGSQL) GetAdjacentPosts(pid int) (*db.PostLink, *db.PostLink, error) {
+	var (
+		prevID, nextID       sql.NullInt64
+		prevTitle, nextTitle sql.NullString
+	)
+	err := pg.instance.QueryRow(`SELECT * FROM public.getAdjacentPosts($1)`, pid).Scan(&prevID, &prevTitle, &nextID, &nextTitle)
+	if err == sql.ErrNoRows {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("select from getAdjacentPosts(): %v", err)
+	}
+	return postLink(prevID, prevTitle), postLink(nextID, nextTitle), nil
+}
+
+// InsertSeries inserts an empty series, returns sid of it
+func (pg *PGSQL) InsertSeries(title, description string) (int, error) {
+	var (
+		sid int
+	)
+	err := pg.instance.QueryRow(`SELECT * FROM public.insertSeries($1, $2)`, title, description).Scan(&sid)
+	if err != nil {
+		return -1, fmt.Errorf("select from insertSeries(): %v", err)
+	}
+	return sid, nil
+}
+
+// UpdateSeries changes title and description of series of sid, returns false if not found
+func (pg *PGSQL) UpdateSeries(sid int, title, description string) (bool, error) {
+	var (
+		performed bool
+	)
+	err := pg.instance.QueryRow(`SELECT * FROM public.updateSeries($1, $2, $3)`, sid, title, description).Scan(&performed)
+	if err != nil {
+		return false, fmt.Errorf("select from updateSeries(): %v", err)
+	}
+	return performed, nil
+}
+
+// DeleteSeries deletes series of sid, its posts are kept, returns false if not found
+func (pg *PGSQL) DeleteSeries(sid int) (bool, error) {
+	var (
+		performed bool
+	)
+	err := pg.instance.QueryRow(`SELECT * FROM public.deleteSeries($1)`, sid).Scan(&performed)
+	if err != nil {
+		return false, fmt.Errorf("select from deleteSeries(): %v", err)
+	}
+	return performed, nil
+}
+
+// SetSeriesParts replaces posts of series of sid by pids in order, returns false
+// if series is not found, it fails if a post is missing or in another series
+func (pg *PGSQL) SetSeriesParts(sid int, pids []int) (bool, error) {
+	var (
+		performed bool
+	)
+	parts := make(pq.Int64Array, len(pids))
+	for i, pid := range pids {
+		parts[i] = int64(pid)
+	}
+	err := pg.instance.QueryRow(`SELECT * FROM public.setSeriesParts($1, $2)`, sid, parts).Scan(&performed)
+	if err != nil {
+		return false, fmt.Errorf("select from setSeriesParts(): %v", err)
+	}
+	return performed, nil
+}
+
+// scanSeries scans columns of SeriesView into a series
+func scanSeries(rs rowScanner) (*db.Series, error) {
+	var (
+		s     db.Series
+		parts []byte
+	)
+	err := rs.Scan(&s.SeriesID, &s.Title, &s.Description, &parts)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(parts, &s.Parts)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal parts: %v", err)
+	}
+	if s.Parts == nil {
+		s.Parts = []db.PostLink{}
+	}
+	return &s, nil
+}
+
+// GetSeries returns series of sid with its posts in order
+func (pg *PGSQL) GetSeries(sid int) (*db.Series, error) {
+	s, err := scanSeries(pg.instance.QueryRow(`SELECT * FROM public.getSeries($1)`, sid))
+	if err != nil {
+		return nil, fmt.Errorf("select from getSeries(): %v", err)
+	}
+	return s, nil
+}
+
+// GetAllSeries returns every series with its posts in order, ordered by title
+func (pg *PGSQL) GetAllSeries() ([]db.Series, error) {
+	series := []db.Series{}
+	rs, err := pg.instance.Query(`SELECT * FROM public.getAllSeries()`)
+	if err != nil {
+		return nil, fmt.Errorf("select from getAllSeries(): %v", err)
+	}
+	defer rs.Close()
+	for rs.Next() {
+		s, err := scanSeries(rs)
+		if err != nil {
+			return nil, fmt.Errorf("parse query result: %v", err)
+		}
+		series = append(series, *s)
+	}
+	if rs.Err() != nil {
+		return nil, fmt.Errorf("perform query: %v", rs.Err())
+	}
+	return series, nil
+}
+
+// GetPostSeries returns where post of pid is in its series, nil if it is in none
+func (pg *PGSQL) GetPostSeries(pid int) (*db.SeriesPosition, error) {
+	var (
+		sp                   db.SeriesPosition
+		prevID, nextID       sql.NullInt64
+		prevTitle, nextTitle sql.NullString
+	)
+	err := pg.instance.QueryRow(`SELECT * FROM public.getPostSeries($1)`, pid).Scan(&sp.SeriesID, &sp.Title, &sp.Part, &sp.Total,
+		&prevID, &prevTitle, &nextID, &nextTitle)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("select from getPostSeries(): %v", err)
+	}
+	sp.Prev, sp.Next = postLink(prevID, prevTitle), postLink(nextID, nextTitle)
+	return &sp, nil
+}
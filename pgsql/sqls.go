@@ -3,37 +3,64 @@ package pgsql
 import (
 	"crypto/sha256"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"middleware/handler/db"
+	"strconv"
 	"time"
 
 	"github.com/lib/pq"
 )
 
-// GetPostByID use pid to filter posts, then returns it
-func (pg *PGSQL) GetPostByID(pid int) (*db.Post, error) {
-	var (
-		id    int
-		c, t  string
-		cDate time.Time
-		mDate pq.NullTime
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
 
-		tgs pq.StringArray
-		p   *db.Post
+// scanPost scans columns of PostView into a post, columns following them are scanned into extra
+func scanPost(rs rowScanner, extra ...interface{}) (*db.Post, error) {
+	var (
+		p         db.Post
+		cDate     time.Time
+		mDate     pq.NullTime
+		tgs       pq.StringArray
+		group     sql.NullInt64
+		reactions []byte
+		pinUntil  pq.NullTime
 	)
-	err := pg.instance.QueryRow(`SELECT * FROM public.getPostByID($1)`, pid).Scan(&id, &t, &cDate, &mDate, &c, &tgs)
+	dest := append([]interface{}{&p.PostID, &p.Title, &cDate, &mDate, &p.Content, &tgs, &p.Language, &group, &reactions,
+		&p.Pinned, &pinUntil, &p.Featured, &p.Version, &p.CommentCount}, extra...)
+	err := rs.Scan(dest...)
 	if err != nil {
-		return nil, fmt.Errorf("select from getPostByID(): %v", err)
+		return nil, err
 	}
+	err = json.Unmarshal(reactions, &p.Reactions)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal reactions: %v", err)
+	}
+	cD := db.Jstime(cDate)
+	p.CDate = &cD
 	if mDate.Valid {
-		cD := db.Jstime(cDate)
 		mD := db.Jstime(mDate.Time)
+		p.MDate = &mD
+	}
+	p.Tags = []string(tgs)
+	if group.Valid {
+		p.TranslationGroup = int(group.Int64)
+	}
+	if pinUntil.Valid {
+		pU := db.Jstime(pinUntil.Time)
+		p.PinnedUntil = &pU
+	}
+	return &p, nil
+}
 
-		p = &db.Post{PostID: id, Title: t, CDate: &cD, MDate: &mD, Content: c, Tags: []string(tgs)}
-	} else {
-		cD := db.Jstime(cDate)
-		p = &db.Post{PostID: pid, Title: t, CDate: &cD, MDate: nil, Content: c, Tags: []string(tgs)}
+// GetPostByID use pid to filter posts, then returns it
+func (pg *PGSQL) GetPostByID(pid int) (*db.Post, error) {
+	p, err := scanPost(pg.instance.QueryRow(`SELECT * FROM public.getPostByID($1)`, pid))
+	if err != nil {
+		return nil, fmt.Errorf("select from getPostByID(): %v", err)
 	}
 	return p, nil
 }
@@ -50,7 +77,65 @@ func (pg *PGSQL) GetCommentsCount(pid int) (int, error) {
 	return count, nil
 }
 
-// GetCommentsByPage accepts pageSize and page, then returns comments bound to a post
+// GetThreadsCount returns number of top-level comments of a post
+func (pg *PGSQL) GetThreadsCount(pid int) (int, error) {
+	var (
+		count int
+	)
+	err := pg.instance.QueryRow(`SELECT public.getThreadsCount($1)`, pid).Scan(&count)
+	if err != nil {
+		return -1, fmt.Errorf("select from getThreadsCount(): %v", err)
+	}
+	return count, nil
+}
+
+// scanComment scans columns of CommentView into a comment, columns following them are scanned into extra
+func scanComment(rs rowScanner, extra ...interface{}) (*db.Comment, error) {
+	var (
+		c         db.Comment
+		cDate     time.Time
+		parent    sql.NullInt64
+		scores    []byte
+		uid       sql.NullInt64
+		createdAt time.Time
+		editedAt  pq.NullTime
+	)
+	dest := append([]interface{}{&c.PostID, &c.CommentID, &c.Email, &c.AuthorName, &cDate, &c.Content, &c.Version, &parent, &c.Depth,
+		&c.Deleted, &c.Status, &scores, &uid, &createdAt, &editedAt, &c.NotifyReplies}, extra...)
+	err := rs.Scan(dest...)
+	if err != nil {
+		return nil, err
+	}
+	if scores != nil {
+		err = json.Unmarshal(scores, &c.SpamScores)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal spam scores: %v", err)
+		}
+	}
+	cD := db.Jstime(cDate)
+	c.CDate = &cD
+	c.ParentID = int(parent.Int64)
+	c.UID = int(uid.Int64)
+	cA := db.Jstime(createdAt)
+	c.CreatedAt = &cA
+	if editedAt.Valid {
+		eA := db.Jstime(editedAt.Time)
+		c.EditedAt = &eA
+	}
+	return &c, nil
+}
+
+// GetComment returns comment of cid
+func (pg *PGSQL) GetComment(cid int) (*db.Comment, error) {
+	c, err := scanComment(pg.instance.QueryRow(`SELECT * FROM public.getComment($1)`, cid))
+	if err != nil {
+		return nil, fmt.Errorf("select from getComment(): %v", err)
+	}
+	return c, nil
+}
+
+// GetCommentsByPage accepts pageSize and page of top-level threads, then returns comments
+// of those threads bound to a post, each reply follows its parent
 func (pg *PGSQL) GetCommentsByPage(pid int, pageSize int, page int) ([]db.Comment, error) {
 	cmts := []db.Comment{}
 
@@ -60,21 +145,14 @@ func (pg *PGSQL) GetCommentsByPage(pid int, pageSize int, page int) ([]db.Commen
 	}
 	defer rs.Close()
 	for rs.Next() {
-		var (
-			id, cid int
-			e       string
-			cDate   time.Time
-			c       string
-		)
-		err := rs.Scan(&id, &cid, &e, &cDate, &c)
+		c, err := scanComment(rs)
 		if err != nil {
 			return nil, fmt.Errorf("parse query result: %v", err)
 		}
-		cD := db.Jstime(cDate)
-		cmts = append(cmts, db.Comment{PostID: id, CommentID: cid, Email: e, CDate: &cD, Content: c})
+		cmts = append(cmts, *c)
 	}
 	if rs.Err() != nil {
-		return nil, fmt.Errorf("perform query: %v", err)
+		return nil, fmt.Errorf("perform query: %v", rs.Err())
 	}
 	if len(cmts) == 0 {
 		return nil, errors.New("no comments found")
@@ -105,29 +183,14 @@ func (pg *PGSQL) GetPosts(pageSize, page int) ([]db.Post, error) {
 	defer rs.Close()
 
 	for rs.Next() {
-		var (
-			id    int
-			c, t  string
-			cDate time.Time
-			mDate pq.NullTime
-			tgs   pq.StringArray
-		)
-		err := rs.Scan(&id, &t, &cDate, &mDate, &c, &tgs)
+		p, err := scanPost(rs)
 		if err != nil {
 			return nil, fmt.Errorf("parse query result: %v", err)
 		}
-		if mDate.Valid {
-			cD := db.Jstime(cDate)
-			mD := db.Jstime(mDate.Time)
-			posts = append(posts, db.Post{PostID: id, Title: t, CDate: &cD, MDate: &mD, Content: c, Tags: []string(tgs)})
-		} else {
-			cD := db.Jstime(cDate)
-			posts = append(posts, db.Post{PostID: id, Title: t, CDate: &cD, MDate: nil, Content: c, Tags: []string(tgs)})
-		}
-
+		posts = append(posts, *p)
 	}
 	if rs.Err() != nil {
-		return nil, fmt.Errorf("perform query: %v", err)
+		return nil, fmt.Errorf("perform query: %v", rs.Err())
 	}
 	if len(posts) == 0 {
 		return nil, errors.New("no posts found")
@@ -135,25 +198,28 @@ func (pg *PGSQL) GetPosts(pageSize, page int) ([]db.Post, error) {
 	return posts, nil
 }
 
-// GetPostsCountByFTS uses search string to filter posts, then returns count of found posts
-func (pg *PGSQL) GetPostsCountByFTS(search string) (int, error) {
+// GetPostsCountByFTS uses websearch query to filter posts written in lang, or in any language
+// if lang is empty, then returns count of found posts
+func (pg *PGSQL) GetPostsCountByFTS(search, lang string) (int, error) {
 	var (
 		count int
 	)
 
-	err := pg.instance.QueryRow(`SELECT public.getPostsCountByFTS($1)`, search).Scan(&count)
+	err := pg.instance.QueryRow(`SELECT public.getPostsCountByFTS($1, $2)`, search, sql.NullString{String: lang, Valid: lang != ""}).Scan(&count)
 	if err != nil {
 		return -1, fmt.Errorf("select from getPostsCountByFTS(): %v", err)
 	}
 	return count, nil
 }
 
-// GetPostsByFTS uses search string, page, pageSize to filter posts, then returns them
-func (pg *PGSQL) GetPostsByFTS(search string, pageSize, page int) (posts []db.Post, err error) {
-	posts = []db.Post{}
+// GetPostsByFTS uses websearch query, page, pageSize to filter posts written in lang, or in any
+// language if lang is empty, then returns them ordered by rank with a headline snippet whose
+// matched words are wrapped in markers of hl
+func (pg *PGSQL) GetPostsByFTS(search, lang string, hl *db.Highlight, pageSize, page int) ([]db.Post, error) {
+	posts := []db.Post{}
 
-	var rs *sql.Rows
-	rs, err = pg.instance.Query(`SELECT * FROM public.getPostsByFTS($1, $2, $3)`, search, pageSize, page)
+	rs, err := pg.instance.Query(`SELECT * FROM public.getPostsByFTS($1, $2, $3, $4, $5, $6)`,
+		search, sql.NullString{String: lang, Valid: lang != ""}, pageSize, page, hl.StartSel, hl.StopSel)
 	if err != nil {
 		return nil, fmt.Errorf("select from getPostsByFTS(): %v", err)
 	}
@@ -161,29 +227,73 @@ func (pg *PGSQL) GetPostsByFTS(search string, pageSize, page int) (posts []db.Po
 
 	for rs.Next() {
 		var (
-			pid   int
-			t, c  string
-			cDate time.Time
-			mDate pq.NullTime
-			tgs   pq.StringArray
+			rank    float64
+			snippet string
 		)
-		err := rs.Scan(&pid, &t, &cDate, &mDate, &c, &tgs)
+		p, err := scanPost(rs, &rank, &snippet)
 		if err != nil {
 			return nil, fmt.Errorf("parse query result: %v", err)
 		}
-		if mDate.Valid {
-			cD := db.Jstime(cDate)
-			mD := db.Jstime(mDate.Time)
-			posts = append(posts, db.Post{PostID: pid, Title: t, CDate: &cD, MDate: &mD, Content: c, Tags: tgs})
-		} else {
-			cD := db.Jstime(cDate)
-			posts = append(posts, db.Post{PostID: pid, Title: t, CDate: &cD, MDate: nil, Content: c, Tags: tgs})
+		p.Rank = rank
+		p.Snippet = snippet
+		posts = append(posts, *p)
+	}
+	if rs.Err() != nil {
+		return nil, fmt.Errorf("perform query correctly: %v", rs.Err())
+	}
+	if len(posts) == 0 {
+		return nil, errors.New("no posts found")
+	}
+	return posts, nil
+}
 
-		}
+// GetPostsCountByFilter returns count of posts matching condition of f
+func (pg *PGSQL) GetPostsCountByFilter(f *db.PostFilter) (int, error) {
+	var (
+		count int
+	)
+	err := pg.instance.QueryRow(`SELECT count(*) FROM Posts p WHERE `+f.Cond, f.Args...).Scan(&count)
+	if err != nil {
+		return -1, fmt.Errorf("select count of filtered posts: %v", err)
+	}
+	return count, nil
+}
+
+// GetPostsByFilter uses condition of f, page, pageSize to select posts, newest first,
+// after pinned ones if f asks so
+func (pg *PGSQL) GetPostsByFilter(f *db.PostFilter, pageSize, page int) ([]db.Post, error) {
+	posts := []db.Post{}
+
+	order := `p.cDate DESC, p.postID DESC`
+	if f.PinnedFirst {
+		order = `(p.pinned AND (p.pinnedUntil IS NULL OR p.pinnedUntil > now())) DESC, ` + order
+	}
 
+	n := len(f.Args)
+	args := append(append([]interface{}{}, f.Args...), pageSize, (page-1)*pageSize)
+	rs, err := pg.instance.Query(`SELECT p.postID, p.title, p.cDate, p.mDate, p.content,
+		ARRAY(SELECT t.tag FROM Tags t WHERE t.postID = p.postID ORDER BY t.tagID),
+		p.language, p.translationGroup,
+		COALESCE((SELECT jsonb_object_agg(rc.emoji, rc.count) FROM ReactionCounts rc WHERE rc.postID = p.postID AND rc.count > 0), '{}'),
+		p.pinned AND (p.pinnedUntil IS NULL OR p.pinnedUntil > now()), p.pinnedUntil, p.featured, p.version,
+		COALESCE(cc.count, 0)
+		FROM Posts p LEFT JOIN CommentCounts cc ON cc.postID = p.postID WHERE `+f.Cond+`
+		ORDER BY `+order+`
+		LIMIT $`+strconv.Itoa(n+1)+` OFFSET $`+strconv.Itoa(n+2), args...)
+	if err != nil {
+		return nil, fmt.Errorf("select filtered posts: %v", err)
+	}
+	defer rs.Close()
+
+	for rs.Next() {
+		p, err := scanPost(rs)
+		if err != nil {
+			return nil, fmt.Errorf("parse query result: %v", err)
+		}
+		posts = append(posts, *p)
 	}
 	if rs.Err() != nil {
-		return nil, fmt.Errorf("perform query correctly: %v", err)
+		return nil, fmt.Errorf("perform query: %v", rs.Err())
 	}
 	if len(posts) == 0 {
 		return nil, errors.New("no posts found")
@@ -191,6 +301,39 @@ func (pg *PGSQL) GetPostsByFTS(search string, pageSize, page int) (posts []db.Po
 	return posts, nil
 }
 
+// GetSuggestions returns titles similar to search as completions and
+// words of titles and tags similar to search as corrections, at most limit of each
+func (pg *PGSQL) GetSuggestions(search string, limit int) (*db.Suggestions, error) {
+	sgs := &db.Suggestions{Completions: []string{}, Corrections: []string{}}
+
+	for _, q := range []struct {
+		fn  string
+		dst *[]string
+	}{
+		{"getTitleCompletions", &sgs.Completions},
+		{"getSpellCorrections", &sgs.Corrections},
+	} {
+		rs, err := pg.instance.Query(`SELECT * FROM public.`+q.fn+`($1, $2)`, search, limit)
+		if err != nil {
+			return nil, fmt.Errorf("select from %s(): %v", q.fn, err)
+		}
+		for rs.Next() {
+			var w string
+			if err := rs.Scan(&w); err != nil {
+				rs.Close()
+				return nil, fmt.Errorf("parse query result: %v", err)
+			}
+			*q.dst = append(*q.dst, w)
+		}
+		err = rs.Err()
+		rs.Close()
+		if err != nil {
+			return nil, fmt.Errorf("perform query: %v", err)
+		}
+	}
+	return sgs, nil
+}
+
 // UserLogin uses username, password to login user, then returns true if user existing
 func (pg *PGSQL) UserLogin(userName string, pass [sha256.Size]byte) (*db.User, error) {
 	var (
@@ -206,12 +349,12 @@ func (pg *PGSQL) UserLogin(userName string, pass [sha256.Size]byte) (*db.User, e
 	return &db.User{UID: id, UserName: unm, Privilege: pri}, nil
 }
 
-// InsertPost inserts post and return its pid
-func (pg *PGSQL) InsertPost(t string, c string, tags []string) (int, error) {
+// InsertPost inserts post written in lang by user of authorUID, 0 if unknown, and return its pid
+func (pg *PGSQL) InsertPost(t string, c string, tags []string, lang string, authorUID int) (int, error) {
 	var (
 		pid int
 	)
-	err := pg.instance.QueryRow(`SELECT * FROM public.insertPost($1, $2, $3)`, t, c, pq.StringArray(tags)).Scan(&pid)
+	err := pg.instance.QueryRow(`SELECT * FROM public.insertPost($1, $2, $3, $4, $5)`, t, c, pq.StringArray(tags), lang, nullID(authorUID)).Scan(&pid)
 	if err != nil {
 		return -1, fmt.Errorf("select from insertPost(): %v", err)
 	}
@@ -230,34 +373,245 @@ func (pg *PGSQL) DeletePost(pid int) (bool, error) {
 	return performed, nil
 }
 
-// UpdatePost update existing post, returns true if update performed while false if not found
-func (pg *PGSQL) UpdatePost(pid int, nTitle, nContent string, nTags []string) (bool, error) {
+// UpdatePost update existing post if its version is still version, language is kept if nLang is empty,
+// returns true if update performed while false if not found, *db.VersionConflict is
+// returned if post was updated since version
+func (pg *PGSQL) UpdatePost(pid, version int, nTitle, nContent string, nTags []string, nLang string) (bool, error) {
 	var (
 		performed bool
+		current   sql.NullInt64
 	)
 
-	err := pg.instance.QueryRow(`SELECT * FROM public.updatePost($1, $2, $3, $4)`, pid, nTitle, nContent, pq.StringArray(nTags)).Scan(&performed)
+	err := pg.instance.QueryRow(`SELECT * FROM public.updatePost($1, $2, $3, $4, $5, $6)`, pid, version, nTitle, nContent, pq.StringArray(nTags), sql.NullString{String: nLang, Valid: nLang != ""}).Scan(&performed, &current)
 
 	if err != nil {
 		return false, fmt.Errorf("select from updatePost(): %v", err)
 
 	}
+	return versionResult(performed, current)
+}
+
+// PatchPost changes fields of post set in p if its version is still version, results are same as UpdatePost
+func (pg *PGSQL) PatchPost(pid, version int, p *db.PostPatch) (bool, error) {
+	var (
+		performed bool
+		current   sql.NullInt64
+		tags      interface{}
+	)
+	// a null array keeps tags while an empty one removes them
+	if p.Tags != nil {
+		tags = pq.StringArray(append([]string{}, *p.Tags...))
+	}
+	err := pg.instance.QueryRow(`SELECT * FROM public.patchPost($1, $2, $3, $4, $5, $6)`, pid, version,
+		nullString(p.Title), nullString(p.Content), tags, nullString(p.Language)).Scan(&performed, &current)
+	if err != nil {
+		return false, fmt.Errorf("select from patchPost(): %v", err)
+	}
+	return versionResult(performed, current)
+}
+
+// nullString maps a nil field of a patch to null
+func nullString(s *string) sql.NullString {
+	if s == nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: *s, Valid: true}
+}
+
+// versionResult interprets result of a versioned update, current is null if row is not found
+func versionResult(performed bool, current sql.NullInt64) (bool, error) {
+	if !performed && current.Valid {
+		return false, &db.VersionConflict{Current: int(current.Int64)}
+	}
+	return performed, nil
+}
+
+// SetPostPinned pins post of pid until until, or forever if it is nil, or unpins it,
+// returns false if post is not found
+func (pg *PGSQL) SetPostPinned(pid int, pinned bool, until *time.Time) (bool, error) {
+	var (
+		performed bool
+		pinUntil  pq.NullTime
+	)
+	if until != nil {
+		pinUntil = pq.NullTime{Time: *until, Valid: true}
+	}
+	err := pg.instance.QueryRow(`SELECT * FROM public.setPostPinned($1, $2, $3)`, pid, pinned, pinUntil).Scan(&performed)
+	if err != nil {
+		return false, fmt.Errorf("select from setPostPinned(): %v", err)
+	}
+	return performed, nil
+}
+
+// SetPostFeatured marks post of pid as featured or not, returns false if post is not found
+func (pg *PGSQL) SetPostFeatured(pid int, featured bool) (bool, error) {
+	var (
+		performed bool
+	)
+	err := pg.instance.QueryRow(`SELECT * FROM public.setPostFeatured($1, $2)`, pid, featured).Scan(&performed)
+	if err != nil {
+		return false, fmt.Errorf("select from setPostFeatured(): %v", err)
+	}
+	return performed, nil
+}
+
+// GetCommentPolicy returns comment policy of post of pid, nil if it follows site default,
+// with date post is created
+func (pg *PGSQL) GetCommentPolicy(pid int) (*db.CommentPolicy, time.Time, error) {
+	var (
+		mode  sql.NullString
+		days  int
+		cDate time.Time
+	)
+	err := pg.instance.QueryRow(`SELECT * FROM public.getCommentPolicy($1)`, pid).Scan(&mode, &days, &cDate)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("select from getCommentPolicy(): %v", err)
+	}
+	if !mode.Valid {
+		return nil, cDate, nil
+	}
+	return &db.CommentPolicy{Mode: mode.String, CloseAfterDays: days}, cDate, nil
+}
+
+// SetCommentPolicy sets comment policy of post of pid, nil makes it follow site default,
+// returns false if post is not found
+func (pg *PGSQL) SetCommentPolicy(pid int, policy *db.CommentPolicy) (bool, error) {
+	var (
+		performed bool
+		mode      sql.NullString
+		days      int
+	)
+	if policy != nil {
+		mode = sql.NullString{String: policy.Mode, Valid: true}
+		days = policy.CloseAfterDays
+	}
+	err := pg.instance.QueryRow(`SELECT * FROM public.setCommentPolicy($1, $2, $3)`, pid, mode, days).Scan(&performed)
+	if err != nil {
+		return false, fmt.Errorf("select from setCommentPolicy(): %v", err)
+	}
+	return performed, nil
+}
+
+// LinkTranslation puts post of pid into translation group of post of groupPID,
+// returns false if either post is not found
+func (pg *PGSQL) LinkTranslation(pid, groupPID int) (bool, error) {
+	var (
+		performed bool
+	)
+	err := pg.instance.QueryRow(`SELECT * FROM public.linkTranslation($1, $2)`, pid, groupPID).Scan(&performed)
+	if err != nil {
+		return false, fmt.Errorf("select from linkTranslation(): %v", err)
+	}
+	return performed, nil
+}
+
+// UnlinkTranslation takes post of pid out of its translation group, returns false if not found
+func (pg *PGSQL) UnlinkTranslation(pid int) (bool, error) {
+	var (
+		performed bool
+	)
+	err := pg.instance.QueryRow(`SELECT * FROM public.unlinkTranslation($1)`, pid).Scan(&performed)
+	if err != nil {
+		return false, fmt.Errorf("select from unlinkTranslation(): %v", err)
+	}
+	return performed, nil
+}
+
+// GetTranslations returns other posts in translation group of post of pid
+func (pg *PGSQL) GetTranslations(pid int) ([]db.Translation, error) {
+	trs := []db.Translation{}
+	rs, err := pg.instance.Query(`SELECT * FROM public.getTranslations($1)`, pid)
+	if err != nil {
+		return nil, fmt.Errorf("select from getTranslations(): %v", err)
+	}
+	defer rs.Close()
+
+	for rs.Next() {
+		var tr db.Translation
+		err := rs.Scan(&tr.PostID, &tr.Language, &tr.Title)
+		if err != nil {
+			return nil, fmt.Errorf("parse query result: %v", err)
+		}
+		trs = append(trs, tr)
+	}
+	if rs.Err() != nil {
+		return nil, fmt.Errorf("perform query: %v", rs.Err())
+	}
+	return trs, nil
+}
+
+// GetPostTOC returns table of contents cached for post of pid with version of post it is made of,
+// toc is nil if it has not been made
+func (pg *PGSQL) GetPostTOC(pid int) ([]db.TOCEntry, int, error) {
+	var (
+		js      []byte
+		version sql.NullInt64
+		toc     []db.TOCEntry
+	)
+	err := pg.instance.QueryRow(`SELECT * FROM public.getPostTOC($1)`, pid).Scan(&js, &version)
+	if err != nil {
+		return nil, -1, fmt.Errorf("select from getPostTOC(): %v", err)
+	}
+	if js == nil {
+		return nil, 0, nil
+	}
+	err = json.Unmarshal(js, &toc)
+	if err != nil {
+		return nil, -1, fmt.Errorf("unmarshal toc: %v", err)
+	}
+	return toc, int(version.Int64), nil
+}
+
+// SetPostTOC caches toc made of content of post of pid at version, returns false if
+// post is not found or has been updated since version
+func (pg *PGSQL) SetPostTOC(pid, version int, toc []db.TOCEntry) (bool, error) {
+	var (
+		performed bool
+	)
+	if toc == nil {
+		toc = []db.TOCEntry{}
+	}
+	js, err := json.Marshal(toc)
+	if err != nil {
+		return false, fmt.Errorf("marshal toc: %v", err)
+	}
+	err = pg.instance.QueryRow(`SELECT * FROM public.setPostTOC($1, $2, $3)`, pid, version, js).Scan(&performed)
+	if err != nil {
+		return false, fmt.Errorf("select from setPostTOC(): %v", err)
+	}
 	return performed, nil
 }
 
-// InsertComment insert comment, returns cid of the inserted comment
-func (pg *PGSQL) InsertComment(pid int, c, authorEmail string) (int, error) {
+// nullID maps id 0 to null
+func nullID(id int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(id), Valid: id != 0}
+}
+
+// InsertComment insert comment c into post of its pid with its status, spam scores, uid of
+// its author, hash of its edit token and whether its author is notified of replies, it replies to comment of its ParentID unless that is 0,
+// returns cid of the inserted comment
+func (pg *PGSQL) InsertComment(c *db.Comment) (int, error) {
 	var (
-		cid int
+		cid    int
+		scores []byte
 	)
-	err := pg.instance.QueryRow(`SELECT * FROM public.insertComment($1, $2, $3)`, pid, c, authorEmail).Scan(&cid)
+	if c.SpamScores != nil {
+		var err error
+		scores, err = json.Marshal(c.SpamScores)
+		if err != nil {
+			return -1, fmt.Errorf("marshal spam scores: %v", err)
+		}
+	}
+	err := pg.instance.QueryRow(`SELECT * FROM public.insertComment($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`, c.PostID, nullID(c.ParentID), c.Content, c.Email,
+		c.AuthorName, nullID(c.UID), c.EditToken, c.Status, scores, c.NotifyReplies).Scan(&cid)
 	if err != nil {
 		return -1, fmt.Errorf("select from insertComment(): %v", err)
 	}
 	return cid, nil
 }
 
-// DeleteComment deletes comment of cid, returns true if performed while false in case of not found
+// DeleteComment deletes comment of cid, a comment with replies is kept as a placeholder,
+// returns true if performed while false in case of not found
 func (pg *PGSQL) DeleteComment(cid int) (bool, error) {
 	var (
 		performed bool
@@ -269,16 +623,67 @@ func (pg *PGSQL) DeleteComment(cid int) (bool, error) {
 	return performed, nil
 }
 
-// UpdateComment updates comment of cid, returns true if performed while false in case of not found
-func (pg *PGSQL) UpdateComment(cid int, nConent, nAE string) (bool, error) {
+// UpdateComment updates comment of cid if its version is still version, returns true if performed
+// while false in case of not found, *db.VersionConflict is returned if comment was updated since version
+func (pg *PGSQL) UpdateComment(cid, version int, nConent, nAE string) (bool, error) {
 	var (
 		performed bool
+		current   sql.NullInt64
 	)
-	err := pg.instance.QueryRow(`SELECT * FROM public.updateComment($1, $2, $3)`, cid, nConent, nAE).Scan(&performed)
+	err := pg.instance.QueryRow(`SELECT * FROM public.updateComment($1, $2, $3, $4)`, cid, version, nConent, nAE).Scan(&performed, &current)
 	if err != nil {
 		return false, fmt.Errorf("select from updateComment(): %v", err)
 	}
-	return performed, nil
+	return versionResult(performed, current)
+}
+
+// GetCommentEditToken returns sha256 of edit token of comment of cid, nil if it has none
+func (pg *PGSQL) GetCommentEditToken(cid int) ([]byte, error) {
+	var (
+		hash []byte
+	)
+	err := pg.instance.QueryRow(`SELECT public.getCommentEditToken($1)`, cid).Scan(&hash)
+	if err != nil {
+		return nil, fmt.Errorf("select from getCommentEditToken(): %v", err)
+	}
+	return hash, nil
+}
+
+// EditComment changes content of comment of cid, with status and spam scores it is moderated
+// into, if its version is still version and it was submitted after since, results are same
+// as UpdateComment
+func (pg *PGSQL) EditComment(cid, version int, nContent, status string, scores []db.SpamScore, since time.Time) (bool, error) {
+	var (
+		performed bool
+		current   sql.NullInt64
+		nScores   []byte
+	)
+	if scores != nil {
+		var err error
+		nScores, err = json.Marshal(scores)
+		if err != nil {
+			return false, fmt.Errorf("marshal spam scores: %v", err)
+		}
+	}
+	err := pg.instance.QueryRow(`SELECT * FROM public.editComment($1, $2, $3, $4, $5, $6)`, cid, version, nContent, status, nScores, since).Scan(&performed, &current)
+	if err != nil {
+		return false, fmt.Errorf("select from editComment(): %v", err)
+	}
+	return versionResult(performed, current)
+}
+
+// PatchComment changes fields of comment set in p if its version is still version, results are same as UpdateComment
+func (pg *PGSQL) PatchComment(cid, version int, p *db.CommentPatch) (bool, error) {
+	var (
+		performed bool
+		current   sql.NullInt64
+	)
+	err := pg.instance.QueryRow(`SELECT * FROM public.patchComment($1, $2, $3, $4)`, cid, version,
+		nullString(p.Content), nullString(p.Email)).Scan(&performed, &current)
+	if err != nil {
+		return false, fmt.Errorf("select from patchComment(): %v", err)
+	}
+	return versionResult(performed, current)
 }
 
 // GetUser accepts userName and passWord to check if certain user exists for purpose of login
@@ -300,7 +705,7 @@ func (pg *PGSQL) InsertUser(userName string, passWord [sha256.Size]byte) (int, e
 	var (
 		uid int
 	)
-	err := pg.instance.QueryRow(`SELECT * FROM public.insertUser($1, $2, $3)`, userName, passWord[:]).Scan(&uid)
+	err := pg.instance.QueryRow(`SELECT * FROM public.insertUser($1, $2)`, userName, passWord[:]).Scan(&uid)
 	if err != nil {
 		return -1, fmt.Errorf("select from insertUser(): %v", err)
 	}
@@ -312,7 +717,7 @@ func (pg *PGSQL) UpdateUser(uid int, nPW [sha256.Size]byte) (bool, error) {
 	var (
 		performed bool
 	)
-	err := pg.instance.QueryRow(`SELECT * FROM public.updateUser($1,$2,$3)`, uid, nPW).Scan(&performed)
+	err := pg.instance.QueryRow(`SELECT * FROM public.updateUser($1, $2)`, uid, nPW[:]).Scan(&performed)
 	if err != nil {
 		return false, fmt.Errorf("select from updateUser(): %v", err)
 	}
@@ -1,30 +1,69 @@
 package main
 
 import (
-        "log"
-        "middleware/handler"
-        "middleware/pgsql"
-        "net/http"
-        "golang.org/x/crypto/acme/autocert"
+	"context"
+	"golang.org/x/crypto/acme/autocert"
+	"log"
+	"middleware/handler"
+	"middleware/localfs"
+	"middleware/pgsql"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
 
-        db, err := pgsql.New(&pgsql.PGConfig{User: "blogdbu", Pass: "123s;,nl", DBName: "blog"})
-        if err != nil {
-                log.Fatalf("setup db server: %v\n", err)
-        }
-        defer db.Close()
+	db, err := pgsql.New(&pgsql.PGConfig{User: "blogdbu", Pass: "123s;,nl", DBName: "blog"})
+	if err != nil {
+		log.Fatalf("setup db server: %v\n", err)
+	}
+	defer db.Close()
 
-        // srvConfig := &SrvConfig{Host: "172.31.41.201", Port: 8443}
-        srv := http.Server{
-                Addr:    ":443",
-                Handler: handler.New(db),
-        }
+	if len(os.Args) > 1 {
+		if err := runCommand(db, os.Args[1:]); err != nil {
+			log.Fatalf("run %s: %v\n", os.Args[1], err)
+		}
+		return
+	}
 
-        crt := autocert.NewListener("api.redhand.vip")
+	media, err := localfs.New(&localfs.FSConfig{Dir: "media", BaseURL: "https://api.redhand.vip/media/files"})
+	if err != nil {
+		log.Fatalf("setup media storage: %v\n", err)
+	}
 
-        if err := srv.Serve(crt); err != nil && err != http.ErrServerClosed {
-                log.Fatalf("setup server: %v\n", err)
-        }
-}
\ No newline at end of file
+	h, err := handler.New(db, &handler.Config{Media: handler.MediaConfig{Storage: media}})
+	if err != nil {
+		log.Fatalf("setup handler: %v\n", err)
+	}
+
+	// srvConfig := &SrvConfig{Host: "172.31.41.201", Port: 8443}
+	srv := http.Server{
+		Addr:    ":443",
+		Handler: h,
+	}
+
+	crt := autocert.NewListener("api.redhand.vip")
+
+	// requests in flight are finished before handler flushes what it buffered
+	shutdown := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("shutdown server: %v\n", err)
+		}
+		close(shutdown)
+	}()
+
+	if err := srv.Serve(crt); err != nil && err != http.ErrServerClosed {
+		log.Fatalf("setup server: %v\n", err)
+	}
+	<-shutdown
+	h.Close()
+}